@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,6 +9,7 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/exec"
 	"strings"
@@ -20,7 +22,7 @@ import (
 
 var (
 	rateLimit = 5
-	exemptIps []*net.IPNet
+	exemptIps []netip.Prefix
 )
 
 const numIPs = 100
@@ -81,7 +83,7 @@ func main() {
 }
 
 func generateUniquePublicIPs(n int) []string {
-	ipSet := make(map[string]struct{})
+	ipSet := make(map[netip.Prefix]struct{})
 	var ips []string
 	config := cp.CreateConfig()
 	bc := &cp.CaptchaProtect{}
@@ -100,10 +102,10 @@ func generateUniquePublicIPs(n int) []string {
 
 	for len(ips) < n {
 		ip := randomPublicIP(config)
-		ip, ipRange := bc.ParseIp(ip)
+		addr, ipRange := bc.ParseIp(netip.MustParseAddr(ip))
 		if _, exists := ipSet[ipRange]; !exists {
 			ipSet[ipRange] = struct{}{}
-			ips = append(ips, ip)
+			ips = append(ips, addr.String())
 		}
 	}
 
@@ -119,7 +121,12 @@ func randomPublicIP(config *cp.Config) string {
 			rand.Intn(254)+1,
 		)
 
-		if !helper.IsIpExcluded(ip, exemptIps) && !helper.IsIpGoodBot(ip, config.GoodBots) {
+		addr := netip.MustParseAddr(ip)
+		if helper.IsIpExcluded(addr, exemptIps) {
+			continue
+		}
+		goodBot, _ := helper.IsIpGoodBot(context.Background(), net.DefaultResolver, addr, config.GoodBots)
+		if !goodBot {
 			return ip
 		}
 	}
@@ -275,8 +282,8 @@ func checkStateReload() {
 	slog.Info("State reloaded successfully!")
 }
 
-func parseCIDR(cidr string) *net.IPNet {
-	_, block, err := net.ParseCIDR(cidr)
+func parseCIDR(cidr string) netip.Prefix {
+	block, err := helper.ParseCIDR(cidr)
 	if err != nil {
 		slog.Error("Failed to parse CIDR", "cidr", cidr, "err", err)
 	}
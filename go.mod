@@ -1,5 +1,3 @@
 module github.com/dararish/captcha-protect
 
 go 1.24.0
-
-require github.com/patrickmn/go-cache v2.1.0+incompatible
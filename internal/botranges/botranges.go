@@ -0,0 +1,208 @@
+package botranges
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dararish/captcha-protect/internal/cidrset"
+	"github.com/dararish/captcha-protect/internal/helper"
+)
+
+// published lists are a few hundred KB at most
+const maxListSize = 10 << 20
+
+// Source is a published list of crawler IP ranges, as shown on the stats page
+type Source struct {
+	Name     string    `json:"name"`
+	Prefixes int       `json:"prefixes"`
+	Updated  time.Time `json:"updated,omitzero"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Table holds the IP ranges of every source
+// A source that fails to update keeps the ranges it last loaded
+type Table struct {
+	client  *http.Client
+	sources []string
+	mu      sync.RWMutex
+	ranges  map[string]*cidrset.Set
+	status  map[string]Source
+}
+
+// New creates an empty table for the given sources
+// A source is a file path, or an http(s) URL
+func New(sources []string, client *http.Client) *Table {
+	t := &Table{
+		client:  client,
+		sources: sources,
+		ranges:  make(map[string]*cidrset.Set, len(sources)),
+		status:  make(map[string]Source, len(sources)),
+	}
+	for _, src := range sources {
+		t.status[src] = Source{Name: src}
+	}
+
+	return t
+}
+
+// IsURL reports whether the source is fetched over http(s) rather than read from disk
+func IsURL(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// Sources returns the configured sources
+func (t *Table) Sources() []string {
+	return t.sources
+}
+
+// Lookup returns the source whose ranges contain ip
+func (t *Table) Lookup(ip netip.Addr) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, src := range t.sources {
+		if t.ranges[src].Contains(ip) {
+			return src, true
+		}
+	}
+
+	return "", false
+}
+
+// Status returns the state of each source, in the configured order
+func (t *Table) Status() []Source {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	status := make([]Source, 0, len(t.sources))
+	for _, src := range t.sources {
+		status = append(status, t.status[src])
+	}
+
+	return status
+}
+
+// Update reloads the ranges for one source
+func (t *Table) Update(ctx context.Context, src string) error {
+	var prefixes []netip.Prefix
+	var err error
+	if IsURL(src) {
+		prefixes, err = t.fetch(ctx, src)
+	} else {
+		prefixes, err = load(src)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := t.status[src]
+	if err != nil {
+		status.Error = err.Error()
+		t.status[src] = status
+		return err
+	}
+
+	t.ranges[src] = cidrset.New(prefixes)
+	t.status[src] = Source{
+		Name:     src,
+		Prefixes: len(prefixes),
+		Updated:  time.Now(),
+	}
+
+	return nil
+}
+
+func load(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Parse(io.LimitReader(f, maxListSize))
+}
+
+func (t *Table) fetch(ctx context.Context, url string) ([]netip.Prefix, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching %s: %s", url, resp.Status)
+	}
+
+	return Parse(io.LimitReader(resp.Body, maxListSize))
+}
+
+// published JSON lists, e.g. https://developers.google.com/static/search/apis/ipranges/googlebot.json
+// Bing, Apple and OpenAI use the same format
+type publishedList struct {
+	Prefixes []struct {
+		IPv4Prefix string `json:"ipv4Prefix"`
+		IPv6Prefix string `json:"ipv6Prefix"`
+	} `json:"prefixes"`
+}
+
+// Parse reads a JSON list in the format crawler operators publish,
+// or a plain text list with one CIDR or IP per line and # comments
+func Parse(r io.Reader) ([]netip.Prefix, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var cidrs []string
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var list publishedList
+		if err := json.Unmarshal(trimmed, &list); err != nil {
+			return nil, fmt.Errorf("invalid IP range JSON: %v", err)
+		}
+		for _, p := range list.Prefixes {
+			for _, cidr := range []string{p.IPv4Prefix, p.IPv6Prefix} {
+				if cidr != "" {
+					cidrs = append(cidrs, cidr)
+				}
+			}
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line, _, _ := strings.Cut(scanner.Text(), "#")
+			line = strings.TrimSpace(line)
+			if line != "" {
+				cidrs = append(cidrs, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := helper.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %s: %v", cidr, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
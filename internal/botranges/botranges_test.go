@@ -0,0 +1,153 @@
+package botranges
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const googlebotJSON = `{
+  "creationTime": "2025-01-01T00:00:00.000000",
+  "prefixes": [
+    {"ipv6Prefix": "2001:4860:4801:10::/64"},
+    {"ipv4Prefix": "66.249.64.0/27"}
+  ]
+}`
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+		wantErr  bool
+	}{
+		{
+			name:     "Published JSON",
+			input:    googlebotJSON,
+			expected: []string{"66.249.64.0/27", "2001:4860:4801:10::/64"},
+		},
+		{
+			name:     "Plain text with comments and bare IPs",
+			input:    "# crawler ranges\n20.15.240.64/28\n\n  40.77.167.0/24 # bingbot\n2001:db8::1\n",
+			expected: []string{"20.15.240.64/28", "40.77.167.0/24", "2001:db8::1/128"},
+		},
+		{
+			name:     "Host bits are masked",
+			input:    "1.2.3.4/24",
+			expected: []string{"1.2.3.0/24"},
+		},
+		{
+			name:    "Invalid JSON",
+			input:   `{"prefixes": [`,
+			wantErr: true,
+		},
+		{
+			name:    "Invalid CIDR",
+			input:   "1.2.3.0/24\nnot-an-ip\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			prefixes, err := Parse(strings.NewReader(tc.input))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Parse() error = %v; wantErr %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+
+			got := map[string]bool{}
+			for _, p := range prefixes {
+				got[p.String()] = true
+			}
+			if len(got) != len(tc.expected) {
+				t.Errorf("Parse() = %v; expected %v", prefixes, tc.expected)
+			}
+			for _, e := range tc.expected {
+				if !got[e] {
+					t.Errorf("Parse() = %v; missing %s", prefixes, e)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "googlebot.json")
+	if err := os.WriteFile(path, []byte(googlebotJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	table := New([]string{path}, http.DefaultClient)
+	if err := table.Update(context.Background(), path); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	src, ok := table.Lookup(netip.MustParseAddr("66.249.64.1"))
+	if !ok || src != path {
+		t.Errorf("Lookup() = %q, %v; expected %q, true", src, ok, path)
+	}
+	if _, ok := table.Lookup(netip.MustParseAddr("66.249.65.1")); ok {
+		t.Error("expected 66.249.65.1 to be outside the published ranges")
+	}
+
+	status := table.Status()
+	if len(status) != 1 || status[0].Prefixes != 2 || status[0].Updated.IsZero() {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	if err := table.Update(context.Background(), filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestUpdateFromURL(t *testing.T) {
+	body := googlebotJSON
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(status)
+		_, _ = rw.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	url := srv.URL + "/googlebot.json"
+	table := New([]string{url}, srv.Client())
+	if err := table.Update(context.Background(), url); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, ok := table.Lookup(netip.MustParseAddr("2001:4860:4801:10::1")); !ok {
+		t.Error("expected 2001:4860:4801:10::1 to be in the published ranges")
+	}
+
+	// a failed refresh keeps the ranges that were last loaded
+	status = http.StatusInternalServerError
+	if err := table.Update(context.Background(), url); err == nil {
+		t.Fatal("expected an error for a 500 response")
+	}
+	if _, ok := table.Lookup(netip.MustParseAddr("66.249.64.1")); !ok {
+		t.Error("expected the previous ranges to be kept after a failed refresh")
+	}
+	if s := table.Status()[0]; s.Error == "" || s.Prefixes != 2 {
+		t.Errorf("unexpected status %+v", s)
+	}
+
+	// a successful refresh replaces the ranges and clears the error
+	status = http.StatusOK
+	body = "40.77.167.0/24\n"
+	if err := table.Update(context.Background(), url); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, ok := table.Lookup(netip.MustParseAddr("66.249.64.1")); ok {
+		t.Error("expected the old ranges to be replaced")
+	}
+	if s := table.Status()[0]; s.Error != "" || s.Prefixes != 1 {
+		t.Errorf("unexpected status %+v", s)
+	}
+}
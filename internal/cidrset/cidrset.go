@@ -0,0 +1,184 @@
+package cidrset
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sort"
+)
+
+// Set is an immutable set of CIDRs
+// Prefixes are merged into sorted, non-overlapping address ranges,
+// so a lookup is a binary search however many prefixes there are
+type Set struct {
+	v4  []range4
+	v6  []range6
+	len int
+}
+
+type range4 struct {
+	start, end uint32
+}
+
+// uint128 is an IPv6 address as two halves
+type uint128 struct {
+	hi, lo uint64
+}
+
+func (u uint128) less(v uint128) bool {
+	return u.hi < v.hi || (u.hi == v.hi && u.lo < v.lo)
+}
+
+func (u uint128) next() (uint128, bool) {
+	if u.lo != ^uint64(0) {
+		return uint128{u.hi, u.lo + 1}, true
+	}
+	if u.hi != ^uint64(0) {
+		return uint128{u.hi + 1, 0}, true
+	}
+	return u, false
+}
+
+type range6 struct {
+	start, end uint128
+}
+
+// New builds a set from prefixes, invalid prefixes are skipped
+// IPv4-mapped IPv6 prefixes match the same addresses as their IPv4 prefix
+func New(prefixes []netip.Prefix) *Set {
+	s := &Set{}
+	for _, p := range prefixes {
+		if !p.IsValid() {
+			continue
+		}
+		p = unmap(p).Masked()
+		s.len++
+
+		if p.Addr().Is4() {
+			a := p.Addr().As4()
+			start := binary.BigEndian.Uint32(a[:])
+			end := start
+			if p.Bits() < 32 {
+				end |= ^uint32(0) >> uint(p.Bits())
+			}
+			s.v4 = append(s.v4, range4{start, end})
+			continue
+		}
+
+		a := p.Addr().As16()
+		start := uint128{binary.BigEndian.Uint64(a[:8]), binary.BigEndian.Uint64(a[8:])}
+		end := start
+		switch bits := p.Bits(); {
+		case bits == 0:
+			end = uint128{^uint64(0), ^uint64(0)}
+		case bits < 64:
+			end.hi |= ^uint64(0) >> uint(bits)
+			end.lo = ^uint64(0)
+		case bits < 128:
+			end.lo |= ^uint64(0) >> uint(bits-64)
+		}
+		s.v6 = append(s.v6, range6{start, end})
+	}
+
+	s.v4 = merge4(s.v4)
+	s.v6 = merge6(s.v6)
+
+	return s
+}
+
+// merge4 sorts ranges and joins those that overlap or touch
+func merge4(ranges []range4) []range4 {
+	if len(ranges) == 0 {
+		return nil
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if last.end == ^uint32(0) || r.start <= last.end+1 {
+			last.end = max(last.end, r.end)
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+func merge6(ranges []range6) []range6 {
+	if len(ranges) == 0 {
+		return nil
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start.less(ranges[j].start) })
+
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		next, ok := last.end.next()
+		if !ok || !next.less(r.start) {
+			if last.end.less(r.end) {
+				last.end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+// Contains reports whether ip is in any prefix of the set
+func (s *Set) Contains(ip netip.Addr) bool {
+	if s == nil {
+		return false
+	}
+
+	ip = ip.Unmap()
+	if ip.Is4() {
+		a := ip.As4()
+		v := binary.BigEndian.Uint32(a[:])
+		// find the first range starting after v, the one before it is the only candidate
+		lo, hi := 0, len(s.v4)
+		for lo < hi {
+			m := int(uint(lo+hi) >> 1)
+			if s.v4[m].start <= v {
+				lo = m + 1
+			} else {
+				hi = m
+			}
+		}
+		return lo > 0 && v <= s.v4[lo-1].end
+	}
+	if !ip.Is6() {
+		return false
+	}
+
+	a := ip.As16()
+	v := uint128{binary.BigEndian.Uint64(a[:8]), binary.BigEndian.Uint64(a[8:])}
+	lo, hi := 0, len(s.v6)
+	for lo < hi {
+		m := int(uint(lo+hi) >> 1)
+		if !v.less(s.v6[m].start) {
+			lo = m + 1
+		} else {
+			hi = m
+		}
+	}
+	return lo > 0 && !s.v6[lo-1].end.less(v)
+}
+
+// Len returns the number of prefixes the set was built from
+func (s *Set) Len() int {
+	if s == nil {
+		return 0
+	}
+	return s.len
+}
+
+// ::ffff:10.0.0.0/104 should match the same addresses as 10.0.0.0/8
+func unmap(p netip.Prefix) netip.Prefix {
+	if !p.Addr().Is4In6() || p.Bits() < 96 {
+		return p
+	}
+	return netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+}
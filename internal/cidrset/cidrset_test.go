@@ -0,0 +1,163 @@
+package cidrset
+
+import (
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"testing"
+
+	"github.com/dararish/captcha-protect/internal/helper"
+)
+
+func prefixes(cidrs ...string) []netip.Prefix {
+	var p []netip.Prefix
+	for _, c := range cidrs {
+		p = append(p, netip.MustParsePrefix(c))
+	}
+	return p
+}
+
+func TestContains(t *testing.T) {
+	tests := []struct {
+		name     string
+		cidrs    []string
+		ip       string
+		expected bool
+	}{
+		{name: "Inside IPv4", cidrs: []string{"192.168.1.0/24"}, ip: "192.168.1.77", expected: true},
+		{name: "Outside IPv4", cidrs: []string{"192.168.1.0/24"}, ip: "192.168.2.1"},
+		{name: "First address", cidrs: []string{"10.0.0.0/8"}, ip: "10.0.0.0", expected: true},
+		{name: "Last address", cidrs: []string{"10.0.0.0/8"}, ip: "10.255.255.255", expected: true},
+		{name: "Before the first range", cidrs: []string{"10.0.0.0/8"}, ip: "9.255.255.255"},
+		{name: "Single IP", cidrs: []string{"192.0.2.7/32"}, ip: "192.0.2.7", expected: true},
+		{name: "Next to a single IP", cidrs: []string{"192.0.2.7/32"}, ip: "192.0.2.8"},
+		{name: "Unmasked prefix", cidrs: []string{"10.1.2.3/8"}, ip: "10.200.0.1", expected: true},
+		{name: "Every IPv4", cidrs: []string{"0.0.0.0/0"}, ip: "255.255.255.255", expected: true},
+		{name: "Every IPv4 is not IPv6", cidrs: []string{"0.0.0.0/0"}, ip: "2001:db8::1"},
+		{name: "Inside IPv6", cidrs: []string{"2001:db8::/32"}, ip: "2001:db8:ffff::1", expected: true},
+		{name: "Outside IPv6", cidrs: []string{"2001:db8::/32"}, ip: "2001:db9::1"},
+		{name: "IPv6 /64", cidrs: []string{"2001:db8:1:2::/64"}, ip: "2001:db8:1:2:ffff:ffff:ffff:ffff", expected: true},
+		{name: "IPv6 /127", cidrs: []string{"2001:db8::/127"}, ip: "2001:db8::2"},
+		{name: "Every IPv6", cidrs: []string{"::/0"}, ip: "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", expected: true},
+		{name: "Mapped IP", cidrs: []string{"192.0.2.0/24"}, ip: "::ffff:192.0.2.1", expected: true},
+		{name: "Mapped prefix", cidrs: []string{"::ffff:10.0.0.0/104"}, ip: "10.1.1.1", expected: true},
+		{name: "Overlapping prefixes", cidrs: []string{"10.0.0.0/8", "10.1.0.0/16", "10.0.0.0/24"}, ip: "10.200.0.1", expected: true},
+		{name: "Adjacent prefixes merge", cidrs: []string{"10.0.0.0/9", "10.128.0.0/9"}, ip: "10.128.0.0", expected: true},
+		{name: "Gap between prefixes", cidrs: []string{"10.0.0.0/24", "10.0.2.0/24"}, ip: "10.0.1.1"},
+		{name: "Empty set", ip: "10.0.0.1"},
+		{name: "Invalid IP", cidrs: []string{"0.0.0.0/0", "::/0"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := New(prefixes(tc.cidrs...))
+			var ip netip.Addr
+			if tc.ip != "" {
+				ip = netip.MustParseAddr(tc.ip)
+			}
+			if got := s.Contains(ip); got != tc.expected {
+				t.Errorf("Contains(%s) = %v; expected %v", tc.ip, got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestNil(t *testing.T) {
+	var s *Set
+	if s.Contains(netip.MustParseAddr("10.0.0.1")) || s.Len() != 0 {
+		t.Error("expected a nil set to be empty")
+	}
+}
+
+func TestLen(t *testing.T) {
+	s := New([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), {}, netip.MustParsePrefix("10.0.0.0/16")})
+	if s.Len() != 2 {
+		t.Errorf("Len() = %d; expected 2", s.Len())
+	}
+}
+
+func randomPrefix(r *rand.Rand) netip.Prefix {
+	if r.Intn(2) == 0 {
+		var a [4]byte
+		r.Read(a[:])
+		return netip.PrefixFrom(netip.AddrFrom4(a), 8+r.Intn(25)).Masked()
+	}
+	var a [16]byte
+	r.Read(a[:])
+	// keep the random IPv6 prefixes in a small space so they overlap
+	a[0], a[1] = 0x20, 0x01
+	return netip.PrefixFrom(netip.AddrFrom16(a), 16+r.Intn(113)).Masked()
+}
+
+func randomAddr(r *rand.Rand, near []netip.Prefix) netip.Addr {
+	p := near[r.Intn(len(near))]
+	// an address close to the prefix, inside or just outside it
+	b := p.Addr().AsSlice()
+	i := len(b) - 1 - r.Intn(len(b)/2)
+	b[i] ^= byte(r.Intn(256))
+	ip, _ := netip.AddrFromSlice(b)
+	return ip
+}
+
+// the set must agree with checking every prefix one by one
+func TestContainsMatchesLinearScan(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 50; round++ {
+		var ps []netip.Prefix
+		for i := 0; i < 1+r.Intn(200); i++ {
+			ps = append(ps, randomPrefix(r))
+		}
+		s := New(ps)
+
+		for i := 0; i < 1000; i++ {
+			ip := randomAddr(r, ps)
+			if got, expected := s.Contains(ip), helper.IsIpExcluded(ip, ps); got != expected {
+				t.Fatalf("Contains(%s) = %v; expected %v for %v", ip, got, expected, ps)
+			}
+		}
+	}
+}
+
+func benchmarkPrefixes(n int) ([]netip.Prefix, []netip.Addr) {
+	r := rand.New(rand.NewSource(1))
+	ps := make([]netip.Prefix, 0, n)
+	for i := 0; i < n; i++ {
+		ps = append(ps, randomPrefix(r))
+	}
+	ips := make([]netip.Addr, 0, 1024)
+	for i := 0; i < 1024; i++ {
+		ips = append(ips, randomAddr(r, ps))
+	}
+	return ps, ips
+}
+
+func BenchmarkContains(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		ps, ips := benchmarkPrefixes(n)
+		s := New(ps)
+		b.Run(fmt.Sprintf("set/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			i := 0
+			for b.Loop() {
+				s.Contains(ips[i&1023])
+				i++
+			}
+		})
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			i := 0
+			for b.Loop() {
+				helper.IsIpExcluded(ips[i&1023], ps)
+				i++
+			}
+		})
+	}
+}
+
+func BenchmarkNew(b *testing.B) {
+	ps, _ := benchmarkPrefixes(10000)
+	b.ReportAllocs()
+	for b.Loop() {
+		New(ps)
+	}
+}
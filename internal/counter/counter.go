@@ -0,0 +1,232 @@
+package counter
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// number of shards, must be a power of two
+	shardCount = 64
+
+	// how many entries are considered when a full shard needs to evict one
+	evictionSample = 8
+)
+
+// Store counts requests per subnet
+// Subnets are spread across shards so concurrent requests rarely share a lock,
+// and requests from a subnet that is already tracked only take a read lock
+type Store struct {
+	expiration      time.Duration
+	cleanupInterval time.Duration
+	maxPerShard     int
+	evictions       atomic.Uint64
+	shards          [shardCount]shard
+}
+
+type shard struct {
+	mu          sync.RWMutex
+	counts      map[netip.Prefix]*count
+	lastCleanup int64
+}
+
+type count struct {
+	n        atomic.Uint64
+	lastSeen atomic.Int64
+	expires  int64
+}
+
+// New creates a counter store
+// Counts expire after expiration, expired counts are swept at most once per cleanupInterval
+// maxEntries of 0 means the store is unbounded
+func New(expiration, cleanupInterval time.Duration, maxEntries int) *Store {
+	s := &Store{
+		expiration:      expiration,
+		cleanupInterval: cleanupInterval,
+	}
+	if maxEntries > 0 {
+		s.maxPerShard = (maxEntries + shardCount - 1) / shardCount
+	}
+
+	now := time.Now().UnixNano()
+	for i := range s.shards {
+		s.shards[i].counts = make(map[netip.Prefix]*count)
+		s.shards[i].lastCleanup = now
+	}
+
+	return s
+}
+
+// Increment adds n to the count for k and returns the new count
+func (s *Store) Increment(k netip.Prefix, n uint) uint {
+	sh := s.shard(k)
+	now := time.Now().UnixNano()
+
+	sh.mu.RLock()
+	c, ok := sh.counts[k]
+	if ok && !c.expired(now) {
+		v := c.n.Add(uint64(n))
+		c.lastSeen.Store(now)
+		sh.mu.RUnlock()
+		return uint(v)
+	}
+	sh.mu.RUnlock()
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	// another request may have added it while we waited for the lock
+	c, ok = sh.counts[k]
+	if ok && !c.expired(now) {
+		c.lastSeen.Store(now)
+		return uint(c.n.Add(uint64(n)))
+	}
+	s.insert(sh, k, uint64(n), now)
+
+	return n
+}
+
+// Get returns the count for k
+func (s *Store) Get(k netip.Prefix) (uint, bool) {
+	sh := s.shard(k)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	c, ok := sh.counts[k]
+	if !ok || c.expired(time.Now().UnixNano()) {
+		return 0, false
+	}
+
+	return uint(c.n.Load()), true
+}
+
+// Raise sets the count for k to v if it is missing or lower
+// Increments only take the read lock, so none are lost while the write lock is held
+func (s *Store) Raise(k netip.Prefix, v uint) {
+	sh := s.shard(k)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	c, ok := sh.counts[k]
+	if !ok {
+		s.insert(sh, k, uint64(v), now)
+		return
+	}
+	if !c.expired(now) && c.n.Load() >= uint64(v) {
+		return
+	}
+	c.n.Store(uint64(v))
+	c.lastSeen.Store(now)
+	c.expires = s.expires(now)
+}
+
+// Items returns a copy of all unexpired counts
+// Shards are copied one at a time so requests are never blocked on the whole store
+func (s *Store) Items() map[netip.Prefix]uint {
+	now := time.Now().UnixNano()
+	items := make(map[netip.Prefix]uint)
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		for k, c := range sh.counts {
+			if !c.expired(now) {
+				items[k] = uint(c.n.Load())
+			}
+		}
+		sh.mu.RUnlock()
+	}
+
+	return items
+}
+
+// ItemCount returns the number of counts, including expired counts not yet swept
+func (s *Store) ItemCount() int {
+	total := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		total += len(sh.counts)
+		sh.mu.RUnlock()
+	}
+
+	return total
+}
+
+// Evictions returns how many counts were evicted to stay within maxEntries
+func (s *Store) Evictions() uint64 {
+	return s.evictions.Load()
+}
+
+func (s *Store) shard(k netip.Prefix) *shard {
+	// FNV-1a over the address bytes
+	a := k.Addr().As16()
+	h := uint32(2166136261)
+	for _, b := range a {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+
+	return &s.shards[h&(shardCount-1)]
+}
+
+func (s *Store) expires(now int64) int64 {
+	if s.expiration <= 0 {
+		return 0
+	}
+	return now + int64(s.expiration)
+}
+
+// insert must be called with the shard's write lock held
+func (s *Store) insert(sh *shard, k netip.Prefix, n uint64, now int64) {
+	if time.Duration(now-sh.lastCleanup) >= s.cleanupInterval {
+		for key, c := range sh.counts {
+			if c.expired(now) {
+				delete(sh.counts, key)
+			}
+		}
+		sh.lastCleanup = now
+	}
+
+	for s.maxPerShard > 0 && len(sh.counts) >= s.maxPerShard {
+		s.evict(sh, now)
+	}
+
+	c := &count{expires: s.expires(now)}
+	c.n.Store(n)
+	c.lastSeen.Store(now)
+	sh.counts[k] = c
+}
+
+// evict removes the lowest count among a sample of the shard,
+// preferring the least recently seen when counts are equal
+// Subnets that have only made a few requests are the cheapest to forget
+func (s *Store) evict(sh *shard, now int64) {
+	var victim netip.Prefix
+	var lowest *count
+	sampled := 0
+	for k, c := range sh.counts {
+		// expired counts are dropped without counting as an eviction
+		if c.expired(now) {
+			delete(sh.counts, k)
+			return
+		}
+		if lowest == nil || c.n.Load() < lowest.n.Load() ||
+			(c.n.Load() == lowest.n.Load() && c.lastSeen.Load() < lowest.lastSeen.Load()) {
+			victim, lowest = k, c
+		}
+		sampled++
+		if sampled == evictionSample {
+			break
+		}
+	}
+
+	delete(sh.counts, victim)
+	s.evictions.Add(1)
+}
+
+func (c *count) expired(now int64) bool {
+	return c.expires > 0 && now > c.expires
+}
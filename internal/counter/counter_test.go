@@ -0,0 +1,176 @@
+package counter
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIncrement(t *testing.T) {
+	s := New(time.Hour, time.Hour, 0)
+	k := netip.MustParsePrefix("1.2.0.0/16")
+
+	if _, ok := s.Get(k); ok {
+		t.Error("expected a missing count")
+	}
+	if v := s.Increment(k, 1); v != 1 {
+		t.Errorf("expected 1, got %d", v)
+	}
+	if v := s.Increment(k, 2); v != 3 {
+		t.Errorf("expected 3, got %d", v)
+	}
+	if v, ok := s.Get(k); !ok || v != 3 {
+		t.Errorf("expected 3, got %d", v)
+	}
+
+	s.Raise(k, 10)
+	if items := s.Items(); items[k] != 10 || len(items) != 1 {
+		t.Errorf("expected only %s with 10, got %v", k, items)
+	}
+}
+
+func TestIncrementConcurrent(t *testing.T) {
+	s := New(time.Hour, time.Hour, 0)
+	k := netip.MustParsePrefix("1.2.0.0/16")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				s.Increment(k, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v, _ := s.Get(k); v != 8000 {
+		t.Errorf("expected 8000, got %d", v)
+	}
+}
+
+func TestRaise(t *testing.T) {
+	s := New(time.Hour, time.Hour, 0)
+	k := netip.MustParsePrefix("1.2.0.0/16")
+
+	s.Raise(k, 5)
+	if v, ok := s.Get(k); !ok || v != 5 {
+		t.Errorf("expected a missing count to be set to 5, got %d", v)
+	}
+	s.Raise(k, 3)
+	if v, _ := s.Get(k); v != 5 {
+		t.Errorf("expected a higher count to be kept, got %d", v)
+	}
+	s.Raise(k, 7)
+	if v, _ := s.Get(k); v != 7 {
+		t.Errorf("expected a lower count to be raised to 7, got %d", v)
+	}
+}
+
+func TestRaiseConcurrent(t *testing.T) {
+	s := New(time.Hour, time.Hour, 0)
+	k := netip.MustParsePrefix("1.2.0.0/16")
+
+	s.Increment(k, 1)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 999; j++ {
+			s.Increment(k, 1)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 1000; j++ {
+			s.Raise(k, 1)
+		}
+	}()
+	wg.Wait()
+
+	// a raise never undoes an increment
+	if v, _ := s.Get(k); v != 1000 {
+		t.Errorf("expected 1000, got %d", v)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	s := New(time.Millisecond, 0, 0)
+	k := netip.MustParsePrefix("1.2.0.0/16")
+	s.Increment(k, 5)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := s.Get(k); ok {
+		t.Error("expected count to be expired")
+	}
+	if v := s.Increment(k, 1); v != 1 {
+		t.Errorf("expected an expired count to restart at 1, got %d", v)
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	// one entry per shard
+	s := New(time.Hour, time.Hour, shardCount)
+	busy := netip.MustParsePrefix("1.2.0.0/16")
+	s.Increment(busy, 100)
+
+	for i := 0; i < 1000; i++ {
+		s.Increment(netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 0}), 24), 1)
+	}
+
+	if s.ItemCount() > shardCount {
+		t.Errorf("expected at most %d counts, got %d", shardCount, s.ItemCount())
+	}
+	if s.Evictions() == 0 {
+		t.Error("expected evictions")
+	}
+}
+
+func TestEvictsLowestCount(t *testing.T) {
+	s := New(time.Hour, time.Hour, shardCount*2)
+	sh := &s.shards[0]
+
+	// find three keys in the same shard
+	var keys []netip.Prefix
+	for i := 0; len(keys) < 3; i++ {
+		k := netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 0}), 24)
+		if s.shard(k) == sh {
+			keys = append(keys, k)
+		}
+	}
+
+	s.Increment(keys[0], 50)
+	s.Increment(keys[1], 1)
+	s.Increment(keys[2], 1)
+
+	if _, ok := s.Get(keys[0]); !ok {
+		t.Error("expected the busy subnet to be kept")
+	}
+	if _, ok := s.Get(keys[1]); ok {
+		t.Error("expected the quiet subnet to be evicted")
+	}
+}
+
+func BenchmarkIncrementParallel(b *testing.B) {
+	s := New(time.Hour, time.Minute, 0)
+
+	var workers atomic.Uint32
+	b.RunParallel(func(pb *testing.PB) {
+		worker := workers.Add(1)
+		keys := make([]netip.Prefix, 256)
+		for i := range keys {
+			keys[i] = netip.MustParsePrefix(fmt.Sprintf("%d.%d.0.0/16", worker, i))
+		}
+
+		i := 0
+		for pb.Next() {
+			s.Increment(keys[i%len(keys)], 1)
+			i++
+		}
+	})
+}
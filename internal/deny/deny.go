@@ -0,0 +1,184 @@
+package deny
+
+import (
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/dararish/captcha-protect/internal/cidrset"
+	"github.com/dararish/captcha-protect/internal/helper"
+)
+
+// Config lists what to deny, inline and from files with one entry per line
+type Config struct {
+	IPs            []string
+	IPsFile        string
+	UserAgents     []string
+	UserAgentsFile string
+	// prefix, substring or regex
+	UserAgentMode string
+	Routes        []string
+	RoutesFile    string
+	// prefix, suffix or regex, the same as protectRoutes
+	RouteMode string
+}
+
+// List is an immutable deny list, replaced as a whole when a file changes
+type List struct {
+	ips             *cidrset.Set
+	userAgents      []string
+	userAgentsRegex []*regexp.Regexp
+	userAgentMode   string
+	routes          []string
+	routesRegex     []*regexp.Regexp
+	routeMode       string
+}
+
+// Load builds a deny list from the inline entries and files
+func Load(c Config) (*List, error) {
+	l := &List{
+		userAgentMode: c.UserAgentMode,
+		routeMode:     c.RouteMode,
+	}
+
+	ips, err := withFile(c.IPs, c.IPsFile)
+	if err != nil {
+		return nil, err
+	}
+	var prefixes []netip.Prefix
+	for _, ip := range ips {
+		prefix, err := helper.ParsePrefix(ip)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing denyIps cidr %s: %v", ip, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	l.ips = cidrset.New(prefixes)
+
+	userAgents, err := withFile(c.UserAgents, c.UserAgentsFile)
+	if err != nil {
+		return nil, err
+	}
+	switch c.UserAgentMode {
+	case "prefix", "substring":
+		for _, ua := range userAgents {
+			l.userAgents = append(l.userAgents, strings.ToLower(ua))
+		}
+	case "regex":
+		for _, ua := range userAgents {
+			re, err := regexp.Compile(ua)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex in denyUserAgents: %s", ua)
+			}
+			l.userAgentsRegex = append(l.userAgentsRegex, re)
+		}
+	default:
+		return nil, fmt.Errorf("unknown denyUserAgentsMode: %s. Supported values are prefix, substring, and regex", c.UserAgentMode)
+	}
+
+	routes, err := withFile(c.Routes, c.RoutesFile)
+	if err != nil {
+		return nil, err
+	}
+	switch c.RouteMode {
+	case "prefix", "suffix":
+		l.routes = routes
+	case "regex":
+		for _, r := range routes {
+			re, err := regexp.Compile(r)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex in denyRoutes: %s", r)
+			}
+			l.routesRegex = append(l.routesRegex, re)
+		}
+	default:
+		return nil, fmt.Errorf("unknown mode: %s. Supported values are prefix, suffix, and regex", c.RouteMode)
+	}
+
+	return l, nil
+}
+
+// Empty reports whether nothing is denied
+func (l *List) Empty() bool {
+	return l.ips.Len() == 0 && len(l.userAgents) == 0 && len(l.userAgentsRegex) == 0 &&
+		len(l.routes) == 0 && len(l.routesRegex) == 0
+}
+
+// Match returns which part of the request is denied: ip, useragent or route
+func (l *List) Match(ip netip.Addr, ua, path string) (string, bool) {
+	if l.ips.Contains(ip) {
+		return "ip", true
+	}
+	if l.matchUserAgent(ua) {
+		return "useragent", true
+	}
+	if l.matchRoute(path) {
+		return "route", true
+	}
+
+	return "", false
+}
+
+func (l *List) matchUserAgent(ua string) bool {
+	for _, re := range l.userAgentsRegex {
+		if re.MatchString(ua) {
+			return true
+		}
+	}
+	if len(l.userAgents) == 0 {
+		return false
+	}
+
+	ua = strings.ToLower(ua)
+	for _, denied := range l.userAgents {
+		if l.userAgentMode == "prefix" && strings.HasPrefix(ua, denied) {
+			return true
+		}
+		if l.userAgentMode == "substring" && strings.Contains(ua, denied) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *List) matchRoute(path string) bool {
+	for _, re := range l.routesRegex {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	if len(l.routes) == 0 {
+		return false
+	}
+
+	// suffix routes ignore the file extension, the same as protectRoutes
+	if l.routeMode == "suffix" {
+		path = strings.TrimSuffix(path, filepath.Ext(path))
+	}
+	for _, route := range l.routes {
+		if l.routeMode == "prefix" && strings.HasPrefix(path, route) {
+			return true
+		}
+		if l.routeMode == "suffix" && strings.HasSuffix(path, route) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func withFile(entries []string, path string) ([]string, error) {
+	if path == "" {
+		return entries, nil
+	}
+
+	lines, err := helper.ReadLines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]string{}, entries...), lines...), nil
+}
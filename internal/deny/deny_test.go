@@ -0,0 +1,171 @@
+package deny
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		ip       string
+		ua       string
+		path     string
+		expected string
+	}{
+		{
+			name:     "Denied CIDR",
+			config:   Config{IPs: []string{"192.0.2.0/24"}},
+			ip:       "192.0.2.10",
+			expected: "ip",
+		},
+		{
+			name:     "Denied single IP",
+			config:   Config{IPs: []string{"2001:db8::1"}},
+			ip:       "2001:db8::1",
+			expected: "ip",
+		},
+		{
+			name:   "IP outside the denied CIDR",
+			config: Config{IPs: []string{"192.0.2.0/24"}},
+			ip:     "198.51.100.1",
+		},
+		{
+			name:     "User agent prefix",
+			config:   Config{UserAgents: []string{"Python-Requests"}},
+			ua:       "python-requests/2.32.3",
+			expected: "useragent",
+		},
+		{
+			name:   "User agent prefix does not match in the middle",
+			config: Config{UserAgents: []string{"python-requests"}},
+			ua:     "Mozilla/5.0 python-requests/2.32.3",
+		},
+		{
+			name:     "User agent substring",
+			config:   Config{UserAgents: []string{"HeadlessChrome"}, UserAgentMode: "substring"},
+			ua:       "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 HeadlessChrome/126.0",
+			expected: "useragent",
+		},
+		{
+			name:     "User agent regex",
+			config:   Config{UserAgents: []string{`(?i)^curl/\d`}, UserAgentMode: "regex"},
+			ua:       "curl/8.5.0",
+			expected: "useragent",
+		},
+		{
+			name:     "Route prefix",
+			config:   Config{Routes: []string{"/wp-admin"}},
+			path:     "/wp-admin/install.php",
+			expected: "route",
+		},
+		{
+			name:     "Route suffix ignores the extension",
+			config:   Config{Routes: []string{"/xmlrpc"}, RouteMode: "suffix"},
+			path:     "/blog/xmlrpc.php",
+			expected: "route",
+		},
+		{
+			name:     "Route regex",
+			config:   Config{Routes: []string{`\.(env|git)`}, RouteMode: "regex"},
+			path:     "/.env",
+			expected: "route",
+		},
+		{
+			name:   "Nothing denied",
+			config: Config{},
+			ip:     "192.0.2.10",
+			ua:     "curl/8.5.0",
+			path:   "/",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.config.UserAgentMode == "" {
+				tc.config.UserAgentMode = "prefix"
+			}
+			if tc.config.RouteMode == "" {
+				tc.config.RouteMode = "prefix"
+			}
+			if tc.ip == "" {
+				tc.ip = "203.0.113.1"
+			}
+			l, err := Load(tc.config)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			got, ok := l.Match(netip.MustParseAddr(tc.ip), tc.ua, tc.path)
+			if got != tc.expected || ok != (tc.expected != "") {
+				t.Errorf("Match() = %q, %v; expected %q", got, ok, tc.expected)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{name: "Invalid CIDR", config: Config{IPs: []string{"192.0.2.0/33"}}},
+		{name: "Invalid IP", config: Config{IPs: []string{"not-an-ip"}}},
+		{name: "Invalid user agent regex", config: Config{UserAgents: []string{"("}, UserAgentMode: "regex"}},
+		{name: "Invalid route regex", config: Config{Routes: []string{"("}, RouteMode: "regex"}},
+		{name: "Unknown user agent mode", config: Config{UserAgentMode: "suffix"}},
+		{name: "Missing file", config: Config{IPsFile: "/nonexistent/deny.txt"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.config.UserAgentMode == "" {
+				tc.config.UserAgentMode = "prefix"
+			}
+			if tc.config.RouteMode == "" {
+				tc.config.RouteMode = "prefix"
+			}
+			if _, err := Load(tc.config); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestLoadFiles(t *testing.T) {
+	dir := t.TempDir()
+	ipsFile := filepath.Join(dir, "ips.txt")
+	uaFile := filepath.Join(dir, "useragents.txt")
+	if err := os.WriteFile(ipsFile, []byte("# partners gone bad\n192.0.2.0/24\n\n  198.51.100.7  \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(uaFile, []byte("scrapy\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := Load(Config{
+		IPs:            []string{"203.0.113.0/24"},
+		IPsFile:        ipsFile,
+		UserAgentsFile: uaFile,
+		UserAgentMode:  "prefix",
+		RouteMode:      "prefix",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for _, ip := range []string{"203.0.113.1", "192.0.2.1", "198.51.100.7"} {
+		if _, ok := l.Match(netip.MustParseAddr(ip), "", "/"); !ok {
+			t.Errorf("expected %s to be denied", ip)
+		}
+	}
+	if _, ok := l.Match(netip.MustParseAddr("198.51.100.8"), "Scrapy/2.11", "/"); !ok {
+		t.Error("expected the user agent from the file to be denied")
+	}
+	if l.Empty() {
+		t.Error("expected the list not to be empty")
+	}
+}
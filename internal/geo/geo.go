@@ -0,0 +1,262 @@
+package geo
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dararish/captcha-protect/internal/mmdb"
+)
+
+// Info is what the MaxMind databases know about an IP
+type Info struct {
+	Country        string
+	ASN            uint
+	ASOrganization string
+}
+
+// Database is implemented by *mmdb.Reader
+type Database interface {
+	Lookup(ip netip.Addr, path ...string) (interface{}, bool, error)
+}
+
+// DB looks up the country and ASN of an IP, either database can be missing
+type DB struct {
+	country Database
+	asn     Database
+}
+
+func New(country, asn Database) *DB {
+	return &DB{country: country, asn: asn}
+}
+
+// Open reads a country (or city) database and an ASN database, a blank path is skipped
+func Open(countryPath, asnPath string) (*DB, error) {
+	db := &DB{}
+	if countryPath != "" {
+		r, err := mmdb.Open(countryPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open geoipDatabase %s: %v", countryPath, err)
+		}
+		db.country = r
+	}
+	if asnPath != "" {
+		r, err := mmdb.Open(asnPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open asnDatabase %s: %v", asnPath, err)
+		}
+		db.asn = r
+	}
+
+	return db, nil
+}
+
+// HasCountry reports whether countries can be looked up
+func (db *DB) HasCountry() bool {
+	return db.country != nil
+}
+
+// HasASN reports whether ASNs can be looked up
+func (db *DB) HasASN() bool {
+	return db.asn != nil
+}
+
+// Lookup returns what is known about ip, an IP missing from a database leaves its fields blank
+func (db *DB) Lookup(ip netip.Addr) (Info, error) {
+	var info Info
+	if db.country != nil {
+		// anycast and satellite IPs only have the country they are registered in
+		for _, field := range []string{"country", "registered_country"} {
+			v, ok, err := db.country.Lookup(ip, field, "iso_code")
+			if err != nil {
+				return info, err
+			}
+			if ok {
+				info.Country, _ = v.(string)
+				break
+			}
+		}
+	}
+
+	if db.asn != nil {
+		v, ok, err := db.asn.Lookup(ip, "autonomous_system_number")
+		if err != nil {
+			return info, err
+		}
+		if ok {
+			n, _ := v.(uint64)
+			info.ASN = uint(n)
+		}
+		v, ok, err = db.asn.Lookup(ip, "autonomous_system_organization")
+		if err != nil {
+			return info, err
+		}
+		if ok {
+			info.ASOrganization, _ = v.(string)
+		}
+	}
+
+	return info, nil
+}
+
+// rule matches a country, an ASN number or a substring of an ASN organization
+type rule struct {
+	country string
+	asn     uint
+	org     string
+}
+
+func (r rule) match(info Info) bool {
+	switch {
+	case r.country != "":
+		return r.country == info.Country
+	case r.asn != 0:
+		return r.asn == info.ASN
+	default:
+		return info.ASOrganization != "" && strings.Contains(strings.ToLower(info.ASOrganization), r.org)
+	}
+}
+
+func parseCountry(s string) (rule, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if len(s) != 2 || s[0] < 'A' || s[0] > 'Z' || s[1] < 'A' || s[1] > 'Z' {
+		return rule{}, fmt.Errorf("invalid country: %q. Must be an ISO 3166-1 alpha-2 code like US", s)
+	}
+
+	return rule{country: s}, nil
+}
+
+// parseASN accepts AS123, 123, or an organization name to match as a substring
+func parseASN(s string) (rule, error) {
+	s = strings.TrimSpace(s)
+	number := s
+	if len(s) > 2 && strings.EqualFold(s[:2], "AS") {
+		number = s[2:]
+	}
+	if n, err := strconv.ParseUint(number, 10, 32); err == nil {
+		if n == 0 {
+			return rule{}, fmt.Errorf("invalid ASN: %q. Must be greater than 0", s)
+		}
+		return rule{asn: uint(n)}, nil
+	}
+	if s == "" {
+		return rule{}, fmt.Errorf("invalid ASN: %q. Must be a number like AS13335 or an organization name", s)
+	}
+
+	return rule{org: strings.ToLower(s)}, nil
+}
+
+// Rules match a request by country or ASN
+type Rules struct {
+	rules []rule
+}
+
+func NewRules(countries, asns []string) (*Rules, error) {
+	r := &Rules{}
+	for _, c := range countries {
+		rule, err := parseCountry(c)
+		if err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, rule)
+	}
+	for _, a := range asns {
+		rule, err := parseASN(a)
+		if err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, rule)
+	}
+
+	return r, nil
+}
+
+// Empty reports whether there are no rules
+func (r *Rules) Empty() bool {
+	return len(r.rules) == 0
+}
+
+func (r *Rules) Match(info Info) bool {
+	for _, rule := range r.rules {
+		if rule.match(info) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type limit struct {
+	rule
+	limit uint
+}
+
+// Limits are rate limits by country and ASN
+type Limits struct {
+	limits []limit
+}
+
+// NewLimits builds rate limits from maps of countries and ASNs to a limit
+func NewLimits(countries, asns map[string]uint) (*Limits, error) {
+	l := &Limits{}
+	for c, n := range countries {
+		rule, err := parseCountry(c)
+		if err != nil {
+			return nil, err
+		}
+		l.limits = append(l.limits, limit{rule: rule, limit: n})
+	}
+	for a, n := range asns {
+		rule, err := parseASN(a)
+		if err != nil {
+			return nil, err
+		}
+		l.limits = append(l.limits, limit{rule: rule, limit: n})
+	}
+
+	// ASN numbers are the most specific, then organizations, then countries
+	// when several organizations match, the lowest limit wins
+	slices.SortFunc(l.limits, func(a, b limit) int {
+		if ka, kb := a.kind(), b.kind(); ka != kb {
+			return ka - kb
+		}
+		if a.limit != b.limit {
+			if a.limit < b.limit {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.country+a.org, b.country+b.org)
+	})
+
+	return l, nil
+}
+
+func (r rule) kind() int {
+	switch {
+	case r.asn != 0:
+		return 0
+	case r.org != "":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Empty reports whether there are no limits
+func (l *Limits) Empty() bool {
+	return len(l.limits) == 0
+}
+
+// Limit returns the rate limit for info, if one is set
+func (l *Limits) Limit(info Info) (uint, bool) {
+	for _, rl := range l.limits {
+		if rl.match(info) {
+			return rl.limit, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,150 @@
+package geo
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// fakeDatabase answers lookups from records keyed by IP
+type fakeDatabase map[string]map[string]interface{}
+
+func (f fakeDatabase) Lookup(ip netip.Addr, path ...string) (interface{}, bool, error) {
+	record, ok := f[ip.String()]
+	if !ok {
+		return nil, false, nil
+	}
+	if record["error"] != nil {
+		return nil, false, errors.New("broken record")
+	}
+
+	v, ok := record[strings.Join(path, ".")]
+	return v, ok, nil
+}
+
+func TestLookup(t *testing.T) {
+	db := New(fakeDatabase{
+		"192.0.2.1":   {"country.iso_code": "DE"},
+		"192.0.2.2":   {"registered_country.iso_code": "FR"},
+		"192.0.2.3":   {"error": true},
+		"2001:db8::1": {"country.iso_code": "US"},
+	}, fakeDatabase{
+		"192.0.2.1": {"autonomous_system_number": uint64(24940), "autonomous_system_organization": "Hetzner Online GmbH"},
+	})
+
+	tests := []struct {
+		ip       string
+		expected Info
+		wantErr  bool
+	}{
+		{ip: "192.0.2.1", expected: Info{Country: "DE", ASN: 24940, ASOrganization: "Hetzner Online GmbH"}},
+		{ip: "192.0.2.2", expected: Info{Country: "FR"}},
+		{ip: "2001:db8::1", expected: Info{Country: "US"}},
+		{ip: "198.51.100.1", expected: Info{}},
+		{ip: "192.0.2.3", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		info, err := db.Lookup(netip.MustParseAddr(tc.ip))
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("Lookup(%s) error = %v; wantErr %v", tc.ip, err, tc.wantErr)
+		}
+		if !tc.wantErr && info != tc.expected {
+			t.Errorf("Lookup(%s) = %+v; expected %+v", tc.ip, info, tc.expected)
+		}
+	}
+}
+
+func TestOpenMissing(t *testing.T) {
+	if _, err := Open("/nonexistent/GeoLite2-Country.mmdb", ""); err == nil {
+		t.Error("expected an error for a missing database")
+	}
+
+	db, err := Open("", "")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if db.HasCountry() || db.HasASN() {
+		t.Error("expected no databases")
+	}
+}
+
+func TestRules(t *testing.T) {
+	rules, err := NewRules([]string{"cn", " RU "}, []string{"AS16509", "14061", "ovh"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		info     Info
+		expected bool
+	}{
+		{name: "Country", info: Info{Country: "CN"}, expected: true},
+		{name: "Country trimmed", info: Info{Country: "RU"}, expected: true},
+		{name: "ASN with prefix", info: Info{Country: "US", ASN: 16509}, expected: true},
+		{name: "ASN number", info: Info{ASN: 14061}, expected: true},
+		{name: "Organization substring", info: Info{ASN: 16276, ASOrganization: "OVH SAS"}, expected: true},
+		{name: "No match", info: Info{Country: "US", ASN: 7922, ASOrganization: "COMCAST-7922"}},
+		{name: "Unknown", info: Info{}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := rules.Match(tc.info); got != tc.expected {
+				t.Errorf("Match(%+v) = %v; expected %v", tc.info, got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestRulesErrors(t *testing.T) {
+	for _, countries := range [][]string{{"USA"}, {"U1"}, {""}} {
+		if _, err := NewRules(countries, nil); err == nil {
+			t.Errorf("expected an error for countries %q", countries)
+		}
+	}
+	for _, asns := range [][]string{{"AS0"}, {" "}} {
+		if _, err := NewRules(nil, asns); err == nil {
+			t.Errorf("expected an error for asns %q", asns)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	limits, err := NewLimits(map[string]uint{
+		"US": 50,
+		"CN": 5,
+	}, map[string]uint{
+		"AS16509":      10,
+		"amazon":       20,
+		"digitalocean": 2,
+		"ocean":        3,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		info     Info
+		expected uint
+		found    bool
+	}{
+		{name: "ASN number beats organization and country", info: Info{Country: "US", ASN: 16509, ASOrganization: "AMAZON-02"}, expected: 10, found: true},
+		{name: "Organization beats country", info: Info{Country: "US", ASN: 14618, ASOrganization: "AMAZON-AES"}, expected: 20, found: true},
+		{name: "Lowest matching organization", info: Info{ASN: 14061, ASOrganization: "DIGITALOCEAN-ASN"}, expected: 2, found: true},
+		{name: "Country", info: Info{Country: "CN", ASN: 4134, ASOrganization: "Chinanet"}, expected: 5, found: true},
+		{name: "No limit", info: Info{Country: "DE"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, found := limits.Limit(tc.info)
+			if got != tc.expected || found != tc.found {
+				t.Errorf("Limit(%+v) = %d, %v; expected %d, %v", tc.info, got, found, tc.expected, tc.found)
+			}
+		})
+	}
+}
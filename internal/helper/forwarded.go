@@ -0,0 +1,146 @@
+package helper
+
+import (
+	"strings"
+)
+
+// Hops walks the entries of a forwarded header from the right (closest proxy) to the left
+// X-Forwarded-For style headers are comma separated IPs.
+// RFC 7239 Forwarded headers are comma separated elements, the IP is taken from the for= parameter.
+// A header may be sent more than once, later lines are walked first.
+type Hops struct {
+	values    []string
+	remaining string
+	rfc7239   bool
+}
+
+func NewHops(values []string, rfc7239 bool) Hops {
+	return Hops{
+		values:  values,
+		rfc7239: rfc7239,
+	}
+}
+
+// IsRFC7239 reports whether the header should be parsed as an RFC 7239 Forwarded header
+func IsRFC7239(header string) bool {
+	return strings.EqualFold(header, "Forwarded")
+}
+
+// Next returns the next hop to the left
+// Hops without a usable address (e.g. for=unknown or for=_hidden) are returned
+// as an empty string so callers can tell where the chain can no longer be followed.
+func (h *Hops) Next() (string, bool) {
+	for {
+		for h.remaining == "" {
+			if len(h.values) == 0 {
+				return "", false
+			}
+			h.remaining = h.values[len(h.values)-1]
+			h.values = h.values[:len(h.values)-1]
+		}
+
+		element := h.remaining
+		h.remaining = ""
+		if i := lastComma(element, h.rfc7239); i >= 0 {
+			element, h.remaining = element[i+1:], element[:i]
+		}
+
+		// empty list elements are allowed and ignored
+		element = strings.TrimSpace(element)
+		if element == "" {
+			continue
+		}
+
+		if h.rfc7239 {
+			return ForwardedFor(element), true
+		}
+		return element, true
+	}
+}
+
+// ForwardedFor returns the address in the for= parameter of an RFC 7239 forwarded-element
+// e.g. `for="[2001:db8::1]:443";proto=https` returns `[2001:db8::1]:443`
+// Obfuscated identifiers, "unknown" and missing for= parameters return an empty string
+func ForwardedFor(element string) string {
+	for element != "" {
+		pair := element
+		element = ""
+		if i := indexUnquoted(pair, ';'); i >= 0 {
+			pair, element = pair[:i], pair[i+1:]
+		}
+
+		name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || !strings.EqualFold(strings.TrimSpace(name), "for") {
+			continue
+		}
+
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		if strings.ContainsRune(value, '\\') {
+			value = strings.ReplaceAll(value, "\\", "")
+		}
+
+		// IPv6 without a port is still bracketed, e.g. "[2001:db8::1]"
+		if len(value) > 2 && value[0] == '[' && value[len(value)-1] == ']' {
+			value = value[1 : len(value)-1]
+		}
+
+		// obfuscated identifiers start with an underscore, e.g. _hidden or _hidden:_port
+		if value == "" || value[0] == '_' || strings.EqualFold(value, "unknown") {
+			return ""
+		}
+
+		return value
+	}
+
+	return ""
+}
+
+// lastComma finds the last comma separating entries, ignoring commas in quoted strings
+func lastComma(s string, quoted bool) int {
+	if !quoted {
+		return strings.LastIndexByte(s, ',')
+	}
+
+	inQuotes := false
+	last := -1
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if inQuotes {
+				i++
+			}
+		case '"':
+			inQuotes = !inQuotes
+		case ',':
+			if !inQuotes {
+				last = i
+			}
+		}
+	}
+
+	return last
+}
+
+// indexUnquoted finds the first c outside of a quoted string
+func indexUnquoted(s string, c byte) int {
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if inQuotes {
+				i++
+			}
+		case '"':
+			inQuotes = !inQuotes
+		case c:
+			if !inQuotes {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
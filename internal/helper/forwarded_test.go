@@ -0,0 +1,78 @@
+package helper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHops(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []string
+		rfc7239  bool
+		expected []string
+	}{
+		{
+			name:     "X-Forwarded-For walks from the right",
+			values:   []string{"1.1.1.1, 2.2.2.2,3.3.3.3"},
+			expected: []string{"3.3.3.3", "2.2.2.2", "1.1.1.1"},
+		},
+		{
+			name:     "Multiple header lines walk the last line first",
+			values:   []string{"1.1.1.1, 2.2.2.2", "3.3.3.3"},
+			expected: []string{"3.3.3.3", "2.2.2.2", "1.1.1.1"},
+		},
+		{
+			name:     "Empty elements are skipped",
+			values:   []string{"1.1.1.1, , 2.2.2.2,", ""},
+			expected: []string{"2.2.2.2", "1.1.1.1"},
+		},
+		{
+			name:     "Forwarded with quoted IPv6 and ports",
+			values:   []string{`for=192.0.2.60;proto=http;by=203.0.113.43, for="[2001:db8:cafe::17]:4711"`},
+			rfc7239:  true,
+			expected: []string{"[2001:db8:cafe::17]:4711", "192.0.2.60"},
+		},
+		{
+			name:     "Forwarded with bracketed IPv6 without a port",
+			values:   []string{`for="[2001:db8::1]";proto=https`},
+			rfc7239:  true,
+			expected: []string{"2001:db8::1"},
+		},
+		{
+			name:     "Forwarded parameter names are case insensitive",
+			values:   []string{`proto=https;For=198.51.100.17`},
+			rfc7239:  true,
+			expected: []string{"198.51.100.17"},
+		},
+		{
+			name:     "Forwarded obfuscated, unknown and missing identifiers are empty",
+			values:   []string{`for=unknown, for="_hidden:_port", by=10.0.0.1, for=1.1.1.1`},
+			rfc7239:  true,
+			expected: []string{"1.1.1.1", "", "", ""},
+		},
+		{
+			name:     "Forwarded ignores commas and semicolons in quoted strings",
+			values:   []string{`for=1.1.1.1;ext="a,b;c", for=2.2.2.2`},
+			rfc7239:  true,
+			expected: []string{"2.2.2.2", "1.1.1.1"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			hops := NewHops(tc.values, tc.rfc7239)
+			var got []string
+			for {
+				hop, ok := hops.Next()
+				if !ok {
+					break
+				}
+				got = append(got, hop)
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
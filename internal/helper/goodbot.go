@@ -0,0 +1,167 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/dararish/captcha-protect/internal/psl"
+)
+
+// Resolver is the part of *net.Resolver used to verify good bots
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// IsIpGoodBot checks if the reverse DNS of clientIP matches goodBots
+// Every PTR record that matches a good bot is looked back up, and the client is only
+// a good bot if one of the forward addresses is clientIP, to avoid spoofing.
+// An error is returned when DNS failed temporarily (e.g. timed out) and the answer is unknown.
+func IsIpGoodBot(ctx context.Context, resolver Resolver, clientIP netip.Addr, goodBots []string) (bool, error) {
+	if len(goodBots) == 0 {
+		return false, nil
+	}
+	clientIP = clientIP.Unmap()
+
+	// lookup the hostnames for a given IP
+	hostnames, err := resolver.LookupAddr(ctx, clientIP.String())
+	if err != nil {
+		if temporary(err) {
+			return false, err
+		}
+		return false, nil
+	}
+
+	var lookupErr error
+	for _, hostname := range hostnames {
+		if !MatchGoodBot(hostname, goodBots) {
+			continue
+		}
+
+		// then nslookup that hostname to avoid spoofing
+		addrs, err := resolver.LookupNetIP(ctx, "ip", hostname)
+		if err != nil {
+			if temporary(err) {
+				lookupErr = err
+			}
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.Unmap() == clientIP {
+				return true, nil
+			}
+		}
+	}
+
+	return false, lookupErr
+}
+
+// temporary reports whether a lookup might succeed if tried again
+// NXDOMAIN and similar answers are final
+func temporary(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+
+	return false
+}
+
+// ValidateGoodBots checks goodBots patterns at startup
+// A pattern that is a public suffix (e.g. com or co.uk) would match almost anyone
+func ValidateGoodBots(goodBots []string) error {
+	for _, bot := range goodBots {
+		pattern := normalizeHost(bot)
+		if pattern == "" {
+			return fmt.Errorf("empty goodBots entry")
+		}
+
+		if tooBroad(pattern) {
+			return fmt.Errorf("goodBots entry %s matches an entire public suffix", bot)
+		}
+	}
+
+	return nil
+}
+
+// MatchGoodBot checks a verified reverse DNS hostname against the goodBots patterns
+//
+//   - a registrable domain such as google.com or yandex.com.tr matches every
+//     hostname with that registrable domain, according to the public suffix list
+//   - a longer hostname such as applebot.apple.com matches itself and its subdomains
+//   - a * matches exactly one label, e.g. crawl.*.applebot.apple.com
+func MatchGoodBot(hostname string, goodBots []string) bool {
+	hostname = normalizeHost(hostname)
+	if hostname == "" {
+		return false
+	}
+	registrable := psl.RegistrableDomain(hostname)
+
+	for _, bot := range goodBots {
+		pattern := normalizeHost(bot)
+		if pattern == "" || tooBroad(pattern) {
+			continue
+		}
+
+		if !strings.Contains(pattern, "*") && pattern == psl.RegistrableDomain(pattern) {
+			if registrable == pattern {
+				return true
+			}
+			continue
+		}
+
+		if matchSuffix(hostname, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tooBroad reports whether the part of the pattern after the last wildcard is a public suffix
+func tooBroad(pattern string) bool {
+	fixed := pattern
+	if pattern == "*" {
+		fixed = ""
+	} else if i := strings.LastIndex(pattern, "*."); i >= 0 {
+		fixed = pattern[i+2:]
+	}
+
+	return fixed == "" || psl.IsPublicSuffix(fixed)
+}
+
+// matchSuffix compares labels from the right, the hostname may have extra labels on the left
+func matchSuffix(hostname, pattern string) bool {
+	for pattern != "" {
+		var hostLabel, patternLabel string
+		hostname, hostLabel = cutLastLabel(hostname)
+		pattern, patternLabel = cutLastLabel(pattern)
+		if hostLabel == "" {
+			return false
+		}
+		if patternLabel != "*" && patternLabel != hostLabel {
+			return false
+		}
+	}
+
+	return true
+}
+
+func cutLastLabel(name string) (string, string) {
+	i := strings.LastIndexByte(name, '.')
+	if i < 0 {
+		return "", name
+	}
+	return name[:i], name[i+1:]
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(host), "."))
+}
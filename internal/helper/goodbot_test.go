@@ -0,0 +1,349 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// fakeResolver answers from maps instead of DNS
+type fakeResolver struct {
+	ptr     map[string][]string
+	forward map[string][]netip.Addr
+	err     map[string]error
+}
+
+func (r *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if err := r.err[addr]; err != nil {
+		return nil, err
+	}
+	if names, ok := r.ptr[addr]; ok {
+		return names, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if err := r.err[host]; err != nil {
+		return nil, err
+	}
+	if addrs, ok := r.forward[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func addrs(ips ...string) []netip.Addr {
+	var a []netip.Addr
+	for _, ip := range ips {
+		a = append(a, netip.MustParseAddr(ip))
+	}
+	return a
+}
+
+func TestIsIpGoodBot(t *testing.T) {
+	timeout := &net.DNSError{Err: "i/o timeout", Name: "1.2.3.4", IsTimeout: true}
+
+	tests := []struct {
+		name     string
+		clientIP string
+		goodBots []string
+		resolver *fakeResolver
+		expected bool
+		wantErr  bool
+	}{
+		{
+			name:     "No good bots configured",
+			clientIP: "1.2.3.4",
+			resolver: &fakeResolver{
+				ptr:     map[string][]string{"1.2.3.4": {"crawl.google.com."}},
+				forward: map[string][]netip.Addr{"crawl.google.com.": addrs("1.2.3.4")},
+			},
+			expected: false,
+		},
+		{
+			name:     "No PTR record",
+			clientIP: "1.2.3.4",
+			goodBots: []string{"google.com"},
+			resolver: &fakeResolver{},
+			expected: false,
+		},
+		{
+			name:     "PTR lookup fails",
+			clientIP: "1.2.3.4",
+			goodBots: []string{"google.com"},
+			resolver: &fakeResolver{err: map[string]error{"1.2.3.4": errors.New("dns error")}},
+			expected: false,
+		},
+		{
+			name:     "PTR lookup times out",
+			clientIP: "1.2.3.4",
+			goodBots: []string{"google.com"},
+			resolver: &fakeResolver{err: map[string]error{"1.2.3.4": timeout}},
+			expected: false,
+			wantErr:  true,
+		},
+		{
+			name:     "Empty hostname result",
+			clientIP: "1.2.3.4",
+			goodBots: []string{"google.com"},
+			resolver: &fakeResolver{ptr: map[string][]string{"1.2.3.4": {}}},
+			expected: false,
+		},
+		{
+			name:     "Spoofed hostname: resolved IP does not match clientIP",
+			clientIP: "1.2.3.4",
+			goodBots: []string{"google.com"},
+			resolver: &fakeResolver{
+				ptr:     map[string][]string{"1.2.3.4": {"crawl.google.com."}},
+				forward: map[string][]netip.Addr{"crawl.google.com.": addrs("5.6.7.8")},
+			},
+			expected: false,
+		},
+		{
+			name:     "Hostname does not have enough parts",
+			clientIP: "1.2.3.4",
+			goodBots: []string{"example.com"},
+			resolver: &fakeResolver{
+				ptr:     map[string][]string{"1.2.3.4": {"localhost."}},
+				forward: map[string][]netip.Addr{"localhost.": addrs("1.2.3.4")},
+			},
+			expected: false,
+		},
+		{
+			name:     "Not a good bot because domain does not match",
+			clientIP: "1.2.3.4",
+			goodBots: []string{"google.com"},
+			resolver: &fakeResolver{
+				ptr:     map[string][]string{"1.2.3.4": {"foo.bar.example.com."}},
+				forward: map[string][]netip.Addr{"foo.bar.example.com.": addrs("1.2.3.4")},
+			},
+			expected: false,
+		},
+		{
+			name:     "Is a good bot",
+			clientIP: "1.2.3.4",
+			goodBots: []string{"example.com"},
+			resolver: &fakeResolver{
+				ptr:     map[string][]string{"1.2.3.4": {"194.114.135.34.bc.example.com."}},
+				forward: map[string][]netip.Addr{"194.114.135.34.bc.example.com.": addrs("1.2.3.4")},
+			},
+			expected: true,
+		},
+		{
+			name:     "Is a good bot under a multi-label public suffix",
+			clientIP: "5.255.253.1",
+			goodBots: []string{"yandex.com.tr"},
+			resolver: &fakeResolver{
+				ptr:     map[string][]string{"5.255.253.1": {"spider-5-255-253-1.crawler.yandex.com.tr."}},
+				forward: map[string][]netip.Addr{"spider-5-255-253-1.crawler.yandex.com.tr.": addrs("5.255.253.1")},
+			},
+			expected: true,
+		},
+		{
+			name:     "Second PTR record matches",
+			clientIP: "1.2.3.4",
+			goodBots: []string{"google.com"},
+			resolver: &fakeResolver{
+				ptr:     map[string][]string{"1.2.3.4": {"host.example.com.", "crawl.google.com."}},
+				forward: map[string][]netip.Addr{"host.example.com.": addrs("1.2.3.4"), "crawl.google.com.": addrs("1.2.3.4")},
+			},
+			expected: true,
+		},
+		{
+			name:     "Client IP is not the first forward address",
+			clientIP: "1.2.3.4",
+			goodBots: []string{"google.com"},
+			resolver: &fakeResolver{
+				ptr:     map[string][]string{"1.2.3.4": {"crawl.google.com."}},
+				forward: map[string][]netip.Addr{"crawl.google.com.": addrs("2001:db8::1", "5.6.7.8", "1.2.3.4")},
+			},
+			expected: true,
+		},
+		{
+			name:     "IPv6 is compared as an address, not a string",
+			clientIP: "2001:0db8:0000:0000:0000:0000:0000:0001",
+			goodBots: []string{"google.com"},
+			resolver: &fakeResolver{
+				ptr:     map[string][]string{"2001:db8::1": {"crawl.google.com."}},
+				forward: map[string][]netip.Addr{"crawl.google.com.": addrs("2001:db8::1")},
+			},
+			expected: true,
+		},
+		{
+			name:     "IPv4-mapped forward address",
+			clientIP: "1.2.3.4",
+			goodBots: []string{"google.com"},
+			resolver: &fakeResolver{
+				ptr:     map[string][]string{"1.2.3.4": {"crawl.google.com."}},
+				forward: map[string][]netip.Addr{"crawl.google.com.": addrs("::ffff:1.2.3.4")},
+			},
+			expected: true,
+		},
+		{
+			name:     "Forward lookup times out",
+			clientIP: "1.2.3.4",
+			goodBots: []string{"google.com"},
+			resolver: &fakeResolver{
+				ptr: map[string][]string{"1.2.3.4": {"crawl.google.com."}},
+				err: map[string]error{"crawl.google.com.": context.DeadlineExceeded},
+			},
+			expected: false,
+			wantErr:  true,
+		},
+		{
+			name:     "Forward lookup times out but another PTR is confirmed",
+			clientIP: "1.2.3.4",
+			goodBots: []string{"google.com"},
+			resolver: &fakeResolver{
+				ptr:     map[string][]string{"1.2.3.4": {"crawl1.google.com.", "crawl2.google.com."}},
+				forward: map[string][]netip.Addr{"crawl2.google.com.": addrs("1.2.3.4")},
+				err:     map[string]error{"crawl1.google.com.": context.DeadlineExceeded},
+			},
+			expected: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := IsIpGoodBot(context.Background(), tc.resolver, netip.MustParseAddr(tc.clientIP), tc.goodBots)
+			if result != tc.expected {
+				t.Errorf("IsIpGoodBot(%q) = %v; expected %v", tc.clientIP, result, tc.expected)
+			}
+			if (err != nil) != tc.wantErr {
+				t.Errorf("IsIpGoodBot(%q) error = %v; wantErr %v", tc.clientIP, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestMatchGoodBot(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostname string
+		goodBots []string
+		expected bool
+	}{
+		{
+			name:     "Second level domain",
+			hostname: "crawl-66-249-66-1.googlebot.com.",
+			goodBots: []string{"googlebot.com"},
+			expected: true,
+		},
+		{
+			name:     "Deep hostname under a second level domain",
+			hostname: "194.114.135.34.bc.googleusercontent.com.",
+			goodBots: []string{"googleusercontent.com"},
+			expected: true,
+		},
+		{
+			name:     "Registrable domain under a multi-label public suffix",
+			hostname: "spider-5-255-253-1.crawler.yandex.com.tr.",
+			goodBots: []string{"yandex.com.tr"},
+			expected: true,
+		},
+		{
+			name:     "Public suffix is not the registrable domain",
+			hostname: "spider-5-255-253-1.crawler.yandex.com.tr.",
+			goodBots: []string{"com.tr"},
+			expected: false,
+		},
+		{
+			name:     "co.uk registrable domain",
+			hostname: "crawler1.bbc.co.uk",
+			goodBots: []string{"bbc.co.uk"},
+			expected: true,
+		},
+		{
+			name:     "Different co.uk registrable domain",
+			hostname: "crawler1.notbbc.co.uk",
+			goodBots: []string{"bbc.co.uk"},
+			expected: false,
+		},
+		{
+			name:     "Hostname suffix",
+			hostname: "17-58-101-179.applebot.apple.com.",
+			goodBots: []string{"applebot.apple.com"},
+			expected: true,
+		},
+		{
+			name:     "Hostname suffix does not match other hosts on the domain",
+			hostname: "mail.apple.com.",
+			goodBots: []string{"applebot.apple.com"},
+			expected: false,
+		},
+		{
+			name:     "Hostname suffix matches on a label boundary",
+			hostname: "notapplebot.apple.com.",
+			goodBots: []string{"applebot.apple.com"},
+			expected: false,
+		},
+		{
+			name:     "Wildcard matches one label",
+			hostname: "crawl.17-58-101-179.applebot.apple.com.",
+			goodBots: []string{"crawl.*.applebot.apple.com"},
+			expected: true,
+		},
+		{
+			name:     "Wildcard does not match a different prefix",
+			hostname: "mail.17-58-101-179.applebot.apple.com.",
+			goodBots: []string{"crawl.*.applebot.apple.com"},
+			expected: false,
+		},
+		{
+			name:     "Wildcard needs a label",
+			hostname: "crawl.applebot.apple.com.",
+			goodBots: []string{"crawl.*.applebot.apple.com"},
+			expected: false,
+		},
+		{
+			name:     "Case insensitive",
+			hostname: "Crawl-66-249-66-1.GoogleBot.com.",
+			goodBots: []string{"googlebot.com"},
+			expected: true,
+		},
+		{
+			name:     "Single label hostname",
+			hostname: "localhost.",
+			goodBots: []string{"example.com"},
+			expected: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result := MatchGoodBot(tc.hostname, tc.goodBots)
+			if result != tc.expected {
+				t.Errorf("MatchGoodBot(%q, %v) = %v; expected %v", tc.hostname, tc.goodBots, result, tc.expected)
+			}
+		})
+	}
+}
+
+func TestValidateGoodBots(t *testing.T) {
+	tests := []struct {
+		name     string
+		goodBots []string
+		wantErr  bool
+	}{
+		{name: "Defaults", goodBots: []string{"apple.com", "archive.org", "google.com", "googleusercontent.com"}},
+		{name: "Multi-label public suffix", goodBots: []string{"yandex.com.tr", "bbc.co.uk"}},
+		{name: "Wildcard", goodBots: []string{"crawl.*.applebot.apple.com"}},
+		{name: "Top level domain", goodBots: []string{"com"}, wantErr: true},
+		{name: "Multi-label public suffix on its own", goodBots: []string{"co.uk"}, wantErr: true},
+		{name: "Wildcard over a public suffix", goodBots: []string{"*.com"}, wantErr: true},
+		{name: "Wildcard on its own", goodBots: []string{"*"}, wantErr: true},
+		{name: "Empty", goodBots: []string{""}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateGoodBots(tc.goodBots)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("ValidateGoodBots(%v) error = %v; wantErr %v", tc.goodBots, err, tc.wantErr)
+			}
+		})
+	}
+}
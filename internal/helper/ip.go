@@ -1,17 +1,12 @@
 package helper
 
 import (
-	"net"
+	"fmt"
+	"net/netip"
 	"strings"
 )
 
-var (
-	lookupAddrFunc = net.LookupAddr
-	lookupIPFunc   = net.LookupIP
-)
-
-func IsIpExcluded(clientIP string, exemptIps []*net.IPNet) bool {
-	ip := net.ParseIP(clientIP)
+func IsIpExcluded(ip netip.Addr, exemptIps []netip.Prefix) bool {
 	for _, block := range exemptIps {
 		if block.Contains(ip) {
 			return true
@@ -21,47 +16,63 @@ func IsIpExcluded(clientIP string, exemptIps []*net.IPNet) bool {
 	return false
 }
 
-func ParseCIDR(cidr string) (*net.IPNet, error) {
-	_, ipNet, err := net.ParseCIDR(cidr)
+// ParseCIDR parses a CIDR into its masked prefix, e.g. 10.1.2.3/8 becomes 10.0.0.0/8
+func ParseCIDR(cidr string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(cidr)
 	if err != nil {
-		return nil, err
+		return netip.Prefix{}, err
 	}
-	return ipNet, nil
+	return unmapPrefix(prefix).Masked(), nil
 }
 
-func IsIpGoodBot(clientIP string, goodBots []string) bool {
-	if len(goodBots) == 0 {
-		return false
+// ParsePrefix parses a CIDR, or a single IP as a prefix covering just that IP
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		ip, ok := ParseAddr(s)
+		if !ok {
+			return netip.Prefix{}, fmt.Errorf("invalid IP")
+		}
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
 	}
 
-	// lookup the hostname for a given IP
-	hostname, err := lookupAddrFunc(clientIP)
-	if err != nil || len(hostname) == 0 {
-		return false
-	}
+	return ParseCIDR(s)
+}
 
-	// then nslookup that hostname to avoid spoofing
-	resolvedIP, err := lookupIPFunc(hostname[0])
-	if err != nil || len(resolvedIP) == 0 || resolvedIP[0].String() != clientIP {
-		return false
+// ParseAddr parses an IP with an optional port
+// IPv4-mapped IPv6 addresses are converted to IPv4
+func ParseAddr(s string) (netip.Addr, bool) {
+	// check for a port first so a RemoteAddr doesn't allocate a parse error
+	var ip netip.Addr
+	if hasPort(s) {
+		addrPort, err := netip.ParseAddrPort(s)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		ip = addrPort.Addr()
+	} else {
+		var err error
+		ip, err = netip.ParseAddr(s)
+		if err != nil {
+			return netip.Addr{}, false
+		}
 	}
 
-	// get the sld
-	// will be like 194.114.135.34.bc.googleusercontent.com.
-	// notice the trailing period
-	parts := strings.Split(hostname[0], ".")
-	l := len(parts)
-	if l < 3 {
-		return false
-	}
-	tld := parts[l-2]
-	domain := parts[l-3] + "." + tld
+	return ip.Unmap().WithZone(""), true
+}
 
-	for _, bot := range goodBots {
-		if domain == bot {
-			return true
-		}
+// 1.2.3.4:80 and [2001:db8::1]:80 have ports, 2001:db8::1 does not
+func hasPort(s string) bool {
+	if strings.HasPrefix(s, "[") {
+		return true
 	}
+	i := strings.IndexByte(s, ':')
+	return i >= 0 && i == strings.LastIndexByte(s, ':')
+}
 
-	return false
+// ::ffff:10.0.0.0/104 should match the same addresses as 10.0.0.0/8
+func unmapPrefix(prefix netip.Prefix) netip.Prefix {
+	if !prefix.Addr().Is4In6() || prefix.Bits() < 96 {
+		return prefix
+	}
+	return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
 }
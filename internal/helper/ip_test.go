@@ -1,182 +1,65 @@
 package helper
 
 import (
-	"errors"
-	"net"
+	"net/netip"
 	"testing"
 )
 
-func TestIsIpGoodBot(t *testing.T) {
-	// Save the original functions and restore them at the end.
-	origLookupAddr := lookupAddrFunc
-	origLookupIP := lookupIPFunc
-	defer func() {
-		lookupAddrFunc = origLookupAddr
-		lookupIPFunc = origLookupIP
-	}()
-
-	tests := []struct {
-		name             string
-		clientIP         string
-		goodBots         []string
-		lookupAddrReturn []string
-		lookupAddrErr    error
-		lookupIPReturn   []net.IP
-		lookupIPErr      error
-		expected         bool
-	}{
-		{
-			name:             "DNS lookup fails",
-			clientIP:         "1.2.3.4",
-			goodBots:         []string{"google.com"},
-			lookupAddrReturn: nil,
-			lookupAddrErr:    errors.New("dns error"),
-			expected:         false,
-		},
-		{
-			name:             "Empty hostname result",
-			clientIP:         "1.2.3.4",
-			goodBots:         []string{"google.com"},
-			lookupAddrReturn: []string{},
-			lookupAddrErr:    nil,
-			expected:         false,
-		},
-		{
-			name:     "Spoofed hostname: resolved IP does not match clientIP",
-			clientIP: "1.2.3.4",
-			goodBots: []string{"google.com"},
-			lookupAddrReturn: []string{
-				"host.example.com.",
-			},
-			lookupAddrErr: nil,
-			lookupIPReturn: []net.IP{
-				net.ParseIP("5.6.7.8"),
-			},
-			lookupIPErr: nil,
-			expected:    false,
-		},
-		{
-			name:     "Hostname does not have enough parts",
-			clientIP: "1.2.3.4",
-			goodBots: []string{"example.com"},
-			lookupAddrReturn: []string{
-				"localhost.",
-			},
-			lookupAddrErr: nil,
-			lookupIPReturn: []net.IP{
-				net.ParseIP("1.2.3.4"),
-			},
-			lookupIPErr: nil,
-			expected:    false,
-		},
-		{
-			name:     "Not a good bot because domain does not match",
-			clientIP: "1.2.3.4",
-			goodBots: []string{"google.com"},
-			lookupAddrReturn: []string{
-				"foo.bar.example.com.",
-			},
-			lookupAddrErr: nil,
-			lookupIPReturn: []net.IP{
-				net.ParseIP("1.2.3.4"),
-			},
-			lookupIPErr: nil,
-			expected:    false,
-		},
-		{
-			name:     "Is a good bot",
-			clientIP: "1.2.3.4",
-			goodBots: []string{"example.com"},
-			lookupAddrReturn: []string{
-				"194.114.135.34.bc.example.com.",
-			},
-			lookupAddrErr: nil,
-			lookupIPReturn: []net.IP{
-				net.ParseIP("1.2.3.4"),
-			},
-			lookupIPErr: nil,
-			expected:    true,
-		},
-	}
-
-	for _, tc := range tests {
-		lookupAddrFunc = func(ip string) ([]string, error) {
-			if ip != tc.clientIP {
-				t.Errorf("Expected lookupAddr to be called with %q; got %q", tc.clientIP, ip)
-			}
-			return tc.lookupAddrReturn, tc.lookupAddrErr
-		}
-
-		lookupIPFunc = func(host string) ([]net.IP, error) {
-			if len(tc.lookupAddrReturn) == 0 || host != tc.lookupAddrReturn[0] {
-				t.Errorf("Expected lookupIP to be called with %q; got %q", tc.lookupAddrReturn[0], host)
-			}
-			return tc.lookupIPReturn, tc.lookupIPErr
-		}
-
-		t.Run(tc.name, func(t *testing.T) {
-			result := IsIpGoodBot(tc.clientIP, tc.goodBots)
-			if result != tc.expected {
-				t.Errorf("IsIpGoodBot(%q) = %v; expected %v", tc.clientIP, result, tc.expected)
-			}
-		})
-	}
-}
-
 func TestIsIpExcluded(t *testing.T) {
 	tests := []struct {
 		name      string
 		clientIP  string
-		exemptIps []*net.IPNet
+		exemptIps []netip.Prefix
 		expected  bool
 	}{
 		{
 			name:      "IP in exempt subnet",
 			clientIP:  "192.168.1.5",
-			exemptIps: []*net.IPNet{parseCIDR("192.168.1.0/24", t)},
+			exemptIps: []netip.Prefix{parseCIDR("192.168.1.0/24", t)},
 			expected:  true,
 		},
 		{
 			name:      "IP not in exempt subnet",
 			clientIP:  "192.168.2.5",
-			exemptIps: []*net.IPNet{parseCIDR("192.168.1.0/24", t)},
+			exemptIps: []netip.Prefix{parseCIDR("192.168.1.0/24", t)},
 			expected:  false,
 		},
 		{
 			name:      "Multiple exempt subnets, matching one",
 			clientIP:  "10.0.0.15",
-			exemptIps: []*net.IPNet{parseCIDR("192.168.1.0/24", t), parseCIDR("10.0.0.0/16", t)},
+			exemptIps: []netip.Prefix{parseCIDR("192.168.1.0/24", t), parseCIDR("10.0.0.0/16", t)},
 			expected:  true,
 		},
 		{
 			name:      "IPv6 address in exempt range",
 			clientIP:  "2001:db8::1",
-			exemptIps: []*net.IPNet{parseCIDR("2001:db8::/32", t)},
+			exemptIps: []netip.Prefix{parseCIDR("2001:db8::/32", t)},
 			expected:  true,
 		},
 		{
 			name:      "IPv6 address not in exempt range",
 			clientIP:  "2001:db9::1",
-			exemptIps: []*net.IPNet{parseCIDR("2001:db8::/32", t)},
+			exemptIps: []netip.Prefix{parseCIDR("2001:db8::/32", t)},
 			expected:  false,
 		},
 		{
 			name:      "Invalid IP address",
 			clientIP:  "invalid-ip",
-			exemptIps: []*net.IPNet{parseCIDR("192.168.1.0/24", t)},
+			exemptIps: []netip.Prefix{parseCIDR("192.168.1.0/24", t)},
 			expected:  false,
 		},
 		{
 			name:      "No exempt IPs",
 			clientIP:  "192.168.1.5",
-			exemptIps: []*net.IPNet{},
+			exemptIps: []netip.Prefix{},
 			expected:  false,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := IsIpExcluded(tt.clientIP, tt.exemptIps)
+			ip, _ := ParseAddr(tt.clientIP)
+			result := IsIpExcluded(ip, tt.exemptIps)
 			if result != tt.expected {
 				t.Errorf("IsIpExcluded(%q) = %v; want %v", tt.clientIP, result, tt.expected)
 			}
@@ -184,10 +67,81 @@ func TestIsIpExcluded(t *testing.T) {
 	}
 }
 
-func parseCIDR(cidr string, t *testing.T) *net.IPNet {
-	_, block, err := net.ParseCIDR(cidr)
+func parseCIDR(cidr string, t *testing.T) netip.Prefix {
+	block, err := ParseCIDR(cidr)
 	if err != nil {
 		t.Fatalf("Failed to parse CIDR %s: %v", cidr, err)
 	}
 	return block
 }
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		ok       bool
+	}{
+		{"1.2.3.4", "1.2.3.4", true},
+		{"1.2.3.4:8080", "1.2.3.4", true},
+		{"2001:db8::1", "2001:db8::1", true},
+		{"[2001:db8::1]:443", "2001:db8::1", true},
+		{"::ffff:1.2.3.4", "1.2.3.4", true},
+		{"fe80::1%eth0", "fe80::1", true},
+		{"not-an-ip", "invalid IP", false},
+		{"", "invalid IP", false},
+	}
+
+	for _, tc := range tests {
+		ip, ok := ParseAddr(tc.input)
+		if ok != tc.ok || ip.String() != tc.expected {
+			t.Errorf("ParseAddr(%q) = %s, %v; want %s, %v", tc.input, ip, ok, tc.expected, tc.ok)
+		}
+	}
+}
+
+func TestParseCIDR(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"10.1.2.3/8", "10.0.0.0/8"},
+		{"::ffff:10.0.0.0/104", "10.0.0.0/8"},
+		{"2001:db8::1/32", "2001:db8::/32"},
+	}
+
+	for _, tc := range tests {
+		prefix, err := ParseCIDR(tc.input)
+		if err != nil || prefix.String() != tc.expected {
+			t.Errorf("ParseCIDR(%q) = %s, %v; want %s", tc.input, prefix, err, tc.expected)
+		}
+	}
+
+	if _, err := ParseCIDR("1.2.3.4"); err == nil {
+		t.Error("expected an error parsing an IP without a prefix length")
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"10.1.2.3/8", "10.0.0.0/8"},
+		{"192.0.2.7", "192.0.2.7/32"},
+		{"::ffff:192.0.2.7", "192.0.2.7/32"},
+		{"2001:db8::1", "2001:db8::1/128"},
+	}
+
+	for _, tc := range tests {
+		prefix, err := ParsePrefix(tc.input)
+		if err != nil || prefix.String() != tc.expected {
+			t.Errorf("ParsePrefix(%q) = %s, %v; want %s", tc.input, prefix, err, tc.expected)
+		}
+	}
+
+	for _, input := range []string{"not-an-ip", "192.0.2.0/33"} {
+		if _, err := ParsePrefix(input); err == nil {
+			t.Errorf("expected an error parsing %q", input)
+		}
+	}
+}
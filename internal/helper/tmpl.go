@@ -4,35 +4,160 @@ package helper
 // given yaegi's constraints on finding files on disk
 // provided by this plugin
 func GetDefaultTmpl() string {
-	return `<html>
+	return `<html lang="{{ .Language }}">
   <head>
-    <title>Verifying connection</title>
-    <script src="{{ .FrontendJS }}" async defer referrerpolicy="no-referrer"></script>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>{{ T .Language "title" }}</title>
+    <script nonce="{{ .Nonce }}" src="{{ .FrontendJS }}" async defer referrerpolicy="no-referrer"></script>
   </head>
   <body>
-    <h1>Verifying connection</h1>
-    <p>One moment while we verify your network connection.</p>
-    <form action="{{ .ChallengeURL }}" method="post" id="captcha-form" accept-charset="UTF-8">
-        <div
-            data-callback="captchaCallback"
-            class="{{ .FrontendKey }}"
-            data-sitekey="{{ .SiteKey }}"
-            data-theme="auto"
-            data-size="normal"
-            data-language="auto"
-            data-retry="auto"
-            interval="8000"
-            data-appearance="always">
-        </div>
-        <input type="hidden" name="destination" value="{{ .Destination }}">
-    </form>
-    <script type="text/javascript">
+    <main>
+      <h1>{{ T .Language "title" }}</h1>
+      <p>{{ T .Language "message" }}</p>
+      {{ with .Error }}<p id="captcha-error" role="alert">{{ T $.Language (print . "Error") }}</p>{{ end }}
+      <noscript>
+          <p>{{ if eq .Provider "recaptcha" }}{{ T .Language "noscriptFallback" }}{{ else }}{{ T .Language "noscript" }}{{ end }}</p>
+          <p><small>{{ .RequestID }}</small></p>
+      </noscript>
+      <form action="{{ .ChallengeURL }}" method="post" id="captcha-form" accept-charset="UTF-8">
+          <div
+              data-callback="captchaCallback"
+              data-expired-callback="captchaError"
+              data-error-callback="captchaError"
+              class="{{ .FrontendKey }}"
+              data-sitekey="{{ .SiteKey }}"
+              data-theme="auto"
+              data-size="normal"
+              data-language="{{ .Language }}"
+              data-retry="auto"
+              interval="8000"
+              data-appearance="always">
+          </div>
+          {{ if eq .Provider "recaptcha" }}<noscript>
+              <iframe src="https://www.google.com/recaptcha/api/fallback?k={{ .SiteKey }}&amp;hl={{ .Language }}" title="reCAPTCHA" width="302" height="422"></iframe>
+              <textarea name="g-recaptcha-response" aria-label="reCAPTCHA" rows="4" cols="40"></textarea>
+              <button type="submit">{{ T .Language "continue" }}</button>
+          </noscript>{{ end }}
+          <input type="hidden" name="destination" value="{{ .Destination }}">
+          {{ if ne .Method "GET" }}<input type="hidden" name="method" value="{{ .Method }}">{{ end }}
+          {{ with .Body }}<input type="hidden" name="body" value="{{ . }}">{{ end }}
+          {{ if .Pow }}<input type="hidden" name="pow" id="pow">
+          <input type="hidden" name="pow-nonce" id="pow-nonce">{{ end }}
+          <p id="captcha-status" role="status" aria-live="polite"
+              data-verified="{{ T .Language "verified" }}"
+              data-error="{{ T .Language "error" }}"
+              data-solving="{{ T .Language "solving" }}"></p>
+          {{ if ne .Provider "turnstile" }}<p id="captcha-help">{{ T .Language (print .Provider "Help") }}</p>{{ end }}
+          <button type="submit" id="captcha-submit" hidden>{{ T .Language "continue" }}</button>
+          {{ if .Pow }}<button type="button" id="pow-start" data-challenge="{{ .Pow }}" data-difficulty="{{ .PowDifficulty }}">{{ T .Language "alternative" }}</button>{{ end }}
+      </form>
+    </main>
+    <script type="text/javascript" nonce="{{ .Nonce }}">
+        var captchaForm = document.getElementById("captcha-form");
+        var captchaStatus = document.getElementById("captcha-status");
+
         function captchaCallback(token) {
+            captchaStatus.textContent = captchaStatus.dataset.verified;
+            // a visible button in case the form can't be submitted for the user
+            document.getElementById("captcha-submit").hidden = false;
             setTimeout(function() {
-                document.getElementById("captcha-form").submit();
+                captchaForm.submit();
             }, 1000);
         }
+
+        function captchaError() {
+            captchaStatus.textContent = captchaStatus.dataset.error;
+        }
+
+        // the proof of work is an alternative to the captcha widget, solved in the browser
+        var powStart = document.getElementById("pow-start");
+        if (powStart) {
+            powStart.addEventListener("click", async function() {
+                var challenge = powStart.dataset.challenge;
+                var difficulty = parseInt(powStart.dataset.difficulty, 10);
+                powStart.disabled = true;
+                captchaStatus.textContent = captchaStatus.dataset.solving;
+                try {
+                    var encoder = new TextEncoder();
+                    for (var nonce = 0; ; nonce++) {
+                        var hash = new Uint8Array(await crypto.subtle.digest("SHA-256", encoder.encode(challenge + ":" + nonce)));
+                        var zeros = 0;
+                        for (var i = 0; i < hash.length && hash[i] === 0; i++) {
+                            zeros += 8;
+                        }
+                        if (i < hash.length) {
+                            zeros += Math.clz32(hash[i]) - 24;
+                        }
+                        if (zeros >= difficulty) {
+                            break;
+                        }
+                    }
+                    document.getElementById("pow").value = challenge;
+                    document.getElementById("pow-nonce").value = nonce;
+                    captchaCallback();
+                } catch (e) {
+                    powStart.disabled = false;
+                    captchaError();
+                }
+            });
+        }
     </script>
   </body>
 </html>`
 }
+
+// GetDefaultPages are the pages served instead of the challenge
+// a challengeTmpl file can replace any of them with {{ define "failed" }}
+func GetDefaultPages() string {
+	return `{{ define "failed" }}<html lang="{{ .Language }}">
+  <head>
+    <meta charset="utf-8">
+    <title>{{ T .Language "failedTitle" }}</title>
+  </head>
+  <body>
+    <h1>{{ T .Language "failedTitle" }}</h1>
+    <p>{{ T .Language "failedMessage" }}</p>
+    <p><a href="{{ .Path }}">{{ T .Language "retry" }}</a></p>
+    <p><small>{{ .RequestID }}</small></p>
+  </body>
+</html>{{ end }}
+{{ define "blocked" }}<html lang="{{ .Language }}">
+  <head>
+    <meta charset="utf-8">
+    <title>{{ T .Language "blockedTitle" }}</title>
+  </head>
+  <body>
+    <h1>{{ T .Language "blockedTitle" }}</h1>
+    <p>{{ T .Language "blockedMessage" }}</p>
+    <p><small>{{ .RequestID }}</small></p>
+  </body>
+</html>{{ end }}
+{{ define "unavailable" }}<html lang="{{ .Language }}">
+  <head>
+    <meta charset="utf-8">
+    <title>{{ T .Language "unavailableTitle" }}</title>
+  </head>
+  <body>
+    <h1>{{ T .Language "unavailableTitle" }}</h1>
+    <p>{{ T .Language "unavailableMessage" }}</p>
+    <p><a href="{{ .Path }}">{{ T .Language "retry" }}</a></p>
+    <p><small>{{ .RequestID }}</small></p>
+  </body>
+</html>{{ end }}
+{{ define "replay" }}<html lang="{{ .Language }}">
+  <head>
+    <meta charset="utf-8">
+    <title>{{ T .Language "title" }}</title>
+  </head>
+  <body>
+    <form action="{{ .Destination }}" method="post" id="replay-form" accept-charset="UTF-8">
+        {{ range .Fields }}<input type="hidden" name="{{ .Name }}" value="{{ .Value }}">
+        {{ end }}<button type="submit">{{ T .Language "continue" }}</button>
+    </form>
+    <script type="text/javascript" nonce="{{ .Nonce }}">
+        document.getElementById("replay-form").submit();
+    </script>
+  </body>
+</html>{{ end }}`
+}
@@ -0,0 +1,282 @@
+package i18n
+
+// catalogs hold the messages of the built-in pages for each language
+// Every catalog has the same keys as English, which is the fallback for a missing key
+var catalogs = map[string]map[string]string{
+	"en": {
+		"title":              "Verifying connection",
+		"message":            "One moment while we verify your network connection.",
+		"failedTitle":        "Verification failed",
+		"failedMessage":      "We couldn't verify your connection. Please try again later.",
+		"blockedTitle":       "Access denied",
+		"blockedMessage":     "Your request has been blocked.",
+		"unavailableTitle":   "Verification unavailable",
+		"unavailableMessage": "We can't verify your connection right now. Please try again in a few minutes.",
+		"retry":              "Try again",
+		"continue":           "Continue",
+		"noscript":           "JavaScript is required to verify your connection. Please enable it and reload this page.",
+		"verified":           "Verified. Continuing…",
+		"error":              "The verification could not be completed. Please try again.",
+		"alternative":        "Use a different verification",
+		"solving":            "Verifying your browser, this can take a few seconds…",
+		"noscriptFallback":   "Without JavaScript, solve the challenge below, copy the code it shows into the box and select Continue.",
+		"recaptchaHelp":      "If you can't solve the pictures, select the headphones button in the challenge for an audio challenge.",
+		"hcaptchaHelp":       "If you can't solve the pictures, open the menu in the challenge to choose a text challenge.",
+		"missingError":       "Please complete the verification before continuing.",
+		"failedError":        "The verification didn't succeed. Please try again.",
+		"expiredError":       "The verification expired. Please try again.",
+	},
+	"de": {
+		"title":              "Verbindung wird überprüft",
+		"message":            "Einen Moment, während wir Ihre Netzwerkverbindung überprüfen.",
+		"failedTitle":        "Überprüfung fehlgeschlagen",
+		"failedMessage":      "Wir konnten Ihre Verbindung nicht überprüfen. Bitte versuchen Sie es später erneut.",
+		"blockedTitle":       "Zugriff verweigert",
+		"blockedMessage":     "Ihre Anfrage wurde blockiert.",
+		"unavailableTitle":   "Überprüfung nicht verfügbar",
+		"unavailableMessage": "Wir können Ihre Verbindung gerade nicht überprüfen. Bitte versuchen Sie es in ein paar Minuten erneut.",
+		"retry":              "Erneut versuchen",
+		"continue":           "Weiter",
+		"noscript":           "Zur Überprüfung Ihrer Verbindung wird JavaScript benötigt. Bitte aktivieren Sie es und laden Sie die Seite neu.",
+		"verified":           "Überprüft. Es geht weiter…",
+		"error":              "Die Überprüfung konnte nicht abgeschlossen werden. Bitte versuchen Sie es erneut.",
+		"alternative":        "Andere Überprüfung verwenden",
+		"solving":            "Ihr Browser wird überprüft, das kann einige Sekunden dauern…",
+		"noscriptFallback":   "Lösen Sie ohne JavaScript die Aufgabe unten, kopieren Sie den angezeigten Code in das Feld und wählen Sie „Weiter“.",
+		"recaptchaHelp":      "Wenn Sie die Bilder nicht lösen können, wählen Sie in der Aufgabe die Kopfhörer-Schaltfläche für eine Audioaufgabe.",
+		"hcaptchaHelp":       "Wenn Sie die Bilder nicht lösen können, öffnen Sie das Menü der Aufgabe und wählen Sie eine Textaufgabe.",
+		"missingError":       "Bitte schließen Sie die Überprüfung ab, bevor Sie fortfahren.",
+		"failedError":        "Die Überprüfung war nicht erfolgreich. Bitte versuchen Sie es erneut.",
+		"expiredError":       "Die Überprüfung ist abgelaufen. Bitte versuchen Sie es erneut.",
+	},
+	"es": {
+		"title":              "Verificando la conexión",
+		"message":            "Un momento mientras verificamos su conexión de red.",
+		"failedTitle":        "La verificación falló",
+		"failedMessage":      "No pudimos verificar su conexión. Inténtelo de nuevo más tarde.",
+		"blockedTitle":       "Acceso denegado",
+		"blockedMessage":     "Su solicitud ha sido bloqueada.",
+		"unavailableTitle":   "Verificación no disponible",
+		"unavailableMessage": "No podemos verificar su conexión en este momento. Inténtelo de nuevo en unos minutos.",
+		"retry":              "Intentar de nuevo",
+		"continue":           "Continuar",
+		"noscript":           "Se necesita JavaScript para verificar su conexión. Actívelo y vuelva a cargar esta página.",
+		"verified":           "Verificado. Continuando…",
+		"error":              "No se pudo completar la verificación. Inténtelo de nuevo.",
+		"alternative":        "Usar otra verificación",
+		"solving":            "Verificando su navegador, puede tardar unos segundos…",
+		"noscriptFallback":   "Sin JavaScript, resuelva el desafío de abajo, copie el código que muestra en el cuadro y seleccione Continuar.",
+		"recaptchaHelp":      "Si no puede resolver las imágenes, seleccione el botón de auriculares del desafío para obtener un desafío de audio.",
+		"hcaptchaHelp":       "Si no puede resolver las imágenes, abra el menú del desafío para elegir un desafío de texto.",
+		"missingError":       "Complete la verificación antes de continuar.",
+		"failedError":        "La verificación no tuvo éxito. Inténtelo de nuevo.",
+		"expiredError":       "La verificación ha caducado. Inténtelo de nuevo.",
+	},
+	"fr": {
+		"title":              "Vérification de la connexion",
+		"message":            "Un instant, nous vérifions votre connexion réseau.",
+		"failedTitle":        "Échec de la vérification",
+		"failedMessage":      "Nous n'avons pas pu vérifier votre connexion. Veuillez réessayer plus tard.",
+		"blockedTitle":       "Accès refusé",
+		"blockedMessage":     "Votre requête a été bloquée.",
+		"unavailableTitle":   "Vérification indisponible",
+		"unavailableMessage": "Nous ne pouvons pas vérifier votre connexion pour le moment. Veuillez réessayer dans quelques minutes.",
+		"retry":              "Réessayer",
+		"continue":           "Continuer",
+		"noscript":           "JavaScript est nécessaire pour vérifier votre connexion. Veuillez l'activer et recharger cette page.",
+		"verified":           "Vérifié. Poursuite…",
+		"error":              "La vérification n'a pas pu aboutir. Veuillez réessayer.",
+		"alternative":        "Utiliser une autre vérification",
+		"solving":            "Vérification de votre navigateur, cela peut prendre quelques secondes…",
+		"noscriptFallback":   "Sans JavaScript, résolvez le défi ci-dessous, copiez le code affiché dans la zone de texte et sélectionnez Continuer.",
+		"recaptchaHelp":      "Si vous ne parvenez pas à résoudre les images, sélectionnez le bouton du casque dans le défi pour obtenir un défi audio.",
+		"hcaptchaHelp":       "Si vous ne parvenez pas à résoudre les images, ouvrez le menu du défi pour choisir un défi textuel.",
+		"missingError":       "Veuillez terminer la vérification avant de continuer.",
+		"failedError":        "La vérification a échoué. Veuillez réessayer.",
+		"expiredError":       "La vérification a expiré. Veuillez réessayer.",
+	},
+	"it": {
+		"title":              "Verifica della connessione",
+		"message":            "Un momento mentre verifichiamo la tua connessione di rete.",
+		"failedTitle":        "Verifica non riuscita",
+		"failedMessage":      "Non è stato possibile verificare la tua connessione. Riprova più tardi.",
+		"blockedTitle":       "Accesso negato",
+		"blockedMessage":     "La tua richiesta è stata bloccata.",
+		"unavailableTitle":   "Verifica non disponibile",
+		"unavailableMessage": "Al momento non possiamo verificare la tua connessione. Riprova tra qualche minuto.",
+		"retry":              "Riprova",
+		"continue":           "Continua",
+		"noscript":           "È necessario JavaScript per verificare la tua connessione. Attivalo e ricarica questa pagina.",
+		"verified":           "Verificato. Continuazione…",
+		"error":              "Non è stato possibile completare la verifica. Riprova.",
+		"alternative":        "Usa una verifica diversa",
+		"solving":            "Verifica del browser in corso, potrebbe richiedere alcuni secondi…",
+		"noscriptFallback":   "Senza JavaScript, risolvi la verifica qui sotto, copia il codice mostrato nella casella e seleziona Continua.",
+		"recaptchaHelp":      "Se non riesci a risolvere le immagini, seleziona il pulsante delle cuffie nella verifica per una verifica audio.",
+		"hcaptchaHelp":       "Se non riesci a risolvere le immagini, apri il menu della verifica per scegliere una verifica testuale.",
+		"missingError":       "Completa la verifica prima di continuare.",
+		"failedError":        "La verifica non è riuscita. Riprova.",
+		"expiredError":       "La verifica è scaduta. Riprova.",
+	},
+	"ja": {
+		"title":              "接続を確認しています",
+		"message":            "ネットワーク接続を確認しています。しばらくお待ちください。",
+		"failedTitle":        "確認に失敗しました",
+		"failedMessage":      "接続を確認できませんでした。しばらくしてからもう一度お試しください。",
+		"blockedTitle":       "アクセスが拒否されました",
+		"blockedMessage":     "リクエストはブロックされました。",
+		"unavailableTitle":   "確認を利用できません",
+		"unavailableMessage": "現在、接続を確認できません。数分後にもう一度お試しください。",
+		"retry":              "再試行",
+		"continue":           "続行",
+		"noscript":           "接続を確認するには JavaScript が必要です。有効にしてからこのページを再読み込みしてください。",
+		"verified":           "確認しました。続行しています…",
+		"error":              "確認を完了できませんでした。もう一度お試しください。",
+		"alternative":        "別の方法で確認する",
+		"solving":            "ブラウザを確認しています。数秒かかる場合があります…",
+		"noscriptFallback":   "JavaScript を使わない場合は、下の認証を解き、表示されたコードをボックスに貼り付けて「続行」を選択してください。",
+		"recaptchaHelp":      "画像を解けない場合は、認証内のヘッドホンボタンを選択すると音声による認証を受けられます。",
+		"hcaptchaHelp":       "画像を解けない場合は、認証内のメニューを開いてテキストによる認証を選択してください。",
+		"missingError":       "続行する前に確認を完了してください。",
+		"failedError":        "確認に成功しませんでした。もう一度お試しください。",
+		"expiredError":       "確認の有効期限が切れました。もう一度お試しください。",
+	},
+	"nl": {
+		"title":              "Verbinding controleren",
+		"message":            "Een moment geduld terwijl we uw netwerkverbinding controleren.",
+		"failedTitle":        "Verificatie mislukt",
+		"failedMessage":      "We konden uw verbinding niet verifiëren. Probeer het later opnieuw.",
+		"blockedTitle":       "Toegang geweigerd",
+		"blockedMessage":     "Uw verzoek is geblokkeerd.",
+		"unavailableTitle":   "Verificatie niet beschikbaar",
+		"unavailableMessage": "We kunnen uw verbinding nu niet verifiëren. Probeer het over een paar minuten opnieuw.",
+		"retry":              "Opnieuw proberen",
+		"continue":           "Doorgaan",
+		"noscript":           "JavaScript is nodig om uw verbinding te verifiëren. Schakel het in en laad deze pagina opnieuw.",
+		"verified":           "Geverifieerd. Doorgaan…",
+		"error":              "De verificatie kon niet worden voltooid. Probeer het opnieuw.",
+		"alternative":        "Een andere verificatie gebruiken",
+		"solving":            "Uw browser wordt geverifieerd, dit kan enkele seconden duren…",
+		"noscriptFallback":   "Los zonder JavaScript de uitdaging hieronder op, kopieer de getoonde code naar het vak en kies Doorgaan.",
+		"recaptchaHelp":      "Lukt het niet om de afbeeldingen op te lossen, kies dan de koptelefoonknop in de uitdaging voor een audio-uitdaging.",
+		"hcaptchaHelp":       "Lukt het niet om de afbeeldingen op te lossen, open dan het menu van de uitdaging om een tekstuitdaging te kiezen.",
+		"missingError":       "Voltooi de verificatie voordat u verdergaat.",
+		"failedError":        "De verificatie is niet gelukt. Probeer het opnieuw.",
+		"expiredError":       "De verificatie is verlopen. Probeer het opnieuw.",
+	},
+	"pl": {
+		"title":              "Weryfikacja połączenia",
+		"message":            "Chwileczkę, weryfikujemy Twoje połączenie sieciowe.",
+		"failedTitle":        "Weryfikacja nie powiodła się",
+		"failedMessage":      "Nie udało się zweryfikować Twojego połączenia. Spróbuj ponownie później.",
+		"blockedTitle":       "Odmowa dostępu",
+		"blockedMessage":     "Twoje żądanie zostało zablokowane.",
+		"unavailableTitle":   "Weryfikacja niedostępna",
+		"unavailableMessage": "Nie możemy teraz zweryfikować Twojego połączenia. Spróbuj ponownie za kilka minut.",
+		"retry":              "Spróbuj ponownie",
+		"continue":           "Kontynuuj",
+		"noscript":           "Do weryfikacji połączenia wymagany jest JavaScript. Włącz go i odśwież tę stronę.",
+		"verified":           "Zweryfikowano. Kontynuowanie…",
+		"error":              "Nie udało się ukończyć weryfikacji. Spróbuj ponownie.",
+		"alternative":        "Użyj innej weryfikacji",
+		"solving":            "Weryfikujemy Twoją przeglądarkę, może to potrwać kilka sekund…",
+		"noscriptFallback":   "Bez JavaScriptu rozwiąż poniższe zadanie, skopiuj wyświetlony kod do pola i wybierz Kontynuuj.",
+		"recaptchaHelp":      "Jeśli nie możesz rozwiązać zadania z obrazkami, wybierz w nim przycisk słuchawek, aby otrzymać zadanie dźwiękowe.",
+		"hcaptchaHelp":       "Jeśli nie możesz rozwiązać zadania z obrazkami, otwórz jego menu i wybierz zadanie tekstowe.",
+		"missingError":       "Dokończ weryfikację, zanim przejdziesz dalej.",
+		"failedError":        "Weryfikacja nie powiodła się. Spróbuj ponownie.",
+		"expiredError":       "Weryfikacja wygasła. Spróbuj ponownie.",
+	},
+	"pt": {
+		"title":              "Verificando a conexão",
+		"message":            "Um momento enquanto verificamos sua conexão de rede.",
+		"failedTitle":        "Falha na verificação",
+		"failedMessage":      "Não foi possível verificar sua conexão. Tente novamente mais tarde.",
+		"blockedTitle":       "Acesso negado",
+		"blockedMessage":     "Sua solicitação foi bloqueada.",
+		"unavailableTitle":   "Verificação indisponível",
+		"unavailableMessage": "Não podemos verificar sua conexão agora. Tente novamente em alguns minutos.",
+		"retry":              "Tentar novamente",
+		"continue":           "Continuar",
+		"noscript":           "É necessário JavaScript para verificar sua conexão. Ative-o e recarregue esta página.",
+		"verified":           "Verificado. Continuando…",
+		"error":              "Não foi possível concluir a verificação. Tente novamente.",
+		"alternative":        "Usar outra verificação",
+		"solving":            "Verificando seu navegador, isso pode levar alguns segundos…",
+		"noscriptFallback":   "Sem JavaScript, resolva o desafio abaixo, copie o código exibido para a caixa e selecione Continuar.",
+		"recaptchaHelp":      "Se não conseguir resolver as imagens, selecione o botão de fones de ouvido no desafio para um desafio em áudio.",
+		"hcaptchaHelp":       "Se não conseguir resolver as imagens, abra o menu do desafio para escolher um desafio em texto.",
+		"missingError":       "Conclua a verificação antes de continuar.",
+		"failedError":        "A verificação não foi bem-sucedida. Tente novamente.",
+		"expiredError":       "A verificação expirou. Tente novamente.",
+	},
+	"ru": {
+		"title":              "Проверка подключения",
+		"message":            "Подождите, пока мы проверяем ваше сетевое подключение.",
+		"failedTitle":        "Проверка не пройдена",
+		"failedMessage":      "Не удалось проверить ваше подключение. Попробуйте позже.",
+		"blockedTitle":       "Доступ запрещён",
+		"blockedMessage":     "Ваш запрос заблокирован.",
+		"unavailableTitle":   "Проверка недоступна",
+		"unavailableMessage": "Сейчас мы не можем проверить ваше подключение. Попробуйте через несколько минут.",
+		"retry":              "Попробовать снова",
+		"continue":           "Продолжить",
+		"noscript":           "Для проверки подключения нужен JavaScript. Включите его и перезагрузите страницу.",
+		"verified":           "Проверено. Продолжаем…",
+		"error":              "Не удалось завершить проверку. Попробуйте ещё раз.",
+		"alternative":        "Использовать другую проверку",
+		"solving":            "Проверяем ваш браузер, это может занять несколько секунд…",
+		"noscriptFallback":   "Без JavaScript решите задание ниже, скопируйте показанный код в поле и нажмите «Продолжить».",
+		"recaptchaHelp":      "Если не получается решить задание с картинками, нажмите в нём кнопку с наушниками, чтобы получить аудиозадание.",
+		"hcaptchaHelp":       "Если не получается решить задание с картинками, откройте его меню и выберите текстовое задание.",
+		"missingError":       "Пожалуйста, пройдите проверку, прежде чем продолжить.",
+		"failedError":        "Проверка не пройдена. Попробуйте ещё раз.",
+		"expiredError":       "Срок проверки истёк. Попробуйте ещё раз.",
+	},
+	"tr": {
+		"title":              "Bağlantı doğrulanıyor",
+		"message":            "Ağ bağlantınızı doğrularken lütfen bekleyin.",
+		"failedTitle":        "Doğrulama başarısız",
+		"failedMessage":      "Bağlantınızı doğrulayamadık. Lütfen daha sonra tekrar deneyin.",
+		"blockedTitle":       "Erişim reddedildi",
+		"blockedMessage":     "İsteğiniz engellendi.",
+		"unavailableTitle":   "Doğrulama kullanılamıyor",
+		"unavailableMessage": "Şu anda bağlantınızı doğrulayamıyoruz. Lütfen birkaç dakika sonra tekrar deneyin.",
+		"retry":              "Tekrar dene",
+		"continue":           "Devam et",
+		"noscript":           "Bağlantınızı doğrulamak için JavaScript gerekiyor. Lütfen etkinleştirip bu sayfayı yeniden yükleyin.",
+		"verified":           "Doğrulandı. Devam ediliyor…",
+		"error":              "Doğrulama tamamlanamadı. Lütfen tekrar deneyin.",
+		"alternative":        "Farklı bir doğrulama kullan",
+		"solving":            "Tarayıcınız doğrulanıyor, bu birkaç saniye sürebilir…",
+		"noscriptFallback":   "JavaScript olmadan aşağıdaki doğrulamayı çözün, gösterilen kodu kutuya kopyalayın ve Devam et'i seçin.",
+		"recaptchaHelp":      "Resimleri çözemiyorsanız, sesli doğrulama için doğrulamadaki kulaklık düğmesini seçin.",
+		"hcaptchaHelp":       "Resimleri çözemiyorsanız, metin tabanlı bir doğrulama seçmek için doğrulamanın menüsünü açın.",
+		"missingError":       "Devam etmeden önce lütfen doğrulamayı tamamlayın.",
+		"failedError":        "Doğrulama başarılı olmadı. Lütfen tekrar deneyin.",
+		"expiredError":       "Doğrulamanın süresi doldu. Lütfen tekrar deneyin.",
+	},
+	"zh": {
+		"title":              "正在验证连接",
+		"message":            "请稍候，我们正在验证您的网络连接。",
+		"failedTitle":        "验证失败",
+		"failedMessage":      "我们无法验证您的连接，请稍后重试。",
+		"blockedTitle":       "访问被拒绝",
+		"blockedMessage":     "您的请求已被阻止。",
+		"unavailableTitle":   "验证暂不可用",
+		"unavailableMessage": "我们现在无法验证您的连接，请几分钟后重试。",
+		"retry":              "重试",
+		"continue":           "继续",
+		"noscript":           "需要启用 JavaScript 才能验证您的连接。请启用后重新加载此页面。",
+		"verified":           "已验证，正在继续…",
+		"error":              "无法完成验证，请重试。",
+		"alternative":        "使用其他验证方式",
+		"solving":            "正在验证您的浏览器，这可能需要几秒钟…",
+		"noscriptFallback":   "如果不使用 JavaScript，请完成下面的验证，将显示的代码复制到文本框中，然后选择“继续”。",
+		"recaptchaHelp":      "如果无法完成图片验证，请选择验证中的耳机按钮以使用语音验证。",
+		"hcaptchaHelp":       "如果无法完成图片验证，请打开验证中的菜单并选择文字验证。",
+		"missingError":       "请先完成验证再继续。",
+		"failedError":        "验证未通过，请重试。",
+		"expiredError":       "验证已过期，请重试。",
+	},
+}
@@ -0,0 +1,87 @@
+package i18n
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Fallback is used for languages and messages without a translation
+const Fallback = "en"
+
+// Supported reports whether there is a catalog for lang
+func Supported(lang string) bool {
+	_, ok := catalogs[strings.ToLower(lang)]
+	return ok
+}
+
+// Languages returns the languages with a catalog, sorted
+func Languages() []string {
+	langs := make([]string, 0, len(catalogs))
+	for lang := range catalogs {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+
+	return langs
+}
+
+// T returns the message for key in lang, falling back to English, then to the key itself
+func T(lang, key string) string {
+	if msg, ok := catalogs[lang][key]; ok {
+		return msg
+	}
+	if msg, ok := catalogs[Fallback][key]; ok {
+		return msg
+	}
+
+	return key
+}
+
+type weighted struct {
+	tag string
+	q   float64
+}
+
+// Negotiate picks the supported language the client prefers most from an Accept-Language header
+// A regional tag like pt-BR matches pt, and fallback is returned when nothing matches
+func Negotiate(acceptLanguage, fallback string) string {
+	if acceptLanguage == "" {
+		return fallback
+	}
+
+	var tags []weighted
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		tags = append(tags, weighted{tag: tag, q: q})
+	}
+	// equal weights keep the order the client sent them in
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	for _, t := range tags {
+		if _, ok := catalogs[t.tag]; ok {
+			return t.tag
+		}
+		base, _, _ := strings.Cut(t.tag, "-")
+		if _, ok := catalogs[base]; ok {
+			return base
+		}
+	}
+
+	return fallback
+}
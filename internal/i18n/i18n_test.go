@@ -0,0 +1,63 @@
+package i18n
+
+import "testing"
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		header   string
+		fallback string
+		expected string
+	}{
+		{header: "", fallback: "en", expected: "en"},
+		{header: "de", fallback: "en", expected: "de"},
+		{header: "de-AT,de;q=0.9,en;q=0.8", fallback: "en", expected: "de"},
+		{header: "pt-BR", fallback: "en", expected: "pt"},
+		{header: "ZH-cn", fallback: "en", expected: "zh"},
+		{header: "en;q=0.5, fr;q=0.9", fallback: "en", expected: "fr"},
+		{header: "xx, it;q=0.1", fallback: "en", expected: "it"},
+		{header: "fr;q=0, es", fallback: "en", expected: "es"},
+		{header: "nl, fr", fallback: "en", expected: "nl"},
+		{header: "*", fallback: "de", expected: "de"},
+		{header: "xx-YY", fallback: "fr", expected: "fr"},
+		{header: "de;q=abc", fallback: "en", expected: "de"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.header, func(t *testing.T) {
+			if got := Negotiate(tc.header, tc.fallback); got != tc.expected {
+				t.Errorf("Negotiate(%q) = %q; expected %q", tc.header, got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestT(t *testing.T) {
+	if got := T("de", "title"); got != "Verbindung wird überprüft" {
+		t.Errorf("T(de, title) = %q", got)
+	}
+	if got := T("xx", "title"); got != "Verifying connection" {
+		t.Errorf("expected an unknown language to fall back to English, got %q", got)
+	}
+	if got := T("de", "missing"); got != "missing" {
+		t.Errorf("expected an unknown key to be returned as is, got %q", got)
+	}
+}
+
+// every catalog must translate every English message
+func TestCatalogsComplete(t *testing.T) {
+	for _, lang := range Languages() {
+		for key := range catalogs[Fallback] {
+			if catalogs[lang][key] == "" {
+				t.Errorf("%s is missing %s", lang, key)
+			}
+		}
+		for key := range catalogs[lang] {
+			if _, ok := catalogs[Fallback][key]; !ok {
+				t.Errorf("%s has %s, which English doesn't", lang, key)
+			}
+		}
+	}
+	if !Supported("DE") || Supported("xx") {
+		t.Error("unexpected Supported result")
+	}
+}
@@ -0,0 +1,95 @@
+package lookup
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+)
+
+// ErrBusy is returned when every worker is already running a lookup
+var ErrBusy = errors.New("too many lookups in progress")
+
+// Group runs slow lookups (e.g. reverse DNS) in the background
+// Concurrent lookups with the same key share one call, and at most
+// workers calls run at once so a flood of new IPs can't exhaust the resolver
+type Group struct {
+	workers chan struct{}
+	mu      sync.Mutex
+	calls   map[Key]*Call
+}
+
+// Key identifies a lookup
+// Name tells apart different lookups for the same IP
+type Key struct {
+	IP   netip.Addr
+	Name string
+}
+
+// Call is a lookup that is running or has finished
+type Call struct {
+	done chan struct{}
+	val  bool
+	err  error
+}
+
+func New(workers int) *Group {
+	return &Group{
+		workers: make(chan struct{}, workers),
+		calls:   make(map[Key]*Call),
+	}
+}
+
+// Do starts fn for key in the background, or returns the call already running for key
+// ErrBusy is returned instead of queueing when all workers are in use
+func (g *Group) Do(key Key, fn func() (bool, error)) (*Call, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if c, ok := g.calls[key]; ok {
+		return c, nil
+	}
+
+	select {
+	case g.workers <- struct{}{}:
+	default:
+		return nil, ErrBusy
+	}
+
+	c := &Call{done: make(chan struct{})}
+	g.calls[key] = c
+	go func() {
+		c.val, c.err = fn()
+
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		<-g.workers
+		close(c.done)
+	}()
+
+	return c, nil
+}
+
+// Pending returns the number of lookups running
+func (g *Group) Pending() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return len(g.calls)
+}
+
+// Done is closed once the lookup has finished
+func (c *Call) Done() <-chan struct{} {
+	return c.done
+}
+
+// Wait blocks until the lookup finishes or ctx is done
+func (c *Call) Wait(ctx context.Context) (bool, error) {
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
@@ -0,0 +1,120 @@
+package lookup
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDoDeduplicates(t *testing.T) {
+	g := New(4)
+	key := Key{IP: netip.MustParseAddr("1.2.3.4")}
+	release := make(chan struct{})
+	var runs atomic.Int32
+	fn := func() (bool, error) {
+		runs.Add(1)
+		<-release
+		return true, nil
+	}
+
+	var wg sync.WaitGroup
+	calls := make([]*Call, 10)
+	for i := range calls {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := g.Do(key, fn)
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+				return
+			}
+			calls[i] = c
+		}(i)
+	}
+	wg.Wait()
+
+	if g.Pending() != 1 {
+		t.Errorf("expected 1 pending lookup, got %d", g.Pending())
+	}
+	close(release)
+
+	for _, c := range calls {
+		if c == nil {
+			continue
+		}
+		v, err := c.Wait(context.Background())
+		if !v || err != nil {
+			t.Errorf("Wait() = %v, %v; expected true, nil", v, err)
+		}
+	}
+	if runs.Load() != 1 {
+		t.Errorf("expected the lookup to run once, ran %d times", runs.Load())
+	}
+	if g.Pending() != 0 {
+		t.Errorf("expected no pending lookups, got %d", g.Pending())
+	}
+}
+
+func TestDoIsBounded(t *testing.T) {
+	g := New(2)
+	release := make(chan struct{})
+	fn := func() (bool, error) {
+		<-release
+		return false, nil
+	}
+
+	var calls []*Call
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2"} {
+		c, err := g.Do(Key{IP: netip.MustParseAddr(ip)}, fn)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		calls = append(calls, c)
+	}
+
+	if _, err := g.Do(Key{IP: netip.MustParseAddr("3.3.3.3")}, fn); !errors.Is(err, ErrBusy) {
+		t.Errorf("expected ErrBusy, got %v", err)
+	}
+
+	// waiting on a running lookup is still allowed while busy
+	if _, err := g.Do(Key{IP: netip.MustParseAddr("1.1.1.1")}, fn); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// a different lookup for the same IP is a separate call
+	if _, err := g.Do(Key{IP: netip.MustParseAddr("1.1.1.1"), Name: "other"}, fn); !errors.Is(err, ErrBusy) {
+		t.Errorf("expected ErrBusy, got %v", err)
+	}
+
+	close(release)
+	for _, c := range calls {
+		<-c.Done()
+	}
+
+	if _, err := g.Do(Key{IP: netip.MustParseAddr("3.3.3.3")}, func() (bool, error) { return true, nil }); err != nil {
+		t.Errorf("expected a free worker after the lookups finished, got %v", err)
+	}
+}
+
+func TestWaitContext(t *testing.T) {
+	g := New(1)
+	release := make(chan struct{})
+	defer close(release)
+	c, err := g.Do(Key{IP: netip.MustParseAddr("1.2.3.4")}, func() (bool, error) {
+		<-release
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
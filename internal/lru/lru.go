@@ -0,0 +1,219 @@
+package lru
+
+import (
+	"container/list"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// For use with functions that take an expiration time
+	NoExpiration time.Duration = -1
+	// Use the expiration the cache was created with
+	DefaultExpiration time.Duration = 0
+)
+
+type Item struct {
+	Object     interface{}
+	Expiration int64
+}
+
+// Expired returns true if the item has expired
+func (item Item) Expired(now int64) bool {
+	return item.Expiration > 0 && now > item.Expiration
+}
+
+type entry struct {
+	key  netip.Prefix
+	item Item
+}
+
+// Cache is a thread-safe, size-bounded cache keyed by IP prefix with per item expiration
+// When full, the least recently used entry is evicted to make room
+type Cache struct {
+	mu                sync.Mutex
+	defaultExpiration time.Duration
+	cleanupInterval   time.Duration
+	maxEntries        int
+	items             map[netip.Prefix]*list.Element
+	order             *list.List
+	evictions         uint64
+	lastCleanup       time.Time
+}
+
+// New creates a cache
+// Expired items are swept at most once per cleanupInterval while the cache is being written to
+// maxEntries of 0 means the cache is unbounded
+func New(defaultExpiration, cleanupInterval time.Duration, maxEntries int) *Cache {
+	return &Cache{
+		defaultExpiration: defaultExpiration,
+		cleanupInterval:   cleanupInterval,
+		maxEntries:        maxEntries,
+		items:             make(map[netip.Prefix]*list.Element),
+		order:             list.New(),
+		lastCleanup:       time.Now(),
+	}
+}
+
+// Set adds an item to the cache, replacing any existing item
+func (c *Cache) Set(k netip.Prefix, x interface{}, d time.Duration) {
+	c.mu.Lock()
+	c.set(k, x, d)
+	c.mu.Unlock()
+}
+
+// Add an item to the cache only if it doesn't already exist
+func (c *Cache) Add(k netip.Prefix, x interface{}, d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, found := c.get(k); found {
+		return fmt.Errorf("item %s already exists", k)
+	}
+	c.set(k, x, d)
+
+	return nil
+}
+
+// Get an item from the cache and mark it as recently used
+func (c *Cache) Get(k netip.Prefix) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.get(k)
+}
+
+// Take removes an item from the cache and returns it
+func (c *Cache) Take(k netip.Prefix) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	x, found := c.get(k)
+	if el, ok := c.items[k]; ok {
+		c.remove(el)
+	}
+
+	return x, found
+}
+
+// Increment adds n to the int stored for k, or stores n when there is none,
+// restarting its expiration, and returns the new value
+func (c *Cache) Increment(k netip.Prefix, n int, d time.Duration) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	x, _ := c.get(k)
+	v, _ := x.(int)
+	v += n
+	c.set(k, v, d)
+
+	return v
+}
+
+// Items returns a copy of all unexpired items in the cache
+func (c *Cache) Items() map[netip.Prefix]Item {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	m := make(map[netip.Prefix]Item, len(c.items))
+	for k, el := range c.items {
+		item := el.Value.(*entry).item
+		if item.Expired(now) {
+			continue
+		}
+		m[k] = item
+	}
+
+	return m
+}
+
+// ItemCount returns the number of items in the cache, including expired items not yet swept
+func (c *Cache) ItemCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.items)
+}
+
+// Evictions returns how many items were evicted to stay within maxEntries
+func (c *Cache) Evictions() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.evictions
+}
+
+func (c *Cache) get(k netip.Prefix) (interface{}, bool) {
+	el, found := c.items[k]
+	if !found {
+		return nil, false
+	}
+
+	e := el.Value.(*entry)
+	if e.item.Expired(time.Now().UnixNano()) {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+
+	return e.item.Object, true
+}
+
+func (c *Cache) set(k netip.Prefix, x interface{}, d time.Duration) {
+	now := time.Now()
+	if d == DefaultExpiration {
+		d = c.defaultExpiration
+	}
+	var exp int64
+	if d > 0 {
+		exp = now.Add(d).UnixNano()
+	}
+
+	if el, found := c.items[k]; found {
+		el.Value.(*entry).item = Item{Object: x, Expiration: exp}
+		c.order.MoveToFront(el)
+		return
+	}
+
+	if now.Sub(c.lastCleanup) >= c.cleanupInterval {
+		c.deleteExpired(now.UnixNano())
+		c.lastCleanup = now
+	}
+
+	for c.maxEntries > 0 && len(c.items) >= c.maxEntries {
+		c.evict()
+	}
+
+	c.items[k] = c.order.PushFront(&entry{
+		key:  k,
+		item: Item{Object: x, Expiration: exp},
+	})
+}
+
+// evict removes the least recently used entry
+func (c *Cache) evict() {
+	victim := c.order.Back()
+	if victim == nil {
+		return
+	}
+
+	c.remove(victim)
+	c.evictions++
+}
+
+func (c *Cache) deleteExpired(now int64) {
+	for el := c.order.Back(); el != nil; {
+		prev := el.Prev()
+		if el.Value.(*entry).item.Expired(now) {
+			c.remove(el)
+		}
+		el = prev
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*entry).key)
+}
@@ -0,0 +1,111 @@
+package lru
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+func key(s string) netip.Prefix {
+	return netip.MustParsePrefix(s)
+}
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	c := New(time.Hour, time.Hour, 3)
+	c.Set(key("1.0.0.0/8"), true, DefaultExpiration)
+	c.Set(key("2.0.0.0/8"), true, DefaultExpiration)
+	c.Set(key("3.0.0.0/8"), true, DefaultExpiration)
+
+	// touch the first entry so the second becomes the least recently used
+	if _, ok := c.Get(key("1.0.0.0/8")); !ok {
+		t.Fatal("expected 1.0.0.0/8 to be cached")
+	}
+	c.Set(key("4.0.0.0/8"), true, DefaultExpiration)
+
+	if _, ok := c.Get(key("2.0.0.0/8")); ok {
+		t.Error("expected 2.0.0.0/8 to be evicted")
+	}
+	for _, k := range []string{"1.0.0.0/8", "3.0.0.0/8", "4.0.0.0/8"} {
+		if _, ok := c.Get(key(k)); !ok {
+			t.Errorf("expected %s to be cached", k)
+		}
+	}
+	if c.ItemCount() != 3 {
+		t.Errorf("expected 3 items, got %d", c.ItemCount())
+	}
+	if c.Evictions() != 1 {
+		t.Errorf("expected 1 eviction, got %d", c.Evictions())
+	}
+}
+
+func TestAdd(t *testing.T) {
+	c := New(time.Hour, time.Hour, 0)
+	if err := c.Add(key("1.0.0.0/8"), true, DefaultExpiration); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := c.Add(key("1.0.0.0/8"), true, DefaultExpiration); err == nil {
+		t.Error("expected an error adding an existing item")
+	}
+}
+
+func TestTake(t *testing.T) {
+	c := New(time.Hour, time.Hour, 0)
+	c.Set(key("1.0.0.0/8"), "body", DefaultExpiration)
+
+	if x, ok := c.Take(key("1.0.0.0/8")); !ok || x != "body" {
+		t.Fatalf("Take() = %v, %v; expected body", x, ok)
+	}
+	if _, ok := c.Take(key("1.0.0.0/8")); ok {
+		t.Error("expected an item to only be taken once")
+	}
+	if c.ItemCount() != 0 {
+		t.Errorf("expected no items, got %d", c.ItemCount())
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	c := New(time.Hour, time.Hour, 0)
+	if v := c.Increment(key("1.0.0.0/8"), 1, DefaultExpiration); v != 1 {
+		t.Errorf("expected a missing item to start at 1, got %d", v)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Increment(key("1.0.0.0/8"), 1, DefaultExpiration)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if x, ok := c.Get(key("1.0.0.0/8")); !ok || x != 801 {
+		t.Errorf("expected no increments to be lost, got %v", x)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	c := New(time.Millisecond, 0, 0)
+	c.Set(key("1.0.0.0/8"), true, DefaultExpiration)
+	c.Set(key("2.0.0.0/8"), true, NoExpiration)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := c.Get(key("1.0.0.0/8")); ok {
+		t.Error("expected 1.0.0.0/8 to be expired")
+	}
+	if len(c.Items()) != 1 {
+		t.Errorf("expected only 2.0.0.0/8 in items, got %v", c.Items())
+	}
+
+	// writes sweep expired items
+	c.Set(key("3.0.0.0/8"), true, NoExpiration)
+	if c.ItemCount() != 2 {
+		t.Errorf("expected expired item to be swept, got %d items", c.ItemCount())
+	}
+	if c.Evictions() != 0 {
+		t.Errorf("expected expired items not to count as evictions, got %d", c.Evictions())
+	}
+}
@@ -0,0 +1,461 @@
+package mmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// MaxMind DB files are read into memory and decoded by hand
+// rather than with the MaxMind libraries, which use mmap and unsafe
+// and so can't be loaded by yaegi
+// https://maxmind.github.io/MaxMind-DB/
+
+var metadataStart = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// the metadata is in the last 128KiB of the file
+const maxMetadataSize = 128 * 1024
+
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+var errInvalid = errors.New("invalid MaxMind DB")
+
+// Reader looks up IPs in a MaxMind DB, e.g. GeoLite2-Country or GeoLite2-ASN
+type Reader struct {
+	buf          []byte
+	data         []byte
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	ipv4Start    uint
+	DatabaseType string
+}
+
+// Open reads a MaxMind DB file into memory
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return FromBytes(buf)
+}
+
+// FromBytes reads a MaxMind DB from memory
+func FromBytes(buf []byte) (*Reader, error) {
+	searchFrom := max(len(buf)-maxMetadataSize, 0)
+	i := bytes.LastIndex(buf[searchFrom:], metadataStart)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: metadata not found", errInvalid)
+	}
+	metaStart := searchFrom + i + len(metadataStart)
+
+	meta, _, err := decoder{buf: buf[metaStart:]}.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: metadata: %v", errInvalid, err)
+	}
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", errInvalid)
+	}
+
+	r := &Reader{buf: buf}
+	r.nodeCount, _ = toUint(m["node_count"])
+	r.recordSize, _ = toUint(m["record_size"])
+	r.ipVersion, _ = toUint(m["ip_version"])
+	r.DatabaseType, _ = m["database_type"].(string)
+	if major, _ := toUint(m["binary_format_major_version"]); major != 2 {
+		return nil, fmt.Errorf("%w: unsupported format version %d", errInvalid, major)
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("%w: unsupported record size %d", errInvalid, r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("%w: unsupported ip version %d", errInvalid, r.ipVersion)
+	}
+
+	// the search tree is followed by 16 zero bytes, then the data section
+	treeSize := r.nodeCount * r.recordSize / 4
+	dataStart := treeSize + 16
+	if dataStart > uint(searchFrom+i) {
+		return nil, fmt.Errorf("%w: search tree is larger than the file", errInvalid)
+	}
+	r.data = buf[dataStart : searchFrom+i]
+
+	// IPv4 addresses are stored at ::a.b.c.d in IPv6 databases
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// Lookup returns the value at path in the record for ip, e.g. Lookup(ip, "country", "iso_code")
+// Maps decode to map[string]interface{}, arrays to []interface{},
+// integers to uint64 or int32, and floating point numbers to float64
+func (r *Reader) Lookup(ip netip.Addr, path ...string) (interface{}, bool, error) {
+	offset, ok, err := r.find(ip)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	d := decoder{buf: r.data}
+	for _, key := range path {
+		offset, ok, err = d.mapValue(offset, key)
+		if err != nil || !ok {
+			return nil, false, err
+		}
+	}
+
+	v, _, err := d.decode(offset, 0)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return v, true, nil
+}
+
+// find walks the search tree to the data offset for ip
+func (r *Reader) find(ip netip.Addr) (uint, bool, error) {
+	ip = ip.Unmap()
+	var addr []byte
+	node := uint(0)
+	if ip.Is4() {
+		a := ip.As4()
+		addr = a[:]
+		node = r.ipv4Start
+	} else {
+		if r.ipVersion == 4 {
+			return 0, false, nil
+		}
+		a := ip.As16()
+		addr = a[:]
+	}
+
+	for i := 0; i < len(addr)*8 && node < r.nodeCount; i++ {
+		bit := uint(addr[i>>3]>>(7-uint(i&7))) & 1
+		node = r.record(node, bit)
+	}
+
+	if node == r.nodeCount {
+		return 0, false, nil
+	}
+	if node < r.nodeCount {
+		return 0, false, fmt.Errorf("%w: search tree is deeper than the address", errInvalid)
+	}
+
+	offset := node - r.nodeCount - 16
+	if offset >= uint(len(r.data)) {
+		return 0, false, fmt.Errorf("%w: record points outside the data section", errInvalid)
+	}
+
+	return offset, true, nil
+}
+
+// record reads the left (bit 0) or right (bit 1) record of a node
+func (r *Reader) record(node, bit uint) uint {
+	b := r.buf[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		// the middle byte holds the high nibble of both records
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+type decoder struct {
+	buf []byte
+}
+
+// pointers can point to pointers in broken files, so nesting is limited
+const maxDepth = 32
+
+// header reads a control byte and returns the type, size and offset of the value
+func (d decoder) header(offset uint) (int, uint, uint, error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, 0, 0, errInvalid
+	}
+	ctrl := d.buf[offset]
+	offset++
+
+	typ := int(ctrl >> 5)
+	if typ == typePointer {
+		return typ, uint(ctrl), offset, nil
+	}
+	if typ == typeExtended {
+		if offset >= uint(len(d.buf)) {
+			return 0, 0, 0, errInvalid
+		}
+		typ = 7 + int(d.buf[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d.buf)) {
+			return 0, 0, 0, errInvalid
+		}
+		v := uint(0)
+		for _, b := range d.buf[offset : offset+n] {
+			v = v<<8 | uint(b)
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + v
+		case 2:
+			size = 285 + v
+		default:
+			size = 65821 + v
+		}
+	}
+
+	return typ, size, offset, nil
+}
+
+// pointer returns the offset a pointer points to and the offset after the pointer
+func (d decoder) pointer(ctrl, offset uint) (uint, uint, error) {
+	n := (ctrl>>3)&3 + 1
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, errInvalid
+	}
+	v := uint(0)
+	if n < 4 {
+		v = ctrl & 7
+	}
+	for _, b := range d.buf[offset : offset+n] {
+		v = v<<8 | uint(b)
+	}
+	switch n {
+	case 2:
+		v += 2048
+	case 3:
+		v += 526336
+	}
+
+	return v, offset + n, nil
+}
+
+// resolve follows a pointer to the value it points to
+func (d decoder) resolve(offset uint) (uint, uint, error) {
+	typ, ctrl, next, err := d.header(offset)
+	if err != nil || typ != typePointer {
+		return offset, 0, err
+	}
+	target, after, err := d.pointer(ctrl, next)
+	return target, after, err
+}
+
+// mapValue returns the offset of key's value in the map at offset
+func (d decoder) mapValue(offset uint, key string) (uint, bool, error) {
+	offset, _, err := d.resolve(offset)
+	if err != nil {
+		return 0, false, err
+	}
+	typ, size, offset, err := d.header(offset)
+	if err != nil {
+		return 0, false, err
+	}
+	if typ != typeMap {
+		return 0, false, nil
+	}
+
+	for i := uint(0); i < size; i++ {
+		k, next, err := d.decode(offset, 0)
+		if err != nil {
+			return 0, false, err
+		}
+		if s, ok := k.(string); ok && s == key {
+			return next, true, nil
+		}
+		offset, err = d.skip(next, 0)
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
+	return 0, false, nil
+}
+
+// skip returns the offset after the value at offset
+func (d decoder) skip(offset uint, depth int) (uint, error) {
+	if depth > maxDepth {
+		return 0, errInvalid
+	}
+	typ, size, next, err := d.header(offset)
+	if err != nil {
+		return 0, err
+	}
+
+	switch typ {
+	case typePointer:
+		_, after, err := d.pointer(size, next)
+		return after, err
+	case typeMap:
+		for i := uint(0); i < size*2; i++ {
+			if next, err = d.skip(next, depth+1); err != nil {
+				return 0, err
+			}
+		}
+		return next, nil
+	case typeArray:
+		for i := uint(0); i < size; i++ {
+			if next, err = d.skip(next, depth+1); err != nil {
+				return 0, err
+			}
+		}
+		return next, nil
+	case typeBool:
+		return next, nil
+	case typeDouble:
+		size = 8
+	case typeFloat:
+		size = 4
+	}
+	if next+size > uint(len(d.buf)) {
+		return 0, errInvalid
+	}
+
+	return next + size, nil
+}
+
+// decode returns the value at offset and the offset after it
+func (d decoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, errInvalid
+	}
+	typ, size, next, err := d.header(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch typ {
+	case typePointer:
+		target, after, err := d.pointer(size, next)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(target, depth+1)
+		return v, after, err
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, after, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("%w: map key is not a string", errInvalid)
+			}
+			m[key], next, err = d.decode(after, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, next, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var v interface{}
+			v, next, err = d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, next, nil
+	case typeBool:
+		return size != 0, next, nil
+	case typeDouble:
+		size = 8
+	case typeFloat:
+		size = 4
+	}
+
+	if next+size > uint(len(d.buf)) {
+		return nil, 0, errInvalid
+	}
+	b := d.buf[next : next+size]
+	next += size
+
+	switch typ {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes:
+		return append([]byte(nil), b...), next, nil
+	case typeDouble:
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case typeFloat:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, errInvalid
+		}
+		v := uint64(0)
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, next, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, errInvalid
+		}
+		v := uint32(0)
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		// shorter values are zero padded, only 4 byte values can be negative
+		return int32(v), next, nil
+	case typeUint128:
+		// too large for the values this plugin reads
+		return append([]byte(nil), b...), next, nil
+	}
+
+	return nil, 0, fmt.Errorf("%w: unknown type %d", errInvalid, typ)
+}
+
+func toUint(v interface{}) (uint, bool) {
+	switch n := v.(type) {
+	case uint64:
+		return uint(n), true
+	case int32:
+		if n >= 0 {
+			return uint(n), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,363 @@
+package mmdb
+
+import (
+	"encoding/binary"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// writer builds small MaxMind DB files for tests
+type writer struct {
+	recordSize int
+	ipVersion  int
+	nodes      [][2]int
+	data       []byte
+}
+
+// records in nodes are another node's index, empty, or data at an offset
+const empty = -1
+
+func dataRecord(offset int) int {
+	return -2 - offset
+}
+
+func newWriter(recordSize, ipVersion int) *writer {
+	return &writer{
+		recordSize: recordSize,
+		ipVersion:  ipVersion,
+		nodes:      [][2]int{{empty, empty}},
+	}
+}
+
+// insert adds a prefix pointing at data written with encode
+func (w *writer) insert(prefix netip.Prefix, offset int) {
+	var addr []byte
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() && w.ipVersion == 6 {
+		a := netip.AddrFrom16(prefix.Addr().As16()).As16()
+		// IPv4 lives at ::a.b.c.d, not ::ffff:a.b.c.d
+		copy(a[:12], make([]byte, 12))
+		addr = a[:]
+		bits += 96
+	} else {
+		a := prefix.Addr().AsSlice()
+		addr = a
+	}
+
+	node := 0
+	for i := 0; i < bits; i++ {
+		bit := int(addr[i>>3]>>(7-uint(i&7))) & 1
+		if i == bits-1 {
+			w.nodes[node][bit] = dataRecord(offset)
+			return
+		}
+		next := w.nodes[node][bit]
+		if next < 0 {
+			w.nodes = append(w.nodes, [2]int{empty, empty})
+			next = len(w.nodes) - 1
+			w.nodes[node][bit] = next
+		}
+		node = next
+	}
+}
+
+func (w *writer) encode(v interface{}) int {
+	offset := len(w.data)
+	w.data = appendValue(w.data, v)
+	return offset
+}
+
+func appendHeader(b []byte, typ, size int) []byte {
+	var ctrl byte
+	var ext []byte
+	if typ > 7 {
+		ext = []byte{byte(typ - 7)}
+	} else {
+		ctrl = byte(typ << 5)
+	}
+
+	switch {
+	case size < 29:
+		b = append(b, ctrl|byte(size))
+		b = append(b, ext...)
+	case size < 285:
+		b = append(b, ctrl|29)
+		b = append(b, ext...)
+		b = append(b, byte(size-29))
+	case size < 65821:
+		b = append(b, ctrl|30)
+		b = append(b, ext...)
+		b = binary.BigEndian.AppendUint16(b, uint16(size-285))
+	default:
+		b = append(b, ctrl|31)
+		b = append(b, ext...)
+		v := size - 65821
+		b = append(b, byte(v>>16), byte(v>>8), byte(v))
+	}
+
+	return b
+}
+
+func appendUint(b []byte, typ int, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	n := 0
+	for n < 8 && buf[n] == 0 {
+		n++
+	}
+	b = appendHeader(b, typ, 8-n)
+	return append(b, buf[n:]...)
+}
+
+// pointer is encoded as a pointer to a data section offset
+type pointer int
+
+// shortInt32 is an int32 encoded in fewer than 4 bytes
+type shortInt32 []byte
+
+func appendValue(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		b = appendHeader(b, typeString, len(v))
+		return append(b, v...)
+	case uint16:
+		return appendUint(b, typeUint16, uint64(v))
+	case uint32:
+		return appendUint(b, typeUint32, uint64(v))
+	case uint64:
+		return appendUint(b, typeUint64, v)
+	case int32:
+		b = appendHeader(b, typeInt32, 4)
+		return binary.BigEndian.AppendUint32(b, uint32(v))
+	case shortInt32:
+		b = appendHeader(b, typeInt32, len(v))
+		return append(b, v...)
+	case float64:
+		b = appendHeader(b, typeDouble, 8)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(v))
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		return appendHeader(b, typeBool, size)
+	case pointer:
+		// the 1 and 2 byte forms are enough for test databases
+		if v < 2048 {
+			return append(b, byte(typePointer<<5|(v>>8)&7), byte(v))
+		}
+		p := int(v) - 2048
+		return append(b, byte(typePointer<<5|1<<3|(p>>16)&7), byte(p>>8), byte(p))
+	case []interface{}:
+		b = appendHeader(b, typeArray, len(v))
+		for _, e := range v {
+			b = appendValue(b, e)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = appendHeader(b, typeMap, len(v))
+		for _, k := range keys {
+			b = appendValue(b, k)
+			b = appendValue(b, v[k])
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+func (w *writer) bytes(databaseType string) []byte {
+	nodeCount := len(w.nodes)
+	record := func(r int) uint32 {
+		switch {
+		case r == empty:
+			return uint32(nodeCount)
+		case r < empty:
+			return uint32(nodeCount + 16 + (-2 - r))
+		default:
+			return uint32(r)
+		}
+	}
+
+	var b []byte
+	for _, n := range w.nodes {
+		left, right := record(n[0]), record(n[1])
+		switch w.recordSize {
+		case 24:
+			b = append(b, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			b = append(b, byte(left>>16), byte(left>>8), byte(left), byte(left>>20)&0xf0|byte(right>>24)&0x0f, byte(right>>16), byte(right>>8), byte(right))
+		case 32:
+			b = binary.BigEndian.AppendUint32(b, left)
+			b = binary.BigEndian.AppendUint32(b, right)
+		}
+	}
+	b = append(b, make([]byte, 16)...)
+	b = append(b, w.data...)
+	b = append(b, metadataStart...)
+
+	return appendValue(b, map[string]interface{}{
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(w.recordSize),
+		"ip_version":                  uint16(w.ipVersion),
+		"database_type":               databaseType,
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1700000000),
+		"languages":                   []interface{}{"en"},
+		"description":                 map[string]interface{}{"en": "test database"},
+	})
+}
+
+func countryDB(t *testing.T, recordSize int) *Reader {
+	t.Helper()
+	w := newWriter(recordSize, 6)
+	// a shared string reached through a pointer, the way real databases dedupe values
+	names := w.encode("United States")
+	us := w.encode(map[string]interface{}{
+		"country": map[string]interface{}{
+			"iso_code": "US",
+			"names":    map[string]interface{}{"en": pointer(names)},
+		},
+		"location": map[string]interface{}{"latitude": 37.751, "longitude": -97.822},
+		"is_eu":    false,
+	})
+	de := w.encode(map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "DE", "is_in_european_union": true},
+	})
+	w.insert(netip.MustParsePrefix("8.8.8.0/24"), us)
+	w.insert(netip.MustParsePrefix("2001:db8::/32"), us)
+	w.insert(netip.MustParsePrefix("5.9.0.0/16"), de)
+
+	r, err := FromBytes(w.bytes("GeoLite2-Country"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return r
+}
+
+func TestLookup(t *testing.T) {
+	for _, recordSize := range []int{24, 28, 32} {
+		r := countryDB(t, recordSize)
+		if r.DatabaseType != "GeoLite2-Country" {
+			t.Errorf("unexpected database type %s", r.DatabaseType)
+		}
+
+		tests := []struct {
+			ip       string
+			path     []string
+			expected interface{}
+		}{
+			{ip: "8.8.8.8", path: []string{"country", "iso_code"}, expected: "US"},
+			{ip: "::ffff:8.8.8.8", path: []string{"country", "iso_code"}, expected: "US"},
+			{ip: "2001:db8::1", path: []string{"country", "iso_code"}, expected: "US"},
+			{ip: "8.8.8.8", path: []string{"country", "names", "en"}, expected: "United States"},
+			{ip: "8.8.8.8", path: []string{"location", "latitude"}, expected: 37.751},
+			{ip: "8.8.8.8", path: []string{"is_eu"}, expected: false},
+			{ip: "5.9.1.2", path: []string{"country", "iso_code"}, expected: "DE"},
+			{ip: "5.9.1.2", path: []string{"country", "is_in_european_union"}, expected: true},
+			{ip: "5.9.1.2", path: []string{"country", "names", "en"}},
+			{ip: "8.8.4.4", path: []string{"country", "iso_code"}},
+			{ip: "2001:db9::1", path: []string{"country", "iso_code"}},
+		}
+
+		for _, tc := range tests {
+			v, ok, err := r.Lookup(netip.MustParseAddr(tc.ip), tc.path...)
+			if err != nil {
+				t.Fatalf("record size %d: Lookup(%s, %v) unexpected error %v", recordSize, tc.ip, tc.path, err)
+			}
+			if ok != (tc.expected != nil) || v != tc.expected {
+				t.Errorf("record size %d: Lookup(%s, %v) = %v, %v; expected %v", recordSize, tc.ip, tc.path, v, ok, tc.expected)
+			}
+		}
+	}
+}
+
+func TestLookupASN(t *testing.T) {
+	w := newWriter(24, 6)
+	amazon := w.encode(map[string]interface{}{
+		"autonomous_system_number":       uint32(16509),
+		"autonomous_system_organization": "AMAZON-02",
+	})
+	w.insert(netip.MustParsePrefix("3.5.140.0/22"), amazon)
+
+	path := filepath.Join(t.TempDir(), "GeoLite2-ASN.mmdb")
+	if err := os.WriteFile(path, w.bytes("GeoLite2-ASN"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	v, ok, err := r.Lookup(netip.MustParseAddr("3.5.140.2"))
+	if err != nil || !ok {
+		t.Fatalf("Lookup() = %v, %v, %v", v, ok, err)
+	}
+	m := v.(map[string]interface{})
+	if m["autonomous_system_number"] != uint64(16509) || m["autonomous_system_organization"] != "AMAZON-02" {
+		t.Errorf("unexpected record %v", m)
+	}
+}
+
+func TestIPv4Database(t *testing.T) {
+	w := newWriter(24, 4)
+	w.insert(netip.MustParsePrefix("192.0.2.0/24"), w.encode(map[string]interface{}{"n": int32(-5)}))
+	r, err := FromBytes(w.bytes("test"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if v, ok, err := r.Lookup(netip.MustParseAddr("192.0.2.1"), "n"); err != nil || !ok || v != int32(-5) {
+		t.Errorf("Lookup() = %v, %v, %v; expected -5", v, ok, err)
+	}
+	if _, ok, err := r.Lookup(netip.MustParseAddr("2001:db8::1"), "n"); err != nil || ok {
+		t.Errorf("expected IPv6 to be missing from an IPv4 database, got %v, %v", ok, err)
+	}
+}
+
+func TestShortInt32(t *testing.T) {
+	w := newWriter(24, 4)
+	w.insert(netip.MustParsePrefix("192.0.2.0/24"), w.encode(map[string]interface{}{
+		"one":  shortInt32{200},
+		"two":  shortInt32{0x80, 0x00},
+		"zero": shortInt32{},
+	}))
+	r, err := FromBytes(w.bytes("test"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// like the MaxMind readers, values shorter than 4 bytes aren't sign extended
+	for path, expected := range map[string]int32{"one": 200, "two": 32768, "zero": 0} {
+		if v, ok, err := r.Lookup(netip.MustParseAddr("192.0.2.1"), path); err != nil || !ok || v != expected {
+			t.Errorf("Lookup(%s) = %v, %v, %v; expected %d", path, v, ok, err, expected)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	if _, err := FromBytes([]byte("not a database")); err == nil {
+		t.Error("expected an error without metadata")
+	}
+
+	// a truncated file
+	b := countryDBBytes()
+	if _, err := FromBytes(b[len(b)/2:]); err == nil {
+		t.Error("expected an error for a truncated database")
+	}
+}
+
+func countryDBBytes() []byte {
+	w := newWriter(24, 6)
+	w.insert(netip.MustParsePrefix("8.8.8.0/24"), w.encode(map[string]interface{}{"country": "US"}))
+	return w.bytes("test")
+}
@@ -0,0 +1,100 @@
+package pow
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"math/bits"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Issuer hands out proof of work challenges and checks their solutions
+// A challenge is signed, so nothing is stored until it is solved
+type Issuer struct {
+	key        []byte
+	difficulty int
+	ttl        time.Duration
+}
+
+// New creates an issuer with a random signing key
+// difficulty is how many leading zero bits the SHA-256 of a solution needs
+func New(difficulty int, ttl time.Duration) *Issuer {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+
+	return &Issuer{
+		key:        key,
+		difficulty: difficulty,
+		ttl:        ttl,
+	}
+}
+
+// Difficulty returns the leading zero bits a solution needs
+func (p *Issuer) Difficulty() int {
+	return p.difficulty
+}
+
+// Challenge returns a new challenge for ip, which expires after the issuer's ttl
+func (p *Issuer) Challenge(ip netip.Addr) string {
+	salt := make([]byte, 12)
+	_, _ = rand.Read(salt)
+	payload := strconv.FormatInt(time.Now().Add(p.ttl).Unix(), 10) + "." + base64.RawURLEncoding.EncodeToString(salt)
+
+	return payload + "." + p.sign(payload, ip)
+}
+
+// Verify checks that challenge was issued to ip, hasn't expired and is solved by nonce
+func (p *Issuer) Verify(challenge, nonce string, ip netip.Addr) bool {
+	i := strings.LastIndexByte(challenge, '.')
+	if i < 0 || nonce == "" {
+		return false
+	}
+	payload, mac := challenge[:i], challenge[i+1:]
+	if !hmac.Equal([]byte(mac), []byte(p.sign(payload, ip))) {
+		return false
+	}
+
+	expiry, _, _ := strings.Cut(payload, ".")
+	exp, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+
+	return Solved(challenge, nonce, p.difficulty)
+}
+
+// sign binds a challenge to the client's IP and the difficulty it must be solved at
+func (p *Issuer) sign(payload string, ip netip.Addr) string {
+	h := hmac.New(sha256.New, p.key)
+	h.Write([]byte(payload + "|" + ip.Unmap().String() + "|" + strconv.Itoa(p.difficulty)))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Solved reports whether the SHA-256 of challenge:nonce starts with difficulty zero bits
+func Solved(challenge, nonce string, difficulty int) bool {
+	sum := sha256.Sum256([]byte(challenge + ":" + nonce))
+	zeros := 0
+	for _, b := range sum {
+		if b != 0 {
+			zeros += bits.LeadingZeros8(b)
+			break
+		}
+		zeros += 8
+	}
+
+	return zeros >= difficulty
+}
+
+// Solve finds a nonce for challenge, the way the challenge page does in the browser
+func Solve(challenge string, difficulty int) string {
+	for n := 0; ; n++ {
+		nonce := strconv.Itoa(n)
+		if Solved(challenge, nonce, difficulty) {
+			return nonce
+		}
+	}
+}
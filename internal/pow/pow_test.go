@@ -0,0 +1,70 @@
+package pow
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	p := New(8, time.Minute)
+	ip := netip.MustParseAddr("192.0.2.1")
+	challenge := p.Challenge(ip)
+	nonce := Solve(challenge, p.Difficulty())
+	unsolved := "x"
+	for Solved(challenge, unsolved, p.Difficulty()) {
+		unsolved += "x"
+	}
+
+	if !p.Verify(challenge, nonce, ip) {
+		t.Fatal("expected the solution to verify")
+	}
+	if !p.Verify(challenge, nonce, netip.MustParseAddr("::ffff:192.0.2.1")) {
+		t.Error("expected a mapped IP to match")
+	}
+
+	tests := []struct {
+		name      string
+		challenge string
+		nonce     string
+		ip        string
+	}{
+		{name: "Another IP", challenge: challenge, nonce: nonce, ip: "192.0.2.2"},
+		{name: "No nonce", challenge: challenge, ip: "192.0.2.1"},
+		{name: "Unsolved", challenge: challenge, nonce: unsolved, ip: "192.0.2.1"},
+		{name: "Tampered expiry", challenge: "9" + challenge, nonce: nonce, ip: "192.0.2.1"},
+		{name: "Not signed", challenge: strings.Split(challenge, ".")[0], nonce: nonce, ip: "192.0.2.1"},
+		{name: "Another issuer", challenge: New(8, time.Minute).Challenge(ip), nonce: nonce, ip: "192.0.2.1"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if p.Verify(tc.challenge, tc.nonce, netip.MustParseAddr(tc.ip)) {
+				t.Error("expected verification to fail")
+			}
+		})
+	}
+}
+
+func TestExpired(t *testing.T) {
+	p := New(4, -time.Minute)
+	ip := netip.MustParseAddr("192.0.2.1")
+	challenge := p.Challenge(ip)
+	if p.Verify(challenge, Solve(challenge, 4), ip) {
+		t.Error("expected an expired challenge to fail")
+	}
+}
+
+func TestSolved(t *testing.T) {
+	tests := []struct {
+		difficulty int
+	}{{0}, {1}, {4}, {12}}
+
+	for _, tc := range tests {
+		nonce := Solve("challenge", tc.difficulty)
+		if !Solved("challenge", nonce, tc.difficulty) {
+			t.Errorf("Solve() = %s doesn't solve difficulty %d", nonce, tc.difficulty)
+		}
+	}
+}
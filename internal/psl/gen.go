@@ -0,0 +1,77 @@
+//go:build ignore
+
+// gen.go writes list.go from a copy of https://publicsuffix.org/list/public_suffix_list.dat
+//
+//	go run gen.go public_suffix_list.dat
+//
+// Only the ICANN section is kept. The private section lists hosting platforms
+// (e.g. cloud provider subdomains) which would change the registrable domain
+// of crawler hostnames. Reverse DNS hostnames are ASCII (punycode), so rules
+// containing unicode are left out.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: go run gen.go public_suffix_list.dat")
+		os.Exit(1)
+	}
+
+	in, err := os.Open(os.Args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer in.Close()
+
+	var rules []string
+	icann := false
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.Contains(line, "===BEGIN ICANN DOMAINS==="):
+			icann = true
+		case strings.Contains(line, "===END ICANN DOMAINS==="):
+			icann = false
+		case !icann, line == "", strings.HasPrefix(line, "//"):
+		case !isASCII(line):
+		default:
+			rules = append(rules, strings.ToLower(line))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	out, err := os.Create("list.go")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer out.Close()
+
+	fmt.Fprintln(out, "// Code generated by gen.go; DO NOT EDIT.")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "package psl")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "// rules from the ICANN section of the public suffix list, one per line")
+	fmt.Fprintln(out, "// https://publicsuffix.org/list/public_suffix_list.dat")
+	fmt.Fprintln(out, "const rules = `"+strings.Join(rules, "\n")+"`")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package psl
+
+import (
+	"strings"
+	"sync"
+)
+
+// list.go is generated by gen.go from a snapshot of the public suffix list.
+// It is compiled in rather than read from disk given yaegi's constraints
+// on finding files provided by this plugin.
+
+type kind uint8
+
+const (
+	exact kind = 1 << iota
+	wildcard
+	exception
+)
+
+var (
+	parseOnce sync.Once
+	table     map[string]kind
+)
+
+func load() {
+	table = make(map[string]kind, 8192)
+	for _, rule := range strings.Split(rules, "\n") {
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			table[rule[1:]] |= exception
+		case strings.HasPrefix(rule, "*."):
+			table[rule[2:]] |= wildcard
+		default:
+			table[rule] |= exact
+		}
+	}
+}
+
+// PublicSuffix returns the public suffix of a hostname, e.g. com.tr for crawler.yandex.com.tr
+// Hostnames not covered by the list use their last label, as the list's default rule requires
+func PublicSuffix(host string) string {
+	parseOnce.Do(load)
+	host = normalize(host)
+
+	// walk from the longest candidate suffix to the shortest
+	// the first match is the longest matching rule
+	suffix := host
+	for {
+		k := table[suffix]
+		if k&exception != 0 {
+			// an exception rule's public suffix drops its leftmost label
+			_, parent, _ := strings.Cut(suffix, ".")
+			return parent
+		}
+		if k&exact != 0 {
+			return suffix
+		}
+
+		// *.ck makes any label directly under ck a public suffix
+		parent, found := parentOf(suffix)
+		if !found {
+			return suffix
+		}
+		if table[parent]&wildcard != 0 {
+			return suffix
+		}
+		suffix = parent
+	}
+}
+
+// RegistrableDomain returns the public suffix plus one label, e.g. yandex.com.tr for crawler.yandex.com.tr
+// A hostname that is itself a public suffix returns an empty string
+func RegistrableDomain(host string) string {
+	host = normalize(host)
+	suffix := PublicSuffix(host)
+	if len(suffix) >= len(host) {
+		return ""
+	}
+
+	rest := host[:len(host)-len(suffix)-1]
+	if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+		rest = rest[i+1:]
+	}
+
+	return rest + "." + suffix
+}
+
+// IsPublicSuffix reports whether a domain is a public suffix, e.g. co.uk
+func IsPublicSuffix(domain string) bool {
+	domain = normalize(domain)
+	return domain != "" && PublicSuffix(domain) == domain
+}
+
+func normalize(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func parentOf(domain string) (string, bool) {
+	_, parent, found := strings.Cut(domain, ".")
+	return parent, found
+}
@@ -0,0 +1,46 @@
+package psl
+
+import "testing"
+
+func TestRegistrableDomain(t *testing.T) {
+	tests := []struct {
+		host     string
+		suffix   string
+		expected string
+	}{
+		{"crawl-66-249-66-1.googlebot.com.", "com", "googlebot.com"},
+		{"194.114.135.34.bc.googleusercontent.com.", "com", "googleusercontent.com"},
+		{"spider-5-255-231-1.crawler.yandex.com.tr.", "com.tr", "yandex.com.tr"},
+		{"bot.example.co.uk", "co.uk", "example.co.uk"},
+		{"Crawler.Example.COM", "com", "example.com"},
+		// *.ck with the !www.ck exception
+		{"a.b.ck", "b.ck", "a.b.ck"},
+		{"foo.www.ck", "ck", "www.ck"},
+		// not in the list falls back to the last label
+		{"host.example.notatld", "notatld", "example.notatld"},
+		{"co.uk", "co.uk", ""},
+		{"localhost.", "localhost", ""},
+	}
+
+	for _, tc := range tests {
+		if got := PublicSuffix(tc.host); got != tc.suffix {
+			t.Errorf("PublicSuffix(%q) = %q; want %q", tc.host, got, tc.suffix)
+		}
+		if got := RegistrableDomain(tc.host); got != tc.expected {
+			t.Errorf("RegistrableDomain(%q) = %q; want %q", tc.host, got, tc.expected)
+		}
+	}
+}
+
+func TestIsPublicSuffix(t *testing.T) {
+	for _, d := range []string{"com", "co.uk", "com.tr", "anything.bd"} {
+		if !IsPublicSuffix(d) {
+			t.Errorf("expected %s to be a public suffix", d)
+		}
+	}
+	for _, d := range []string{"google.com", "yandex.com.tr", ""} {
+		if IsPublicSuffix(d) {
+			t.Errorf("expected %s not to be a public suffix", d)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Server is a DNS server queries are sent to
+type Server struct {
+	Network string
+	Address string
+}
+
+func (s Server) String() string {
+	return s.Network + "://" + s.Address
+}
+
+// ParseServer parses a DNS server like 1.1.1.1, tcp://1.1.1.1:5353 or udp://[2001:db8::1]
+// The network defaults to udp and the port to 53
+func ParseServer(s string) (Server, error) {
+	server := Server{Network: "udp"}
+	if network, address, found := strings.Cut(s, "://"); found {
+		server.Network = strings.ToLower(network)
+		s = address
+	}
+	if server.Network != "udp" && server.Network != "tcp" {
+		return Server{}, fmt.Errorf("invalid DNS server %s: network must be udp or tcp", s)
+	}
+
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		server.Address = addrPort.String()
+		return server, nil
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return Server{}, fmt.Errorf("invalid DNS server %s: %v", s, err)
+	}
+	server.Address = netip.AddrPortFrom(addr, 53).String()
+
+	return server, nil
+}
+
+// Resolver sends each lookup to the configured servers in turn,
+// giving each attempt its own timeout and retrying timeouts and temporary failures
+// With no servers, the system's DNS servers are used
+type Resolver struct {
+	servers  []Server
+	timeout  time.Duration
+	retries  int
+	next     atomic.Uint32
+	resolver *net.Resolver
+	dialer   net.Dialer
+}
+
+type serverKey struct{}
+
+func New(servers []Server, timeout time.Duration, retries int) *Resolver {
+	r := &Resolver{
+		servers: servers,
+		timeout: timeout,
+		retries: retries,
+	}
+	r.resolver = &net.Resolver{PreferGo: true}
+	if len(servers) > 0 {
+		r.resolver.Dial = r.dial
+	}
+
+	return r
+}
+
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	var names []string
+	err := r.retry(ctx, func(ctx context.Context) error {
+		var err error
+		names, err = r.resolver.LookupAddr(ctx, addr)
+		return err
+	})
+
+	return names, err
+}
+
+func (r *Resolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	err := r.retry(ctx, func(ctx context.Context) error {
+		var err error
+		addrs, err = r.resolver.LookupNetIP(ctx, network, host)
+		return err
+	})
+
+	return addrs, err
+}
+
+func (r *Resolver) retry(ctx context.Context, lookup func(context.Context) error) error {
+	var err error
+	for attempt := 0; attempt <= r.retries; attempt++ {
+		attemptCtx := ctx
+		if len(r.servers) > 0 {
+			// rotate servers so a retry doesn't go back to the server that just failed
+			server := r.servers[int(r.next.Add(1)-1)%len(r.servers)]
+			attemptCtx = context.WithValue(attemptCtx, serverKey{}, server)
+		}
+		var cancel context.CancelFunc
+		if r.timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(attemptCtx, r.timeout)
+		}
+
+		err = lookup(attemptCtx)
+		if cancel != nil {
+			cancel()
+		}
+		if err == nil || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+// dial ignores the system's DNS servers and connects to the server chosen for this attempt
+// UDP servers are dialed over the network the resolver asks for,
+// so a truncated UDP answer is retried over TCP
+func (r *Resolver) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	server, ok := ctx.Value(serverKey{}).(Server)
+	if !ok {
+		server = r.servers[0]
+	}
+	if server.Network == "udp" {
+		return r.dialer.DialContext(ctx, network, server.Address)
+	}
+
+	return r.dialer.DialContext(ctx, server.Network, server.Address)
+}
+
+// retryable reports whether another attempt might succeed
+// NXDOMAIN and similar answers are final
+func retryable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+
+	return false
+}
@@ -0,0 +1,350 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	typeA    = 1
+	typePTR  = 12
+	typeAAAA = 28
+)
+
+// fakeServer is an in-process DNS server answering from a map of lowercase names
+type fakeServer struct {
+	ptr      map[string]string
+	addrs    map[string][]netip.Addr
+	drop     atomic.Int32 // number of queries to ignore before answering
+	truncate bool         // answer UDP queries with the truncated flag and no records
+	queries  atomic.Int32
+}
+
+// parseQuery returns the end of the question section, its name and type
+func parseQuery(msg []byte) (int, string, uint16, bool) {
+	if len(msg) < 12 {
+		return 0, "", 0, false
+	}
+	var labels []string
+	off := 12
+	for {
+		if off >= len(msg) {
+			return 0, "", 0, false
+		}
+		l := int(msg[off])
+		off++
+		if l == 0 {
+			break
+		}
+		if off+l > len(msg) {
+			return 0, "", 0, false
+		}
+		labels = append(labels, string(msg[off:off+l]))
+		off += l
+	}
+	if off+4 > len(msg) {
+		return 0, "", 0, false
+	}
+	qtype := binary.BigEndian.Uint16(msg[off:])
+
+	return off + 4, strings.ToLower(strings.Join(labels, ".")) + ".", qtype, true
+}
+
+func encodeName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// answer builds a response echoing the question, or nil to drop the query
+func (s *fakeServer) answer(query []byte) []byte {
+	s.queries.Add(1)
+	if s.drop.Add(-1) >= 0 {
+		return nil
+	}
+
+	end, name, qtype, ok := parseQuery(query)
+	if !ok {
+		return nil
+	}
+
+	var rdata [][]byte
+	switch qtype {
+	case typePTR:
+		if host, ok := s.ptr[name]; ok {
+			rdata = append(rdata, encodeName(host))
+		}
+	case typeA, typeAAAA:
+		for _, addr := range s.addrs[name] {
+			if addr.Is4() && qtype == typeA {
+				a := addr.As4()
+				rdata = append(rdata, a[:])
+			} else if addr.Is6() && qtype == typeAAAA {
+				a := addr.As16()
+				rdata = append(rdata, a[:])
+			}
+		}
+	}
+
+	resp := make([]byte, 12, 512)
+	copy(resp, query[:2])
+	binary.BigEndian.PutUint16(resp[2:], 0x8180) // response, recursion desired and available
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(rdata)))
+	if len(rdata) == 0 && qtype == typePTR {
+		binary.BigEndian.PutUint16(resp[2:], 0x8183) // NXDOMAIN
+	}
+	resp = append(resp, query[12:end]...)
+	for _, rd := range rdata {
+		resp = append(resp, 0xc0, 12) // pointer to the question name
+		resp = binary.BigEndian.AppendUint16(resp, qtype)
+		resp = binary.BigEndian.AppendUint16(resp, 1)
+		resp = binary.BigEndian.AppendUint32(resp, 60)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(rd)))
+		resp = append(resp, rd...)
+	}
+
+	return resp
+}
+
+func (s *fakeServer) serveUDP(t *testing.T) Server {
+	return s.serveUDPOn(t, "127.0.0.1:0")
+}
+
+func (s *fakeServer) serveUDPOn(t *testing.T, address string) Server {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			resp := s.answer(buf[:n])
+			if resp != nil && s.truncate {
+				end, _, _, _ := parseQuery(resp)
+				resp = resp[:end]
+				binary.BigEndian.PutUint16(resp[2:], 0x8380) // truncated
+				binary.BigEndian.PutUint16(resp[6:], 0)
+			}
+			if resp != nil {
+				_, _ = conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+
+	return Server{Network: "udp", Address: conn.LocalAddr().String()}
+}
+
+func (s *fakeServer) serveTCP(t *testing.T) Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		ln.Close()
+		wg.Wait()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+				for {
+					var l [2]byte
+					if _, err := io.ReadFull(conn, l[:]); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(l[:]))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					resp := s.answer(query)
+					if resp == nil {
+						return
+					}
+					_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+				}
+			}()
+		}
+	}()
+
+	return Server{Network: "tcp", Address: ln.Addr().String()}
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{
+		ptr: map[string]string{
+			"4.3.2.1.in-addr.arpa.": "crawl-1-2-3-4.googlebot.com.",
+		},
+		addrs: map[string][]netip.Addr{
+			"crawl-1-2-3-4.googlebot.com.": {netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("2001:db8::4")},
+		},
+	}
+}
+
+func checkLookups(t *testing.T, r *Resolver) {
+	t.Helper()
+	ctx := context.Background()
+
+	names, err := r.LookupAddr(ctx, "1.2.3.4")
+	if err != nil {
+		t.Fatalf("LookupAddr() unexpected error %v", err)
+	}
+	if len(names) != 1 || names[0] != "crawl-1-2-3-4.googlebot.com." {
+		t.Errorf("LookupAddr() = %v; expected [crawl-1-2-3-4.googlebot.com.]", names)
+	}
+
+	addrs, err := r.LookupNetIP(ctx, "ip", "crawl-1-2-3-4.googlebot.com.")
+	if err != nil {
+		t.Fatalf("LookupNetIP() unexpected error %v", err)
+	}
+	found := map[netip.Addr]bool{}
+	for _, a := range addrs {
+		found[a.Unmap()] = true
+	}
+	if len(found) != 2 || !found[netip.MustParseAddr("1.2.3.4")] || !found[netip.MustParseAddr("2001:db8::4")] {
+		t.Errorf("LookupNetIP() = %v; expected 1.2.3.4 and 2001:db8::4", addrs)
+	}
+}
+
+func TestResolverUDP(t *testing.T) {
+	s := newFakeServer()
+	checkLookups(t, New([]Server{s.serveUDP(t)}, time.Second, 0))
+}
+
+func TestResolverTCP(t *testing.T) {
+	s := newFakeServer()
+	checkLookups(t, New([]Server{s.serveTCP(t)}, time.Second, 0))
+}
+
+func TestResolverTruncated(t *testing.T) {
+	s := newFakeServer()
+	s.truncate = true
+	// the TCP fallback goes to the same address as the UDP server
+	tcp := s.serveTCP(t)
+	udp := s.serveUDPOn(t, tcp.Address)
+	checkLookups(t, New([]Server{udp}, time.Second, 0))
+}
+
+func TestResolverNotFound(t *testing.T) {
+	s := newFakeServer()
+	r := New([]Server{s.serveUDP(t)}, time.Second, 2)
+
+	_, err := r.LookupAddr(context.Background(), "5.6.7.8")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+	// not found is final, so it isn't retried
+	if s.queries.Load() != 1 {
+		t.Errorf("expected 1 query, got %d", s.queries.Load())
+	}
+}
+
+func TestResolverRetries(t *testing.T) {
+	s := newFakeServer()
+	server := s.serveUDP(t)
+
+	s.drop.Store(1)
+	r := New([]Server{server}, 100*time.Millisecond, 0)
+	if _, err := r.LookupAddr(context.Background(), "1.2.3.4"); err == nil {
+		t.Fatal("expected a timeout without retries")
+	}
+
+	s.drop.Store(1)
+	r = New([]Server{server}, 100*time.Millisecond, 1)
+	names, err := r.LookupAddr(context.Background(), "1.2.3.4")
+	if err != nil || len(names) != 1 {
+		t.Fatalf("LookupAddr() = %v, %v; expected the retry to succeed", names, err)
+	}
+}
+
+func TestResolverRotatesServers(t *testing.T) {
+	// the first server never answers
+	dead := newFakeServer()
+	dead.drop.Store(1 << 30)
+	s := newFakeServer()
+
+	r := New([]Server{dead.serveUDP(t), s.serveUDP(t)}, 100*time.Millisecond, 1)
+	names, err := r.LookupAddr(context.Background(), "1.2.3.4")
+	if err != nil || len(names) != 1 {
+		t.Fatalf("LookupAddr() = %v, %v; expected the second server to answer", names, err)
+	}
+	if dead.queries.Load() == 0 {
+		t.Error("expected the first server to be tried")
+	}
+}
+
+func TestResolverContext(t *testing.T) {
+	s := newFakeServer()
+	s.drop.Store(1 << 30)
+	r := New([]Server{s.serveUDP(t)}, time.Second, 5)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := r.LookupAddr(ctx, "1.2.3.4"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("expected retries to stop when the context is done, took %s", time.Since(start))
+	}
+}
+
+func TestParseServer(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		wantErr  bool
+	}{
+		{input: "1.1.1.1", expected: "udp://1.1.1.1:53"},
+		{input: "1.1.1.1:5353", expected: "udp://1.1.1.1:5353"},
+		{input: "tcp://8.8.8.8", expected: "tcp://8.8.8.8:53"},
+		{input: "UDP://8.8.8.8:53", expected: "udp://8.8.8.8:53"},
+		{input: "2001:db8::1", expected: "udp://[2001:db8::1]:53"},
+		{input: "[2001:db8::1]", expected: "udp://[2001:db8::1]:53"},
+		{input: "tcp://[2001:db8::1]:5353", expected: "tcp://[2001:db8::1]:5353"},
+		{input: "https://1.1.1.1", wantErr: true},
+		{input: "dns.google", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.input, func(t *testing.T) {
+			server, err := ParseServer(tc.input)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseServer(%q) error = %v; wantErr %v", tc.input, err, tc.wantErr)
+			}
+			if !tc.wantErr && server.String() != tc.expected {
+				t.Errorf("ParseServer(%q) = %s; expected %s", tc.input, server, tc.expected)
+			}
+		})
+	}
+}
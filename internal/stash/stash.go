@@ -0,0 +1,68 @@
+package stash
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+)
+
+var errToken = errors.New("invalid token")
+
+// Box is data encrypted with AES-256-GCM under a random key
+// The key is only handed out as a token, so a box can't be opened from memory alone
+type Box struct {
+	nonce []byte
+	data  []byte
+}
+
+// Seal encrypts plaintext with a new key, returned as a URL-safe token
+func Seal(plaintext []byte) (string, *Box, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(key), &Box{
+		nonce: nonce,
+		data:  gcm.Seal(nil, nonce, plaintext, nil),
+	}, nil
+}
+
+// Open decrypts the box with the token Seal returned
+func (b *Box) Open(token string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(key) != 32 {
+		return nil, errToken
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := gcm.Open(nil, b.nonce, b.data, nil)
+	if err != nil {
+		return nil, errToken
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,53 @@
+package stash
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	plaintext := []byte("/comment?id=1\nname=a&text=hello+world")
+	token, box, err := Seal(plaintext)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if bytes.Contains(box.data, []byte("hello")) {
+		t.Error("expected the box to be encrypted")
+	}
+
+	got, err := box.Open(token)
+	if err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("Open() = %q, %v; expected %q", got, err, plaintext)
+	}
+}
+
+func TestOpenWrongToken(t *testing.T) {
+	_, box, err := Seal([]byte("secret"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	other, _, err := Seal([]byte("other"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for _, token := range []string{other, "", "not base64!", "c2hvcnQ"} {
+		if _, err := box.Open(token); err == nil {
+			t.Errorf("expected token %q not to open the box", token)
+		}
+	}
+}
+
+func TestTokensAreUnique(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		token, _, err := Seal(nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if seen[token] {
+			t.Fatal("expected a new key for every box")
+		}
+		seen[token] = true
+	}
+}
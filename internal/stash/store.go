@@ -0,0 +1,103 @@
+package stash
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store keeps boxes under random IDs until they are taken or expire
+// The token handed out carries both the ID and the key, so any number
+// of boxes can be kept for the same client without replacing each other
+type Store struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	boxes      map[string]*list.Element
+	order      *list.List
+}
+
+type entry struct {
+	id      string
+	box     *Box
+	expires time.Time
+}
+
+// NewStore creates a store whose boxes expire after ttl
+// maxEntries of 0 means the store is unbounded, otherwise the oldest box is dropped when full
+func NewStore(ttl time.Duration, maxEntries int) *Store {
+	return &Store{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		boxes:      make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// Put seals plaintext and keeps it, returning the URL-safe token that takes it back
+func (s *Store) Put(plaintext []byte) (string, error) {
+	key, box, err := Seal(plaintext)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	// every box lives for ttl, so the oldest are the first to expire
+	for el := s.order.Front(); el != nil && now.After(el.Value.(*entry).expires); el = s.order.Front() {
+		s.remove(el)
+	}
+	for s.maxEntries > 0 && s.order.Len() >= s.maxEntries {
+		s.remove(s.order.Front())
+	}
+	s.boxes[id] = s.order.PushBack(&entry{id: id, box: box, expires: now.Add(s.ttl)})
+
+	return id + "." + key, nil
+}
+
+// Take opens the box for token and removes it, so it can only be taken once
+// A token with the wrong key leaves the box in place
+func (s *Store) Take(token string) ([]byte, error) {
+	id, key, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errToken
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.boxes[id]
+	if !ok || time.Now().After(el.Value.(*entry).expires) {
+		return nil, errToken
+	}
+	plaintext, err := el.Value.(*entry).box.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	s.remove(el)
+
+	return plaintext, nil
+}
+
+// Len returns the number of boxes kept, including expired ones not yet dropped
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.order.Len()
+}
+
+func (s *Store) remove(el *list.Element) {
+	s.order.Remove(el)
+	delete(s.boxes, el.Value.(*entry).id)
+}
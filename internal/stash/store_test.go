@@ -0,0 +1,97 @@
+package stash
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	s := NewStore(time.Hour, 0)
+	first, err := s.Put([]byte("first"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	second, err := s.Put([]byte("second"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// a second box never replaces the first
+	for token, expected := range map[string]string{first: "first", second: "second"} {
+		got, err := s.Take(token)
+		if err != nil || string(got) != expected {
+			t.Errorf("Take() = %q, %v; expected %q", got, err, expected)
+		}
+	}
+
+	// a box is only taken once
+	if _, err := s.Take(first); err == nil {
+		t.Error("expected a taken box to be gone")
+	}
+	if s.Len() != 0 {
+		t.Errorf("expected an empty store, got %d", s.Len())
+	}
+}
+
+func TestStoreWrongToken(t *testing.T) {
+	s := NewStore(time.Hour, 0)
+	token, err := s.Put([]byte("secret"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	id, _, _ := strings.Cut(token, ".")
+	other, _, err := Seal(nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for _, bad := range []string{"", id, id + "." + other, "missing." + other} {
+		if _, err := s.Take(bad); err == nil {
+			t.Errorf("expected token %q not to take the box", bad)
+		}
+	}
+
+	// guessing the key doesn't drop the box
+	if got, err := s.Take(token); err != nil || string(got) != "secret" {
+		t.Errorf("Take() = %q, %v; expected secret", got, err)
+	}
+}
+
+func TestStoreLimits(t *testing.T) {
+	s := NewStore(time.Hour, 3)
+	var tokens []string
+	for i := 0; i < 5; i++ {
+		token, err := s.Put([]byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		tokens = append(tokens, token)
+	}
+	if s.Len() != 3 {
+		t.Errorf("expected 3 boxes, got %d", s.Len())
+	}
+	if _, err := s.Take(tokens[0]); err == nil {
+		t.Error("expected the oldest box to be dropped")
+	}
+	if got, err := s.Take(tokens[4]); err != nil || string(got) != "4" {
+		t.Errorf("Take() = %q, %v; expected 4", got, err)
+	}
+
+	s = NewStore(time.Millisecond, 0)
+	token, err := s.Put([]byte("old"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := s.Take(token); err == nil {
+		t.Error("expected an expired box to be gone")
+	}
+	if _, err := s.Put([]byte("new")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if s.Len() != 1 {
+		t.Errorf("expected expired boxes to be dropped, got %d", s.Len())
+	}
+}
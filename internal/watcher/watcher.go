@@ -0,0 +1,90 @@
+package watcher
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// Fingerprint identifies a version of a file on disk
+type Fingerprint struct {
+	ModTime time.Time
+	Size    int64
+}
+
+// Watcher reports changes to a single file
+type Watcher struct {
+	path     string
+	interval time.Duration
+	mu       sync.Mutex
+	seen     Fingerprint
+}
+
+// New creates a watcher for the given file path
+// interval is how often the file is polled for changes
+func New(path string, interval time.Duration) *Watcher {
+	return &Watcher{
+		path:     path,
+		interval: interval,
+	}
+}
+
+// Stat returns the current fingerprint of the file
+// A missing file returns the zero Fingerprint
+func (w *Watcher) Stat() Fingerprint {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return Fingerprint{}
+	}
+
+	return Fingerprint{
+		ModTime: info.ModTime(),
+		Size:    info.Size(),
+	}
+}
+
+// MarkSeen records the current version of the file as already seen
+// so writes made by this process don't trigger a reload
+// Calling it before the file is first read means a change made while reading isn't missed
+func (w *Watcher) MarkSeen() {
+	fp := w.Stat()
+	w.mu.Lock()
+	w.seen = fp
+	w.mu.Unlock()
+}
+
+// Changed reports whether the file differs from the last seen version
+// and records the current version as seen
+func (w *Watcher) Changed() bool {
+	fp := w.Stat()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if fp == w.seen {
+		return false
+	}
+	w.seen = fp
+
+	return true
+}
+
+// Watch calls onChange every interval until ctx is done
+// onChange uses Changed to tell whether the file was actually modified
+func (w *Watcher) Watch(ctx context.Context, onChange func()) {
+	go w.poll(ctx, onChange)
+}
+
+func (w *Watcher) poll(ctx context.Context, onChange func()) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			onChange()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
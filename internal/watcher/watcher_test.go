@@ -0,0 +1,71 @@
+package watcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	w := New(path, time.Second)
+
+	if w.Changed() {
+		t.Error("expected a missing file to be unchanged")
+	}
+
+	writeFile(t, path, "one")
+	if !w.Changed() {
+		t.Error("expected a new file to be changed")
+	}
+	if w.Changed() {
+		t.Error("expected file to be unchanged after it was seen")
+	}
+
+	writeFile(t, path, "three")
+	w.MarkSeen()
+	if w.Changed() {
+		t.Error("expected our own write to be ignored after MarkSeen")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	w := New(path, 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes := make(chan struct{}, 10)
+	w.Watch(ctx, func() {
+		if w.Changed() {
+			changes <- struct{}{}
+		}
+	})
+
+	// files other than the watched one are ignored
+	writeFile(t, filepath.Join(dir, "state.json.lock"), "123")
+	select {
+	case <-changes:
+		t.Fatal("expected other files to be ignored")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	writeFile(t, path, "{}")
+	select {
+	case <-changes:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for change")
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("unable to write %s: %v", path, err)
+	}
+}
@@ -1,12 +1,18 @@
 package captcha_protect
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"html/template"
+	"io"
 	"log/slog"
-	"net"
+	"mime"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -14,15 +20,25 @@ import (
 	"slices"
 	"strings"
 	"sync"
-	"text/template"
+	"sync/atomic"
 	"time"
 
+	"github.com/dararish/captcha-protect/internal/botranges"
+	"github.com/dararish/captcha-protect/internal/cidrset"
+	"github.com/dararish/captcha-protect/internal/counter"
+	"github.com/dararish/captcha-protect/internal/deny"
 	"github.com/dararish/captcha-protect/internal/filelock"
+	"github.com/dararish/captcha-protect/internal/geo"
 	"github.com/dararish/captcha-protect/internal/helper"
+	"github.com/dararish/captcha-protect/internal/i18n"
 	plog "github.com/dararish/captcha-protect/internal/log"
+	"github.com/dararish/captcha-protect/internal/lookup"
+	"github.com/dararish/captcha-protect/internal/lru"
+	"github.com/dararish/captcha-protect/internal/pow"
+	"github.com/dararish/captcha-protect/internal/resolver"
+	"github.com/dararish/captcha-protect/internal/stash"
 	"github.com/dararish/captcha-protect/internal/state"
-
-	lru "github.com/patrickmn/go-cache"
+	"github.com/dararish/captcha-protect/internal/watcher"
 )
 
 var (
@@ -35,54 +51,525 @@ type Config struct {
 	IPv4SubnetMask        int      `json:"ipv4subnetMask"`
 	IPv6SubnetMask        int      `json:"ipv6subnetMask"`
 	IPForwardedHeader     string   `json:"ipForwardedHeader"`
+	IPForwardedHeaders    []string `json:"ipForwardedHeaders"`
 	IPDepth               int      `json:"ipDepth"`
+	TrustedProxies        []string `json:"trustedProxies"`
 	ProtectParameters     string   `json:"protectParameters"`
 	ProtectRoutes         []string `json:"protectRoutes"`
 	ExcludeRoutes         []string `json:"excludeRoutes"`
 	ProtectFileExtensions []string `json:"protectFileExtensions"`
 	ProtectHttpMethods    []string `json:"protectHttpMethods"`
 	GoodBots              []string `json:"goodBots"`
+	GoodBotRanges         []string `json:"goodBotRanges"`
+	GoodBotRangesRefresh  int64    `json:"goodBotRangesRefresh"`
+	DnsTimeout            int64    `json:"dnsTimeout"`
+	DnsServers            []string `json:"dnsServers"`
+	DnsQueryTimeout       int64    `json:"dnsQueryTimeout"`
+	DnsRetries            int      `json:"dnsRetries"`
+	GoodBotTTL            int64    `json:"goodBotTTL"`
+	NotGoodBotTTL         int64    `json:"notGoodBotTTL"`
+	GoodBotLookupWorkers  int      `json:"goodBotLookupWorkers"`
+	GoodBotPending        string   `json:"goodBotPending"`
 	ExemptIPs             []string `json:"exemptIps"`
+	ExemptIPsFile         string   `json:"exemptIpsFile"`
 	ExemptUserAgents      []string `json:"exemptUserAgents"`
 	ChallengeURL          string   `json:"challengeURL"`
 	ChallengeTmpl         string   `json:"challengeTmpl"`
 	ChallengeStatusCode   int      `json:"challengeStatusCode"`
+	Language              string   `json:"language"`
+	DefaultLanguage       string   `json:"defaultLanguage"`
 	CaptchaProvider       string   `json:"captchaProvider"`
 	SiteKey               string   `json:"siteKey"`
 	SecretKey             string   `json:"secretKey"`
 	EnableStatsPage       string   `json:"enableStatsPage"`
+	ShowClientIp          string   `json:"showClientIp"`
 	LogLevel              string   `json:"loglevel,omitempty"`
 	PersistentStateFile   string   `json:"persistentStateFile"`
+	StateReloadInterval   int64    `json:"stateReloadInterval"`
+	MaxRateEntries        int      `json:"maxRateEntries"`
+	MaxBotEntries         int      `json:"maxBotEntries"`
+	MaxVerifiedEntries    int      `json:"maxVerifiedEntries"`
 	Mode                  string   `json:"mode"`
+
+	// user agents of well known bots, mapped to the goodBots patterns they must verify as
+	BotUserAgents      map[string]string `json:"botUserAgents"`
+	BotUserAgentAction string            `json:"botUserAgentAction"`
+
+	// requests that skip the rate limit and go straight to denyAction
+	DenyIPs            []string `json:"denyIps"`
+	DenyIPsFile        string   `json:"denyIpsFile"`
+	DenyUserAgents     []string `json:"denyUserAgents"`
+	DenyUserAgentsFile string   `json:"denyUserAgentsFile"`
+	DenyUserAgentsMode string   `json:"denyUserAgentsMode"`
+	DenyRoutes         []string `json:"denyRoutes"`
+	DenyRoutesFile     string   `json:"denyRoutesFile"`
+	DenyAction         string   `json:"denyAction"`
+
+	// MaxMind DB files for rules by ISO country and ASN
+	GeoIPDatabase      string          `json:"geoipDatabase"`
+	ASNDatabase        string          `json:"asnDatabase"`
+	ExemptCountries    []string        `json:"exemptCountries"`
+	ChallengeCountries []string        `json:"challengeCountries"`
+	ExemptASNs         []string        `json:"exemptAsns"`
+	ChallengeASNs      []string        `json:"challengeAsns"`
+	CountryRateLimits  map[string]uint `json:"countryRateLimits"`
+	ASNRateLimits      map[string]uint `json:"asnRateLimits"`
+
+	// headers added to or replacing the default challenge page headers, a blank value removes one
+	ChallengeHeaders map[string]string `json:"challengeHeaders"`
+
+	// challenge config for other hosts, keyed by host or *.example.com
+	Hosts map[string]HostConfig `json:"hosts"`
+
+	// form posts that trip the rate limit are kept encrypted and replayed once the challenge is passed
+	PreserveBody   string `json:"preserveBody"`
+	MaxBodySize    int    `json:"maxBodySize"`
+	MaxBodyEntries int    `json:"maxBodyEntries"`
+
+	// a proof of work the challenge page offers in place of the captcha
+	PowFallback   string `json:"powFallback"`
+	PowDifficulty int    `json:"powDifficulty"`
+
+	// failed challenges in a row before a client gets the failed page instead of another challenge
+	// Failures are counted for challengeAttemptsTTL seconds after the last one, for up to maxAttemptEntries IPs
+	MaxChallengeAttempts int   `json:"maxChallengeAttempts"`
+	ChallengeAttemptsTTL int64 `json:"challengeAttemptsTTL"`
+	MaxAttemptEntries    int   `json:"maxAttemptEntries"`
 }
 
 type CaptchaProtect struct {
 	next               http.Handler
 	name               string
 	config             *Config
-	rateCache          *lru.Cache
-	verifiedCache      *lru.Cache
-	botCache           *lru.Cache
-	captchaConfig      CaptchaConfig
-	exemptIps          []*net.IPNet
-	tmpl               *template.Template
-	ipv4Mask           net.IPMask
-	ipv6Mask           net.IPMask
+	caches             *cacheSet
+	exemptIps          atomic.Value
+	resolver           helper.Resolver
+	dnsTimeout         time.Duration
+	goodBotRanges      *botranges.Table
+	goodBotTTL         time.Duration
+	notGoodBotTTL      time.Duration
+	botLookups         *lookup.Group
+	botFailures        *lru.Cache
+	botClaims          []botClaim
+	claims             *lru.Cache
+	bodies             *stash.Store
+	pow                *pow.Issuer
+	attempts           *lru.Cache
+	denyList           atomic.Value
+	geo                *geo.DB
+	geoExempt          *geo.Rules
+	geoChallenge       *geo.Rules
+	geoLimits          *geo.Limits
+	trustedProxies     *cidrset.Set
+	forwardedHeaders   []string
+	site               *site
+	hosts              map[string]*site
+	wildcardHosts      []wildcardSite
+	ipv4Bits           int
+	ipv6Bits           int
 	protectRoutesRegex []*regexp.Regexp
 	excludeRoutesRegex []*regexp.Regexp
 	stateMutex         sync.RWMutex
 	stateChanged       chan struct{}
-	lastStateReload    time.Time
+	stateWatcher       *watcher.Watcher
+}
+
+// cacheSet groups the in-memory caches
+// A state reload merges into them in place, so writes from requests are never lost
+// Each cache has its own cap so a flood of new subnets in the
+// rate cache can never evict verified clients
+type cacheSet struct {
+	rate     *counter.Store
+	bots     *lru.Cache
+	verified *lru.Cache
+}
+
+// botClaim is a user agent that is only exempt once the client is verified as one of goodBots
+type botClaim struct {
+	userAgent string
+	goodBots  []string
+}
+
+// claimResult caches whether an IP passed verification for the user agent it claimed
+type claimResult struct {
+	userAgent string
+	verified  bool
+}
+
+type claimStatus int
+
+const (
+	claimPending claimStatus = iota
+	claimVerified
+	claimFailed
+)
+
+// newSite applies a hosts entry to the top level config
+// templates are shared by path, so a template used by many hosts is only parsed once
+func newSite(config *Config, host HostConfig, tmpls map[string]*templateFile) (*site, error) {
+	s := &site{
+		siteKey:       config.SiteKey,
+		secretKey:     config.SecretKey,
+		provider:      config.CaptchaProvider,
+		challengeURL:  config.ChallengeURL,
+		challengeTmpl: config.ChallengeTmpl,
+	}
+	if host.SiteKey != "" {
+		s.siteKey = host.SiteKey
+	}
+	if host.SecretKey != "" {
+		s.secretKey = host.SecretKey
+	}
+	if host.CaptchaProvider != "" {
+		s.provider = host.CaptchaProvider
+	}
+	if host.ChallengeURL != "" {
+		s.challengeURL = host.ChallengeURL
+	}
+	if host.ChallengeTmpl != "" {
+		s.challengeTmpl = host.ChallengeTmpl
+	}
+
+	if s.challengeURL == "/" {
+		return nil, fmt.Errorf("your challenge URL can not be the entire site. Default is `/challenge`. A blank value will have challenges presented on the visit that trips the rate limit")
+	}
+	if !s.challengeOnPage() && !strings.HasPrefix(s.challengeURL, "/") {
+		return nil, fmt.Errorf("invalid challengeURL: %s. Must be a path like /challenge or ?challenge=true", s.challengeURL)
+	}
+
+	// set the captcha config based on the provider
+	// thanks to https://github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/blob/4708d76854c7ae95fa7313c46fbe21959be2fff1/pkg/captcha/captcha.go#L39-L55
+	// for the struct/idea
+	switch s.provider {
+	case "hcaptcha":
+		s.captchaConfig = CaptchaConfig{
+			js:       "https://hcaptcha.com/1/api.js",
+			key:      "h-captcha",
+			validate: "https://api.hcaptcha.com/siteverify",
+			csp:      "https://hcaptcha.com https://*.hcaptcha.com",
+		}
+	case "recaptcha":
+		s.captchaConfig = CaptchaConfig{
+			js:       "https://www.google.com/recaptcha/api.js",
+			key:      "g-recaptcha",
+			validate: "https://www.google.com/recaptcha/api/siteverify",
+			csp:      "https://www.google.com/recaptcha/ https://recaptcha.google.com/recaptcha/ https://www.gstatic.com/recaptcha/",
+		}
+	case "turnstile":
+		s.captchaConfig = CaptchaConfig{
+			js:       "https://challenges.cloudflare.com/turnstile/v0/api.js",
+			key:      "cf-turnstile",
+			validate: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+			csp:      "https://challenges.cloudflare.com",
+		}
+	default:
+		return nil, fmt.Errorf("invalid captcha provider: %s", s.provider)
+	}
+	s.headers = challengeHeaders(s.captchaConfig, config.ChallengeHeaders)
+
+	// if a status code was not configured
+	// retain the default set before this config option was added
+	s.statusCode = config.ChallengeStatusCode
+	if s.statusCode == 0 {
+		s.statusCode = http.StatusOK
+		if s.challengeOnPage() {
+			s.statusCode = http.StatusTooManyRequests
+		}
+	}
+
+	if tmpl, ok := tmpls[s.challengeTmpl]; ok {
+		s.tmpl = tmpl
+		return s, nil
+	}
+	tmpl, err := loadTemplate(s.challengeTmpl, time.Duration(config.StateReloadInterval)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	tmpls[s.challengeTmpl] = tmpl
+	s.tmpl = tmpl
+
+	return s, nil
+}
+
+// newHostSites validates the hosts config
+// exact hosts are looked up in a map, wildcards are checked longest first
+func newHostSites(config *Config, tmpls map[string]*templateFile) (map[string]*site, []wildcardSite, error) {
+	hosts := map[string]*site{}
+	var wildcards []wildcardSite
+	for pattern, hc := range config.Hosts {
+		s, err := newSite(config, hc, tmpls)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid hosts entry %s: %v", pattern, err)
+		}
+
+		host := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(pattern)), ".")
+		if suffix, ok := strings.CutPrefix(host, "*."); ok {
+			if suffix == "" || strings.Contains(suffix, "*") {
+				return nil, nil, fmt.Errorf("invalid hosts entry %s. Wildcards must be like *.example.com", pattern)
+			}
+			wildcards = append(wildcards, wildcardSite{suffix: "." + suffix, site: s})
+			continue
+		}
+		if host == "" || strings.Contains(host, "*") {
+			return nil, nil, fmt.Errorf("invalid hosts entry %s. Wildcards must be like *.example.com", pattern)
+		}
+		hosts[host] = s
+	}
+	slices.SortFunc(wildcards, func(a, b wildcardSite) int {
+		if len(a.suffix) != len(b.suffix) {
+			return len(b.suffix) - len(a.suffix)
+		}
+		return strings.Compare(a.suffix, b.suffix)
+	})
+
+	return hosts, wildcards, nil
+}
+
+// siteFor returns the hosts entry matching the request's host, or the top level config
+func (bc *CaptchaProtect) siteFor(req *http.Request) *site {
+	if len(bc.hosts) == 0 && len(bc.wildcardHosts) == 0 {
+		return bc.site
+	}
+
+	host := hostname(req.Host)
+	if s, ok := bc.hosts[host]; ok {
+		return s
+	}
+	for _, w := range bc.wildcardHosts {
+		if strings.HasSuffix(host, w.suffix) {
+			return w.site
+		}
+	}
+
+	return bc.site
+}
+
+// hostname strips the port and trailing dot from a Host header and lowercases it
+func hostname(host string) string {
+	if strings.HasPrefix(host, "[") {
+		if i := strings.IndexByte(host, ']'); i > 0 {
+			host = host[1:i]
+		}
+	} else if i := strings.IndexByte(host, ':'); i >= 0 && i == strings.LastIndexByte(host, ':') {
+		host = host[:i]
+	}
+
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// templateFile is a challengeTmpl file, reparsed when it changes
+type templateFile struct {
+	path    string
+	parsed  atomic.Value
+	watcher *watcher.Watcher
+}
+
+// page names a template in challengeTmpl
+// The file itself is the challenge page, the others can be replaced with {{ define "failed" }}
+const (
+	pageChallenge   = "challenge"
+	pageFailed      = "failed"
+	pageBlocked     = "blocked"
+	pageUnavailable = "unavailable"
+	pageReplay      = "replay"
+)
+
+// loadTemplate parses a challengeTmpl file, a missing file uses the default template
+func loadTemplate(path string, interval time.Duration) (*templateFile, error) {
+	t := &templateFile{
+		path:    path,
+		watcher: watcher.New(path, interval),
+	}
+	t.watcher.MarkSeen()
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		log.Warn("Unable to find template file. Using default template.", "challengeTmpl", path)
+		t.path = ""
+	} else if err != nil {
+		return nil, fmt.Errorf("error checking for template file %s: %v", path, err)
+	}
+
+	tmpl, err := parseTemplate(t.path)
+	if err != nil {
+		return nil, err
+	}
+	t.parsed.Store(tmpl)
+
+	return t, nil
+}
+
+// parseTemplate parses the built-in pages, then the file at path over them
+func parseTemplate(path string) (*template.Template, error) {
+	tmpl, err := template.New(pageChallenge).Funcs(templateFuncs).Parse(helper.GetDefaultTmpl())
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse challenge template: %v", err)
+	}
+	if _, err := tmpl.Parse(helper.GetDefaultPages()); err != nil {
+		return nil, fmt.Errorf("unable to parse default pages: %v", err)
+	}
+	if path == "" {
+		return tmpl, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read challenge template file %s: %v", path, err)
+	}
+	file, err := tmpl.New(filepath.Base(path)).Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse challenge template file %s: %v", path, err)
+	}
+	if _, err := tmpl.AddParseTree(pageChallenge, file.Tree); err != nil {
+		return nil, fmt.Errorf("unable to parse challenge template file %s: %v", path, err)
+	}
+
+	// html/template only reports escaping errors when a page is first executed,
+	// so every page is rendered once before the template is used
+	for _, page := range []string{pageChallenge, pageFailed, pageBlocked, pageUnavailable, pageReplay} {
+		if err := tmpl.ExecuteTemplate(io.Discard, page, sampleChallengeData); err != nil {
+			return nil, fmt.Errorf("unable to render challenge template file %s: %v", path, err)
+		}
+	}
+
+	return tmpl, nil
+}
+
+// sampleChallengeData is what a template is test rendered with before it's used
+var sampleChallengeData = ChallengeData{
+	ChallengeURL: "/challenge",
+	Destination:  "%2F",
+	Provider:     "turnstile",
+	Language:     "en",
+	Method:       http.MethodGet,
+	Path:         "/",
+	Fields:       []FormField{{Name: "field", Value: "value"}},
+}
+
+func (t *templateFile) get() *template.Template {
+	return t.parsed.Load().(*template.Template)
+}
+
+// reload reparses the file when it changes
+// If it doesn't parse the last good template is kept
+func (t *templateFile) reload() {
+	if !t.watcher.Changed() {
+		return
+	}
+
+	tmpl, err := parseTemplate(t.path)
+	if err != nil {
+		log.Error("Unable to reload challenge template, keeping the previous template", "challengeTmpl", t.path, "err", err)
+		return
+	}
+	t.parsed.Store(tmpl)
+	log.Info("Reloaded challenge template", "challengeTmpl", t.path)
+}
+
+// templateFuncs are available to challengeTmpl, e.g. {{ T .Language "title" }}
+var templateFuncs = template.FuncMap{
+	"T": i18n.T,
+}
+
+// ChallengeData is the data challengeTmpl is executed with
+type ChallengeData struct {
+	// SiteKey, FrontendJS and FrontendKey configure the captcha provider's widget
+	SiteKey     string
+	FrontendJS  string
+	FrontendKey string
+	// ChallengeURL is where the form is posted
+	ChallengeURL string
+	// Destination is the escaped URL to return to once verified
+	Destination string
+	// Provider is turnstile, hcaptcha or recaptcha
+	Provider string
+	// Language is the language the page should be shown in
+	Language string
+	// Host, Method and Path are from the request that was challenged
+	Host   string
+	Method string
+	Path   string
+	// ClientIP is only set with showClientIp
+	ClientIP string
+	// RequestID is the X-Request-Id header, or a random ID when there isn't one
+	RequestID string
+	// Retry is how many times the client has failed the challenge
+	Retry int
+	// Error is why the last attempt failed: missing, failed or expired
+	Error string
+	// Nonce is random for every response, for inline scripts and styles
+	Nonce string
+	// Country, ASN and ASOrganization are set with geoipDatabase and asnDatabase
+	Country        string
+	ASN            uint
+	ASOrganization string
+	// Pow is a proof of work challenge the page can solve instead of the captcha, set with powFallback
+	// PowDifficulty is how many leading zero bits the SHA-256 of Pow:nonce needs
+	Pow           string
+	PowDifficulty int
+	// Body is the token of a form post preserved with preserveBody, posted back in the body field
+	Body string
+	// Fields are the preserved form post on the replay page, which posts them to Destination
+	Fields []FormField
+}
+
+// FormField is a field of a preserved form post
+type FormField struct {
+	Name  string
+	Value string
+}
+
+// HostConfig overrides the challenge config for requests to one host, blank values are inherited
+type HostConfig struct {
+	SiteKey         string `json:"siteKey"`
+	SecretKey       string `json:"secretKey"`
+	CaptchaProvider string `json:"captchaProvider"`
+	ChallengeTmpl   string `json:"challengeTmpl"`
+	ChallengeURL    string `json:"challengeURL"`
+}
+
+// site is how challenges are served and verified for a host
+type site struct {
+	siteKey       string
+	secretKey     string
+	provider      string
+	captchaConfig CaptchaConfig
+	challengeURL  string
+	challengeTmpl string
+	tmpl          *templateFile
+	headers       map[string]string
+	statusCode    int
+}
+
+// botFailureTTL is how long an IP whose good bot or bot user agent lookup failed is handled as unverified
+// Failures are kept out of the bot cache so they are never saved to the state file
+const botFailureTTL = 5 * time.Minute
+
+// bodyTTL is how long a preserved form post waits for the challenge to be passed
+const bodyTTL = 10 * time.Minute
+
+// powTTL is how long a proof of work challenge can be solved for
+const powTTL = 10 * time.Minute
+
+// wildcardSite is a hosts entry like *.example.com, which matches every subdomain of example.com
+type wildcardSite struct {
+	suffix string
+	site   *site
+}
+
+func (s *site) challengeOnPage() bool {
+	return s.challengeURL == "?challenge=true"
 }
 
 type CaptchaConfig struct {
 	js       string
 	key      string
 	validate string
+	// csp lists the sources the provider's widget loads scripts, frames and styles from
+	csp string
 }
 
 type captchaResponse struct {
-	Success bool `json:"success"`
+	Success    bool     `json:"success"`
+	ErrorCodes []string `json:"error-codes"`
 }
 
 func CreateConfig() *Config {
@@ -92,22 +579,64 @@ func CreateConfig() *Config {
 		IPv4SubnetMask:        16,
 		IPv6SubnetMask:        64,
 		IPForwardedHeader:     "",
+		IPForwardedHeaders:    []string{},
 		ProtectParameters:     "false",
 		ProtectRoutes:         []string{},
 		ExcludeRoutes:         []string{},
 		ProtectHttpMethods:    []string{},
 		ProtectFileExtensions: []string{},
 		GoodBots:              []string{},
+		GoodBotRanges:         []string{},
+		GoodBotRangesRefresh:  86400,
+		DnsTimeout:            2000,
+		DnsServers:            []string{},
+		DnsQueryTimeout:       1000,
+		DnsRetries:            2,
+		GoodBotTTL:            86400,
+		NotGoodBotTTL:         3600,
+		GoodBotLookupWorkers:  16,
+		GoodBotPending:        "wait",
 		ExemptIPs:             []string{},
 		ExemptUserAgents:      []string{},
+		TrustedProxies:        []string{},
 		ChallengeURL:          "/challenge",
 		ChallengeTmpl:         "challenge.tmpl.html",
 		ChallengeStatusCode:   0,
+		Language:              "",
+		DefaultLanguage:       i18n.Fallback,
 		EnableStatsPage:       "false",
+		ShowClientIp:          "false",
 		LogLevel:              "INFO",
 		IPDepth:               0,
 		CaptchaProvider:       "turnstile",
+		StateReloadInterval:   5,
+		MaxRateEntries:        100000,
+		MaxBotEntries:         100000,
+		MaxVerifiedEntries:    100000,
 		Mode:                  "prefix",
+		BotUserAgents:         map[string]string{},
+		BotUserAgentAction:    "challenge",
+		DenyIPs:               []string{},
+		DenyUserAgents:        []string{},
+		DenyUserAgentsMode:    "prefix",
+		DenyRoutes:            []string{},
+		DenyAction:            "challenge",
+		ExemptCountries:       []string{},
+		ChallengeCountries:    []string{},
+		ExemptASNs:            []string{},
+		ChallengeASNs:         []string{},
+		CountryRateLimits:     map[string]uint{},
+		ASNRateLimits:         map[string]uint{},
+		ChallengeHeaders:      map[string]string{},
+		Hosts:                 map[string]HostConfig{},
+		PreserveBody:          "false",
+		MaxBodySize:           65536,
+		MaxBodyEntries:        1000,
+		PowFallback:           "false",
+		PowDifficulty:         16,
+		MaxChallengeAttempts:  5,
+		ChallengeAttemptsTTL:  3600,
+		MaxAttemptEntries:     100000,
 	}
 }
 
@@ -125,6 +654,11 @@ func NewCaptchaProtect(ctx context.Context, next http.Handler, config *Config, n
 		return nil, fmt.Errorf("you must protect at least one route with the protectRoutes config value. / will cover your entire site")
 	}
 
+	// the state, exempt, deny and template files are all polled at this interval
+	if config.StateReloadInterval <= 0 {
+		return nil, fmt.Errorf("invalid stateReloadInterval: %d. Must be greater than 0", config.StateReloadInterval)
+	}
+
 	protectRoutesRegex := []*regexp.Regexp{}
 	excludeRoutesRegex := []*regexp.Regexp{}
 	if config.Mode == "regex" {
@@ -146,6 +680,106 @@ func NewCaptchaProtect(ctx context.Context, next http.Handler, config *Config, n
 		return nil, fmt.Errorf("unknown mode: %s. Supported values are prefix, suffix, and regex", config.Mode)
 	}
 
+	if err := helper.ValidateGoodBots(config.GoodBots); err != nil {
+		return nil, err
+	}
+	if config.DnsTimeout <= 0 {
+		return nil, fmt.Errorf("invalid dnsTimeout: %d. Must be greater than 0", config.DnsTimeout)
+	}
+	if config.GoodBotTTL <= 0 || config.NotGoodBotTTL <= 0 {
+		return nil, fmt.Errorf("invalid goodBotTTL/notGoodBotTTL: %d/%d. Must be greater than 0", config.GoodBotTTL, config.NotGoodBotTTL)
+	}
+	if config.GoodBotLookupWorkers <= 0 {
+		return nil, fmt.Errorf("invalid goodBotLookupWorkers: %d. Must be greater than 0", config.GoodBotLookupWorkers)
+	}
+	if config.DnsQueryTimeout <= 0 {
+		return nil, fmt.Errorf("invalid dnsQueryTimeout: %d. Must be greater than 0", config.DnsQueryTimeout)
+	}
+	if config.DnsRetries < 0 {
+		return nil, fmt.Errorf("invalid dnsRetries: %d. Must be 0 or greater", config.DnsRetries)
+	}
+	var dnsServers []resolver.Server
+	for _, s := range config.DnsServers {
+		server, err := resolver.ParseServer(s)
+		if err != nil {
+			return nil, err
+		}
+		dnsServers = append(dnsServers, server)
+	}
+	dnsResolver := resolver.New(dnsServers, time.Duration(config.DnsQueryTimeout)*time.Millisecond, config.DnsRetries)
+	botClaims := []botClaim{}
+	for ua, bots := range config.BotUserAgents {
+		claim := botClaim{userAgent: strings.ToLower(strings.TrimSpace(ua))}
+		for _, bot := range strings.Split(bots, ",") {
+			if bot = strings.TrimSpace(bot); bot != "" {
+				claim.goodBots = append(claim.goodBots, bot)
+			}
+		}
+		if claim.userAgent == "" || len(claim.goodBots) == 0 {
+			return nil, fmt.Errorf("invalid botUserAgents entry %s: %s. Must map a user agent to goodBots patterns", ua, bots)
+		}
+		if err := helper.ValidateGoodBots(claim.goodBots); err != nil {
+			return nil, fmt.Errorf("invalid botUserAgents entry %s: %v", ua, err)
+		}
+		botClaims = append(botClaims, claim)
+	}
+	// map order is random, keep matching deterministic
+	slices.SortFunc(botClaims, func(a, b botClaim) int {
+		return strings.Compare(a.userAgent, b.userAgent)
+	})
+	if config.BotUserAgentAction != "challenge" && config.BotUserAgentAction != "block" {
+		return nil, fmt.Errorf("unknown botUserAgentAction: %s. Supported values are challenge and block", config.BotUserAgentAction)
+	}
+
+	if config.DenyAction != "challenge" && config.DenyAction != "block" {
+		return nil, fmt.Errorf("unknown denyAction: %s. Supported values are challenge and block", config.DenyAction)
+	}
+	var denyWatchers []*watcher.Watcher
+	for _, path := range []string{config.DenyIPsFile, config.DenyUserAgentsFile, config.DenyRoutesFile} {
+		if path == "" {
+			continue
+		}
+		w := watcher.New(path, time.Duration(config.StateReloadInterval)*time.Second)
+		w.MarkSeen()
+		denyWatchers = append(denyWatchers, w)
+	}
+	denyList, err := deny.Load(denyConfig(config))
+	if err != nil {
+		return nil, err
+	}
+
+	geoExempt, err := geo.NewRules(config.ExemptCountries, config.ExemptASNs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exemptCountries/exemptAsns: %v", err)
+	}
+	geoChallenge, err := geo.NewRules(config.ChallengeCountries, config.ChallengeASNs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid challengeCountries/challengeAsns: %v", err)
+	}
+	geoLimits, err := geo.NewLimits(config.CountryRateLimits, config.ASNRateLimits)
+	if err != nil {
+		return nil, fmt.Errorf("invalid countryRateLimits/asnRateLimits: %v", err)
+	}
+	var geoDB *geo.DB
+	if config.GeoIPDatabase != "" || config.ASNDatabase != "" {
+		geoDB, err = geo.Open(config.GeoIPDatabase, config.ASNDatabase)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.GeoIPDatabase == "" && len(config.ExemptCountries)+len(config.ChallengeCountries)+len(config.CountryRateLimits) > 0 {
+		return nil, fmt.Errorf("exemptCountries, challengeCountries and countryRateLimits require geoipDatabase")
+	}
+	if config.ASNDatabase == "" && len(config.ExemptASNs)+len(config.ChallengeASNs)+len(config.ASNRateLimits) > 0 {
+		return nil, fmt.Errorf("exemptAsns, challengeAsns and asnRateLimits require asnDatabase")
+	}
+
+	switch config.GoodBotPending {
+	case "wait", "allow", "challenge":
+	default:
+		return nil, fmt.Errorf("unknown goodBotPending: %s. Supported values are wait, allow, and challenge", config.GoodBotPending)
+	}
+
 	// put exempt user agents in lowercase for quicker comparisons
 	ua := []string{}
 	for _, a := range config.ExemptUserAgents {
@@ -171,68 +805,121 @@ func NewCaptchaProtect(ctx context.Context, next http.Handler, config *Config, n
 	}
 	config.ParseHttpMethods()
 
-	var tmpl *template.Template
-	if _, err := os.Stat(config.ChallengeTmpl); os.IsNotExist(err) {
-		log.Warn("Unable to find template file. Using default template.", "challengeTmpl", config.ChallengeTmpl)
-		ts := helper.GetDefaultTmpl()
-		tmpl, err = template.New("challenge").Parse(ts)
-		if err != nil {
-			return nil, fmt.Errorf("unable to parse challenge template: %v", err)
-		}
-	} else if err != nil {
-		return nil, fmt.Errorf("error checking for template file %s: %v", config.ChallengeTmpl, err)
-	} else {
-		tmpl, err = template.ParseFiles(config.ChallengeTmpl)
-		if err != nil {
-			return nil, fmt.Errorf("unable to parse challenge template file %s: %v", config.ChallengeTmpl, err)
+	for _, lang := range []string{config.Language, config.DefaultLanguage} {
+		if lang != "" && !i18n.Supported(lang) {
+			return nil, fmt.Errorf("unsupported language: %s. Supported values are %s", lang, strings.Join(i18n.Languages(), ", "))
 		}
 	}
+	config.Language = strings.ToLower(config.Language)
+	config.DefaultLanguage = strings.ToLower(config.DefaultLanguage)
+	if config.DefaultLanguage == "" {
+		config.DefaultLanguage = i18n.Fallback
+	}
+
+	tmpls := map[string]*templateFile{}
+	defaultSite, err := newSite(config, HostConfig{}, tmpls)
+	if err != nil {
+		return nil, err
+	}
+	hosts, wildcardHosts, err := newHostSites(config, tmpls)
+	if err != nil {
+		return nil, err
+	}
 
 	if !slices.Contains(config.ProtectFileExtensions, "html") {
 		config.ProtectFileExtensions = append(config.ProtectFileExtensions, "html")
 	}
 
-	// transform exempt IP strings into what go can easily parse (net.IPNet)
-	var ips []*net.IPNet
-	exemptIps := []string{
-		"127.0.0.0/8",
-		"10.0.0.0/8",
-		"172.16.0.0/12",
-		"192.168.0.0/16",
-		"fc00::/8",
+	var exemptWatcher *watcher.Watcher
+	if config.ExemptIPsFile != "" {
+		exemptWatcher = watcher.New(config.ExemptIPsFile, time.Duration(config.StateReloadInterval)*time.Second)
+		exemptWatcher.MarkSeen()
 	}
-	exemptIps = append(exemptIps, config.ExemptIPs...)
-	for _, ip := range exemptIps {
+	ips, err := loadExemptIps(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var trustedProxies []netip.Prefix
+	for _, ip := range config.TrustedProxies {
 		parsedIp, err := helper.ParseCIDR(ip)
 		if err != nil {
-			return nil, fmt.Errorf("error parsing cidr %s: %v", ip, err)
+			return nil, fmt.Errorf("error parsing trustedProxies cidr %s: %v", ip, err)
+		}
+		trustedProxies = append(trustedProxies, parsedIp)
+	}
+
+	// ipForwardedHeader is checked before the ipForwardedHeaders candidates
+	// names are canonicalized once so looking them up on a request doesn't allocate
+	forwardedHeaders := []string{}
+	for _, h := range append([]string{config.IPForwardedHeader}, config.IPForwardedHeaders...) {
+		h = http.CanonicalHeaderKey(strings.TrimSpace(h))
+		if h != "" && !slices.Contains(forwardedHeaders, h) {
+			forwardedHeaders = append(forwardedHeaders, h)
+		}
+	}
+	if len(forwardedHeaders) > 0 && len(trustedProxies) == 0 {
+		log.Warn("Forwarded headers are trusted from any peer. Set trustedProxies to the CIDRs of your load balancers to prevent spoofing", "headers", forwardedHeaders)
+	}
+
+	for _, max := range []int{config.MaxRateEntries, config.MaxBotEntries, config.MaxVerifiedEntries, config.MaxBodyEntries, config.MaxAttemptEntries} {
+		if max < 0 {
+			return nil, fmt.Errorf("invalid max entries: %d. Must be 0 (unlimited) or greater", max)
 		}
-		ips = append(ips, parsedIp)
 	}
 
 	bc := CaptchaProtect{
-		next:               next,
-		name:               name,
-		config:             config,
-		rateCache:          lru.New(expiration, 1*time.Minute),
-		botCache:           lru.New(expiration, 1*time.Hour),
-		verifiedCache:      lru.New(expiration, 1*time.Hour),
-		exemptIps:          ips,
-		tmpl:               tmpl,
+		next:   next,
+		name:   name,
+		config: config,
+		caches: &cacheSet{
+			rate:     counter.New(expiration, 1*time.Minute, config.MaxRateEntries),
+			bots:     lru.New(expiration, 1*time.Hour, config.MaxBotEntries),
+			verified: lru.New(expiration, 1*time.Hour, config.MaxVerifiedEntries),
+		},
+		resolver:           dnsResolver,
+		dnsTimeout:         time.Duration(config.DnsTimeout) * time.Millisecond,
+		goodBotTTL:         time.Duration(config.GoodBotTTL) * time.Second,
+		notGoodBotTTL:      time.Duration(config.NotGoodBotTTL) * time.Second,
+		botLookups:         lookup.New(config.GoodBotLookupWorkers),
+		botFailures:        lru.New(botFailureTTL, time.Minute, config.MaxBotEntries),
+		botClaims:          botClaims,
+		claims:             lru.New(expiration, 1*time.Hour, config.MaxBotEntries),
+		geo:                geoDB,
+		geoExempt:          geoExempt,
+		geoChallenge:       geoChallenge,
+		geoLimits:          geoLimits,
+		trustedProxies:     cidrset.New(trustedProxies),
+		forwardedHeaders:   forwardedHeaders,
 		protectRoutesRegex: protectRoutesRegex,
 		excludeRoutesRegex: excludeRoutesRegex,
+		site:               defaultSite,
+		hosts:              hosts,
+		wildcardHosts:      wildcardHosts,
 	}
-
-	// if a status code was not configured
-	// retain the default set before this config option was added
-	if config.ChallengeStatusCode == 0 {
-		bc.config.ChallengeStatusCode = http.StatusOK
-		if bc.ChallengeOnPage() {
-			bc.config.ChallengeStatusCode = http.StatusTooManyRequests
+	if config.PreserveBody == "true" {
+		if config.MaxBodySize <= 0 {
+			return nil, fmt.Errorf("invalid maxBodySize: %d. Must be greater than 0", config.MaxBodySize)
+		}
+		bc.bodies = stash.NewStore(bodyTTL, config.MaxBodyEntries)
+	}
+	if config.MaxChallengeAttempts < 0 {
+		return nil, fmt.Errorf("invalid maxChallengeAttempts: %d. Must be 0 (unlimited) or greater", config.MaxChallengeAttempts)
+	}
+	if config.ChallengeAttemptsTTL <= 0 {
+		return nil, fmt.Errorf("invalid challengeAttemptsTTL: %d. Must be greater than 0", config.ChallengeAttemptsTTL)
+	}
+	bc.attempts = lru.New(time.Duration(config.ChallengeAttemptsTTL)*time.Second, time.Minute, config.MaxAttemptEntries)
+	if config.PowFallback == "true" {
+		if config.PowDifficulty < 1 || config.PowDifficulty > 32 {
+			return nil, fmt.Errorf("invalid powDifficulty: %d. Must be between 1 and 32", config.PowDifficulty)
 		}
+		bc.pow = pow.New(config.PowDifficulty, powTTL)
 	}
+	bc.setDenyList(denyList)
+	bc.SetExemptIps(ips)
 
-	err := bc.SetIpv4Mask(config.IPv4SubnetMask)
+	err = bc.SetIpv4Mask(config.IPv4SubnetMask)
 	if err != nil {
 		return nil, err
 	}
@@ -242,37 +929,14 @@ func NewCaptchaProtect(ctx context.Context, next http.Handler, config *Config, n
 		return nil, err
 	}
 
-	// set the captcha config based on the provider
-	// thanks to https://github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/blob/4708d76854c7ae95fa7313c46fbe21959be2fff1/pkg/captcha/captcha.go#L39-L55
-	// for the struct/idea
-	switch config.CaptchaProvider {
-	case "hcaptcha":
-		bc.captchaConfig = CaptchaConfig{
-			js:       "https://hcaptcha.com/1/api.js",
-			key:      "h-captcha",
-			validate: "https://api.hcaptcha.com/siteverify",
-		}
-	case "recaptcha":
-		bc.captchaConfig = CaptchaConfig{
-			js:       "https://www.google.com/recaptcha/api.js",
-			key:      "g-recaptcha",
-			validate: "https://www.google.com/recaptcha/api/siteverify",
-		}
-	case "turnstile":
-		bc.captchaConfig = CaptchaConfig{
-			js:       "https://challenges.cloudflare.com/turnstile/v0/api.js",
-			key:      "cf-turnstile",
-			validate: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
-		}
-	default:
-		return nil, fmt.Errorf("invalid captcha provider: %s", config.CaptchaProvider)
-	}
-
 	if config.PersistentStateFile != "" {
 		bc.stateChanged = make(chan struct{}, 1)
+		bc.stateWatcher = watcher.New(config.PersistentStateFile, time.Duration(config.StateReloadInterval)*time.Second)
 		bc.loadState()
 		childCtx, cancel := context.WithCancel(ctx)
 		go bc.saveStateOnChange(childCtx)
+		bc.stateWatcher.Watch(childCtx, bc.reloadStateFromFile)
+		log.Debug("Watching state file for changes", "stateFile", config.PersistentStateFile)
 		go func() {
 			<-ctx.Done()
 			log.Debug("Context canceled, calling child cancel...")
@@ -280,137 +944,654 @@ func NewCaptchaProtect(ctx context.Context, next http.Handler, config *Config, n
 		}()
 	}
 
-	return &bc, nil
+	if exemptWatcher != nil {
+		exemptWatcher.Watch(ctx, func() {
+			bc.reloadExemptIps(exemptWatcher)
+		})
+		log.Debug("Watching exempt IPs for changes", "exemptIpsFile", config.ExemptIPsFile)
+	}
+
+	for _, w := range denyWatchers {
+		w.Watch(ctx, func() {
+			bc.reloadDenyList(w)
+		})
+		log.Debug("Watching deny list for changes")
+	}
+
+	// the default template is built in, so only template files are watched
+	for _, t := range tmpls {
+		if t.path == "" {
+			continue
+		}
+		t.watcher.Watch(ctx, t.reload)
+		log.Debug("Watching challenge template for changes", "challengeTmpl", t.path)
+	}
+
+	if len(config.GoodBotRanges) > 0 {
+		if config.GoodBotRangesRefresh <= 0 {
+			return nil, fmt.Errorf("invalid goodBotRangesRefresh: %d. Must be greater than 0", config.GoodBotRangesRefresh)
+		}
+		bc.goodBotRanges = botranges.New(config.GoodBotRanges, &http.Client{Timeout: 30 * time.Second})
+		// files are loaded now so a bad path fails at startup, URLs are fetched in the background
+		for _, src := range config.GoodBotRanges {
+			if botranges.IsURL(src) {
+				continue
+			}
+			if err := bc.goodBotRanges.Update(ctx, src); err != nil {
+				return nil, fmt.Errorf("unable to load goodBotRanges %s: %v", src, err)
+			}
+		}
+		go bc.refreshGoodBotRanges(ctx, time.Duration(config.GoodBotRangesRefresh)*time.Second)
+	}
+
+	return &bc, nil
+}
+
+// loadExemptIps parses the private ranges that are always exempt, exemptIps and exemptIpsFile
+func loadExemptIps(config *Config) ([]netip.Prefix, error) {
+	exemptIps := []string{
+		"127.0.0.0/8",
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"fc00::/8",
+	}
+	exemptIps = append(exemptIps, config.ExemptIPs...)
+	if config.ExemptIPsFile != "" {
+		lines, err := helper.ReadLines(config.ExemptIPsFile)
+		if err != nil {
+			return nil, err
+		}
+		exemptIps = append(exemptIps, lines...)
+	}
+
+	// transform exempt IP strings into what go can easily parse (netip.Prefix)
+	var ips []netip.Prefix
+	for _, ip := range exemptIps {
+		parsedIp, err := helper.ParsePrefix(ip)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing cidr %s: %v", ip, err)
+		}
+		ips = append(ips, parsedIp)
+	}
+
+	return ips, nil
+}
+
+func (bc *CaptchaProtect) reloadExemptIps(w *watcher.Watcher) {
+	if !w.Changed() {
+		return
+	}
+
+	ips, err := loadExemptIps(bc.config)
+	if err != nil {
+		log.Error("Unable to reload exempt IPs, keeping the previous list", "err", err)
+		return
+	}
+	bc.SetExemptIps(ips)
+	log.Info("Reloaded exempt IPs", "count", len(ips))
+}
+
+func denyConfig(config *Config) deny.Config {
+	return deny.Config{
+		IPs:            config.DenyIPs,
+		IPsFile:        config.DenyIPsFile,
+		UserAgents:     config.DenyUserAgents,
+		UserAgentsFile: config.DenyUserAgentsFile,
+		UserAgentMode:  config.DenyUserAgentsMode,
+		Routes:         config.DenyRoutes,
+		RoutesFile:     config.DenyRoutesFile,
+		RouteMode:      config.Mode,
+	}
+}
+
+// setDenyList swaps in a new deny list, an empty list is stored as nil so requests skip it
+func (bc *CaptchaProtect) setDenyList(list *deny.List) {
+	if list.Empty() {
+		list = nil
+	}
+	bc.denyList.Store(list)
+}
+
+// reloadDenyList rebuilds the deny list when one of its files changes
+// If the files can't be loaded the previous list is kept
+func (bc *CaptchaProtect) reloadDenyList(w *watcher.Watcher) {
+	if !w.Changed() {
+		return
+	}
+
+	list, err := deny.Load(denyConfig(bc.config))
+	if err != nil {
+		log.Error("Unable to reload deny list, keeping the previous list", "err", err)
+		return
+	}
+	bc.setDenyList(list)
+	log.Info("Reloaded deny list")
+}
+
+// refreshGoodBotRanges fetches the goodBotRanges URLs, then reloads every source periodically
+func (bc *CaptchaProtect) refreshGoodBotRanges(ctx context.Context, interval time.Duration) {
+	update := func(urlsOnly bool) {
+		for _, src := range bc.goodBotRanges.Sources() {
+			if urlsOnly && !botranges.IsURL(src) {
+				continue
+			}
+			if err := bc.goodBotRanges.Update(ctx, src); err != nil {
+				log.Warn("Unable to update goodBotRanges", "source", src, "err", err)
+			}
+		}
+	}
+
+	update(true)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			update(false)
+		}
+	}
+}
+
+func (bc *CaptchaProtect) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	clientIP, ipRange := bc.getClientIP(req)
+	site := bc.siteFor(req)
+	if site.challengeOnPage() && req.Method == http.MethodPost {
+		if req.URL.Query().Get("challenge") != "" {
+			statusCode := bc.verifyChallengePage(rw, req, clientIP)
+			log.Info("Captcha challenge", "clientIP", clientIP, "method", req.Method, "path", req.URL.Path, "status", statusCode, "useragent", req.UserAgent())
+			return
+		}
+	} else if req.URL.Path == site.challengeURL {
+		switch req.Method {
+		case http.MethodGet:
+			destination := req.URL.Query().Get("destination")
+			info := bc.lookupGeo(clientIP)
+			log.Info("Captcha challenge", "clientIP", clientIP, "method", req.Method, "path", req.URL.Path, "destination", destination, "useragent", req.UserAgent(), bc.geoAttr(info))
+			bc.serveChallengePage(rw, req, clientIP, destination, req.URL.Query().Get("body"), info)
+		case http.MethodPost:
+			statusCode := bc.verifyChallengePage(rw, req, clientIP)
+			log.Info("Captcha challenge", "clientIP", clientIP, "method", req.Method, "path", req.URL.Path, "status", statusCode, "useragent", req.UserAgent())
+		default:
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	} else if req.URL.Path == "/captcha-protect/stats" && bc.config.EnableStatsPage == "true" {
+		log.Info("Captcha stats", "clientIP", clientIP, "method", req.Method, "path", req.URL.Path, "useragent", req.UserAgent())
+		bc.serveStatsPage(rw, clientIP)
+		return
+	}
+
+	if reason, denied := bc.isDenied(req, clientIP); denied {
+		bc.deny(rw, req, clientIP, reason)
+		return
+	}
+
+	if !bc.isProtected(req, clientIP) {
+		bc.next.ServeHTTP(rw, req)
+		return
+	}
+
+	info := bc.lookupGeo(clientIP)
+	if bc.geoExempt.Match(info) {
+		bc.next.ServeHTTP(rw, req)
+		return
+	}
+
+	if claim := bc.claimedBot(req.UserAgent()); claim != nil {
+		switch bc.verifyClaim(req, clientIP, claim) {
+		case claimFailed:
+			bc.rejectClaim(rw, req, clientIP)
+			return
+		case claimVerified:
+			if !bc.protectsParameters(req) {
+				bc.next.ServeHTTP(rw, req)
+				return
+			}
+		}
+		// a claim that isn't verified yet is never exempt as a good bot or user agent
+	} else if bc.isGoodBot(req, clientIP) || bc.isGoodUserAgent(req.UserAgent()) {
+		bc.next.ServeHTTP(rw, req)
+		return
+	}
+
+	// challenged straight away, without counting towards the rate limit
+	if bc.geoChallenge.Match(info) {
+		bc.challenge(rw, req, clientIP)
+		return
+	}
+	bc.registerRequest(ipRange)
+
+	if !bc.trippedRateLimit(ipRange, bc.rateLimit(info)) {
+		bc.next.ServeHTTP(rw, req)
+		return
+	}
+
+	bc.challenge(rw, req, clientIP)
+}
+
+// challenge serves the challenge on the requested page, or redirects to challengeURL
+func (bc *CaptchaProtect) challenge(rw http.ResponseWriter, req *http.Request, clientIP netip.Addr) {
+	encodedURI := url.QueryEscape(req.RequestURI)
+	body := bc.preserveBody(req, clientIP)
+	site := bc.siteFor(req)
+	if site.challengeOnPage() {
+		info := bc.lookupGeo(clientIP)
+		log.Info("Captcha challenge", "clientIP", clientIP, "method", req.Method, "path", req.URL.Path, "useragent", req.UserAgent(), bc.geoAttr(info))
+		bc.serveChallengePage(rw, req, clientIP, encodedURI, body, info)
+		return
+	}
+	url := fmt.Sprintf("%s?destination=%s", site.challengeURL, encodedURI)
+	// the browser follows the redirect with a GET, so the challenged method goes with it
+	if req.Method != http.MethodGet {
+		url += "&method=" + req.Method
+	}
+	if body != "" {
+		url += "&body=" + body
+	}
+	// a cached redirect would send every visitor of the page to the challenge
+	rw.Header().Set("Cache-Control", "no-store")
+	http.Redirect(rw, req, url, http.StatusFound)
+}
+
+// preserveBody keeps a form post that is being challenged, encrypted with a key only the client is given
+// Browsers can only replay url encoded forms, so other bodies and bodies over maxBodySize are dropped
+func (bc *CaptchaProtect) preserveBody(req *http.Request, clientIP netip.Addr) string {
+	if bc.bodies == nil || req.Method != http.MethodPost || req.Body == nil {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return ""
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, int64(bc.config.MaxBodySize)+1))
+	if err != nil {
+		log.Debug("Unable to read request body", "clientIP", clientIP, "err", err)
+		return ""
+	}
+	if len(body) > bc.config.MaxBodySize {
+		log.Debug("Request body is too large to preserve", "clientIP", clientIP, "maxBodySize", bc.config.MaxBodySize)
+		return ""
+	}
+
+	// the body is only ever replayed to the URL it was posted to, and only for the client that posted it
+	// It is kept under its own token, so posts from other tabs or clients behind the same IP don't replace it
+	token, err := bc.bodies.Put(append([]byte(hostPrefix(clientIP).String()+"\n"+req.URL.RequestURI()+"\n"), body...))
+	if err != nil {
+		log.Error("Unable to encrypt request body", "err", err)
+		return ""
+	}
+
+	return token
+}
+
+// replayBody serves a page that posts a preserved form again
+// It returns false when there is no body for the token, or it was posted by another client or to another path,
+// and the client is redirected as usual
+func (bc *CaptchaProtect) replayBody(rw http.ResponseWriter, req *http.Request, clientIP netip.Addr, token, destination string) bool {
+	if bc.bodies == nil || token == "" {
+		return false
+	}
+	// a body is only replayed once
+	plaintext, err := bc.bodies.Take(token)
+	if err != nil {
+		log.Debug("Unable to open preserved body", "clientIP", clientIP, "err", err)
+		return false
+	}
+
+	prefix, rest, _ := strings.Cut(string(plaintext), "\n")
+	uri, body, _ := strings.Cut(rest, "\n")
+	// a token handed to another client must not make it post the form
+	if prefix != hostPrefix(clientIP).String() || !samePath(uri, destination) {
+		log.Info("Preserved body doesn't belong to this request", "clientIP", clientIP, "destination", destination)
+		return false
+	}
+	fields, err := formFields(body)
+	if err != nil {
+		log.Debug("Unable to parse preserved body", "clientIP", clientIP, "err", err)
+		return false
+	}
+
+	d := bc.challengeData(req, clientIP, uri, bc.lookupGeo(clientIP))
+	d.Fields = fields
+	bc.servePage(rw, req, pageReplay, http.StatusOK, d)
+
+	return true
+}
+
+// samePath reports whether uri has the same path as the escaped destination
+func samePath(uri, destination string) bool {
+	d, err := url.QueryUnescape(destination)
+	if err != nil {
+		return false
+	}
+	a, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	b, err := url.Parse(d)
+	if err != nil {
+		return false
+	}
+
+	return a.Path == b.Path
 }
 
-func (bc *CaptchaProtect) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	// Reload state from file every 5 seconds if persistent state is enabled
-	if bc.config.PersistentStateFile != "" {
-		bc.reloadStateIfNeeded()
-	}
-
-	clientIP, ipRange := bc.getClientIP(req)
-	challengeOnPage := bc.ChallengeOnPage()
-	if challengeOnPage && req.Method == http.MethodPost {
-		if req.URL.Query().Get("challenge") != "" {
-			statusCode := bc.verifyChallengePage(rw, req, clientIP)
-			log.Info("Captcha challenge", "clientIP", clientIP, "method", req.Method, "path", req.URL.Path, "status", statusCode, "useragent", req.UserAgent())
-			return
+// formFields parses a url encoded body, keeping the order of its fields
+func formFields(body string) ([]FormField, error) {
+	var fields []FormField
+	for body != "" {
+		var field string
+		field, body, _ = strings.Cut(body, "&")
+		if field == "" {
+			continue
 		}
-	} else if req.URL.Path == bc.config.ChallengeURL {
-		switch req.Method {
-		case http.MethodGet:
-			destination := req.URL.Query().Get("destination")
-			log.Info("Captcha challenge", "clientIP", clientIP, "method", req.Method, "path", req.URL.Path, "destination", destination, "useragent", req.UserAgent())
-			bc.serveChallengePage(rw, destination)
-		case http.MethodPost:
-			statusCode := bc.verifyChallengePage(rw, req, clientIP)
-			log.Info("Captcha challenge", "clientIP", clientIP, "method", req.Method, "path", req.URL.Path, "status", statusCode, "useragent", req.UserAgent())
-		default:
-			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		name, value, _ := strings.Cut(field, "=")
+		name, err := url.QueryUnescape(name)
+		if err != nil {
+			return nil, err
 		}
-		return
-	} else if req.URL.Path == "/captcha-protect/stats" && bc.config.EnableStatsPage == "true" {
-		log.Info("Captcha stats", "clientIP", clientIP, "method", req.Method, "path", req.URL.Path, "useragent", req.UserAgent())
-		bc.serveStatsPage(rw, clientIP)
-		return
+		value, err = url.QueryUnescape(value)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, FormField{Name: name, Value: value})
 	}
 
-	if !bc.shouldApply(req, clientIP) {
-		bc.next.ServeHTTP(rw, req)
+	return fields, nil
+}
+
+// serveChallengePage renders the challenge, body is the token of a preserved form post
+func (bc *CaptchaProtect) serveChallengePage(rw http.ResponseWriter, req *http.Request, clientIP netip.Addr, destination, body string, info geo.Info) {
+	d := bc.challengeData(req, clientIP, destination, info)
+	if bc.tooManyAttempts(clientIP) {
+		bc.servePage(rw, req, pageFailed, http.StatusTooManyRequests, d)
 		return
 	}
-	bc.registerRequest(ipRange)
+	d.Body = body
+	bc.servePage(rw, req, pageChallenge, bc.siteFor(req).statusCode, d)
+}
 
-	if !bc.trippedRateLimit(ipRange) {
-		bc.next.ServeHTTP(rw, req)
-		return
+// challengedMethod returns the method carried in the method field, GET when there is none
+func challengedMethod(m string) string {
+	if m == "" || len(m) > 16 {
+		return http.MethodGet
+	}
+	for _, c := range m {
+		if c < 'A' || c > 'Z' {
+			return http.MethodGet
+		}
 	}
 
-	encodedURI := url.QueryEscape(req.RequestURI)
-	if bc.ChallengeOnPage() {
-		log.Info("Captcha challenge", "clientIP", clientIP, "method", req.Method, "path", req.URL.Path, "useragent", req.UserAgent())
-		bc.serveChallengePage(rw, encodedURI)
+	return m
+}
+
+// servePage renders one of the pages in challengeTmpl
+func (bc *CaptchaProtect) servePage(rw http.ResponseWriter, req *http.Request, page string, statusCode int, d ChallengeData) {
+	site := bc.siteFor(req)
+
+	// render before writing anything so a template error can still be served as a 500
+	var buf bytes.Buffer
+	if err := site.tmpl.get().ExecuteTemplate(&buf, page, d); err != nil {
+		log.Error("Unable to execute go template", "tmpl", site.challengeTmpl, "page", page, "err", err)
+		http.Error(rw, "Internal error", http.StatusInternalServerError)
 		return
 	}
-	url := fmt.Sprintf("%s?destination=%s", bc.config.ChallengeURL, encodedURI)
-	http.Redirect(rw, req, url, http.StatusFound)
+
+	h := rw.Header()
+	for k, v := range site.headers {
+		h.Set(k, strings.ReplaceAll(v, "{nonce}", d.Nonce))
+	}
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(statusCode)
+	_, _ = buf.WriteTo(rw)
 }
 
-func (bc *CaptchaProtect) serveChallengePage(rw http.ResponseWriter, destination string) {
-	d := map[string]string{
-		"SiteKey":      bc.config.SiteKey,
-		"FrontendJS":   bc.captchaConfig.js,
-		"FrontendKey":  bc.captchaConfig.key,
-		"ChallengeURL": bc.config.ChallengeURL,
-		"Destination":  destination,
+// challengeHeaders are the headers of every challenge page, {nonce} is replaced with the page's nonce
+// The content security policy only allows inline scripts with the nonce and the provider's widget
+func challengeHeaders(captcha CaptchaConfig, custom map[string]string) map[string]string {
+	csp := strings.Join([]string{
+		"default-src 'none'",
+		"script-src 'nonce-{nonce}' " + captcha.csp,
+		"style-src 'self' 'nonce-{nonce}' " + captcha.csp,
+		"frame-src " + captcha.csp,
+		"connect-src 'self' " + captcha.csp,
+		"img-src 'self' data: " + captcha.csp,
+		"form-action 'self'",
+		"base-uri 'none'",
+		"frame-ancestors 'none'",
+	}, "; ")
+
+	headers := map[string]string{
+		"Content-Security-Policy": csp,
+		"Cache-Control":           "no-store",
+		"X-Frame-Options":         "DENY",
+		"X-Content-Type-Options":  "nosniff",
+		"Referrer-Policy":         "same-origin",
+	}
+	for k, v := range custom {
+		k = http.CanonicalHeaderKey(k)
+		if v == "" {
+			delete(headers, k)
+			continue
+		}
+		headers[k] = v
 	}
 
-	// have to write http status before executing the template
-	// otherwise a 200 will get served by the template execution
-	rw.WriteHeader(bc.config.ChallengeStatusCode)
+	return headers
+}
 
-	err := bc.tmpl.Execute(rw, d)
-	if err != nil {
-		log.Error("Unable to execute go template", "tmpl", bc.config.ChallengeTmpl, "err", err)
-		http.Error(rw, "Internal error", http.StatusInternalServerError)
+// challengeData builds the data passed to challengeTmpl
+func (bc *CaptchaProtect) challengeData(req *http.Request, clientIP netip.Addr, destination string, info geo.Info) ChallengeData {
+	site := bc.siteFor(req)
+	lang := bc.language(req)
+	js := site.captchaConfig.js
+	// hcaptcha and recaptcha take the widget language from the script URL, turnstile from data-language
+	if site.provider != "turnstile" {
+		js += "?hl=" + lang
+	}
+
+	// on the challenge URL the original path is in the destination
+	path := req.URL.Path
+	if req.URL.Path == site.challengeURL {
+		path = "/"
+		if u, err := url.QueryUnescape(destination); err == nil {
+			if u, err := url.Parse(u); err == nil && u.Path != "" {
+				path = u.Path
+			}
+		}
+	}
+
+	// the original method is in the method field once the challenge was redirected or posted
+	method := req.Method
+	if req.URL.Path == site.challengeURL || (site.challengeOnPage() && req.Method == http.MethodPost && req.URL.Query().Get("challenge") != "") {
+		method = challengedMethod(req.FormValue("method"))
+	}
+
+	requestID := req.Header.Get("X-Request-Id")
+	if requestID == "" {
+		requestID = randomToken(8)
+	}
+
+	d := ChallengeData{
+		SiteKey:        site.siteKey,
+		FrontendJS:     js,
+		FrontendKey:    site.captchaConfig.key,
+		ChallengeURL:   site.challengeURL,
+		Destination:    destination,
+		Provider:       site.provider,
+		Language:       lang,
+		Host:           req.Host,
+		Method:         method,
+		Path:           path,
+		RequestID:      requestID,
+		Nonce:          randomToken(16),
+		Country:        info.Country,
+		ASN:            info.ASN,
+		ASOrganization: info.ASOrganization,
+	}
+	d.Retry = bc.failedAttempts(clientIP)
+	if bc.config.ShowClientIp == "true" {
+		d.ClientIP = clientIP.String()
+	}
+	if bc.pow != nil {
+		d.Pow = bc.pow.Challenge(clientIP)
+		d.PowDifficulty = bc.pow.Difficulty()
+	}
+
+	return d
+}
+
+// randomToken returns n random bytes as URL-safe base64
+func randomToken(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// language is the language config value, or the client's preferred language with a catalog
+func (bc *CaptchaProtect) language(req *http.Request) string {
+	if bc.config.Language != "" {
+		return bc.config.Language
 	}
+	return i18n.Negotiate(req.Header.Get("Accept-Language"), bc.config.DefaultLanguage)
 }
 
-func (bc *CaptchaProtect) verifyChallengePage(rw http.ResponseWriter, req *http.Request, ip string) int {
-	response := req.FormValue(bc.captchaConfig.key + "-response")
+func (bc *CaptchaProtect) verifyChallengePage(rw http.ResponseWriter, req *http.Request, ip netip.Addr) int {
+	site := bc.siteFor(req)
+	response := req.FormValue(site.captchaConfig.key + "-response")
+	destination := req.FormValue("destination")
+	// don't ask the provider about clients that already failed too often
+	if bc.tooManyAttempts(ip) {
+		bc.servePage(rw, req, pageFailed, http.StatusTooManyRequests, bc.challengeData(req, ip, destination, bc.lookupGeo(ip)))
+		return http.StatusTooManyRequests
+	}
+	if response == "" && bc.pow != nil && req.FormValue("pow") != "" {
+		return bc.verifyPow(rw, req, ip, destination)
+	}
 	if response == "" {
-		http.Error(rw, "Bad request", http.StatusBadRequest)
-		return http.StatusBadRequest
+		return bc.failChallenge(rw, req, ip, destination, "missing", http.StatusBadRequest)
 	}
 
 	var body = url.Values{}
-	body.Add("secret", bc.config.SecretKey)
+	body.Add("secret", site.secretKey)
 	body.Add("response", response)
-	resp, err := http.PostForm(bc.captchaConfig.validate, body)
+	resp, err := http.PostForm(site.captchaConfig.validate, body)
 	if err != nil {
-		log.Error("Unable to validate captcha", "url", bc.captchaConfig.validate, "body", body, "err", err)
-		http.Error(rw, "Internal error", http.StatusInternalServerError)
-		return http.StatusInternalServerError
+		log.Error("Unable to validate captcha", "url", site.captchaConfig.validate, "body", body, "err", err)
+		bc.servePage(rw, req, pageUnavailable, http.StatusServiceUnavailable, bc.challengeData(req, ip, destination, bc.lookupGeo(ip)))
+		return http.StatusServiceUnavailable
 	}
 	defer resp.Body.Close()
 
 	var captchaResponse captchaResponse
 	err = json.NewDecoder(resp.Body).Decode(&captchaResponse)
 	if err != nil {
-		log.Error("Unable to unmarshal captcha response", "url", bc.captchaConfig.validate, "err", err)
-		http.Error(rw, "Internal error", http.StatusInternalServerError)
-		return http.StatusInternalServerError
+		log.Error("Unable to unmarshal captcha response", "url", site.captchaConfig.validate, "err", err)
+		bc.servePage(rw, req, pageUnavailable, http.StatusServiceUnavailable, bc.challengeData(req, ip, destination, bc.lookupGeo(ip)))
+		return http.StatusServiceUnavailable
 	}
 	if captchaResponse.Success {
-		bc.verifiedCache.Set(ip, true, lru.DefaultExpiration)
-		bc.notifyStateChange()
-		destination := req.FormValue("destination")
-		if destination == "" {
-			destination = "%2F"
-		}
-		u, err := url.QueryUnescape(destination)
-		if err != nil {
-			log.Error("Unable to unescape destination", "destination", destination, "err", err)
-			u = "/"
-		}
-		http.Redirect(rw, req, u, http.StatusFound)
-		return http.StatusFound
+		return bc.passChallenge(rw, req, ip, destination)
+	}
+
+	reason := "failed"
+	// every provider reports a token that was used or timed out the same way
+	if slices.Contains(captchaResponse.ErrorCodes, "timeout-or-duplicate") {
+		reason = "expired"
+	}
+	log.Debug("Captcha verification failed", "clientIP", ip, "errorCodes", captchaResponse.ErrorCodes)
+
+	return bc.failChallenge(rw, req, ip, destination, reason, http.StatusForbidden)
+}
+
+// verifyPow checks a proof of work solved in place of the captcha
+func (bc *CaptchaProtect) verifyPow(rw http.ResponseWriter, req *http.Request, ip netip.Addr, destination string) int {
+	if !bc.pow.Verify(req.FormValue("pow"), req.FormValue("pow-nonce"), ip) {
+		return bc.failChallenge(rw, req, ip, destination, "failed", http.StatusForbidden)
+	}
+
+	return bc.passChallenge(rw, req, ip, destination)
+}
+
+// failChallenge counts a failed attempt and serves the challenge again with the reason
+// The destination and any preserved form post are kept for the next attempt
+func (bc *CaptchaProtect) failChallenge(rw http.ResponseWriter, req *http.Request, ip netip.Addr, destination, reason string, statusCode int) int {
+	// submitting before the widget finished isn't an attempt
+	attempts := bc.failedAttempts(ip)
+	if reason != "missing" {
+		attempts = bc.attempts.Increment(hostPrefix(ip), 1, lru.DefaultExpiration)
+	}
+	if bc.config.MaxChallengeAttempts > 0 && attempts >= bc.config.MaxChallengeAttempts {
+		log.Info("Too many failed challenges", "clientIP", ip, "maxChallengeAttempts", bc.config.MaxChallengeAttempts)
+		bc.servePage(rw, req, pageFailed, http.StatusTooManyRequests, bc.challengeData(req, ip, destination, bc.lookupGeo(ip)))
+		return http.StatusTooManyRequests
+	}
+
+	d := bc.challengeData(req, ip, destination, bc.lookupGeo(ip))
+	d.Error = reason
+	d.Body = req.FormValue("body")
+	bc.servePage(rw, req, pageChallenge, statusCode, d)
+
+	return statusCode
+}
+
+// failedAttempts is how many challenges the client failed in a row
+func (bc *CaptchaProtect) failedAttempts(ip netip.Addr) int {
+	v, ok := bc.attempts.Get(hostPrefix(ip))
+	if !ok {
+		return 0
 	}
 
-	http.Error(rw, "Validation failed", http.StatusForbidden)
+	return v.(int)
+}
+
+// tooManyAttempts reports whether the client used up maxChallengeAttempts
+func (bc *CaptchaProtect) tooManyAttempts(ip netip.Addr) bool {
+	return bc.config.MaxChallengeAttempts > 0 && bc.failedAttempts(ip) >= bc.config.MaxChallengeAttempts
+}
+
+// passChallenge marks the client as verified and sends it on to its destination
+func (bc *CaptchaProtect) passChallenge(rw http.ResponseWriter, req *http.Request, ip netip.Addr, destination string) int {
+	bc.caches.verified.Set(hostPrefix(ip), true, lru.DefaultExpiration)
+	bc.notifyStateChange()
+	bc.attempts.Take(hostPrefix(ip))
+	if bc.replayBody(rw, req, ip, req.FormValue("body"), destination) {
+		return http.StatusOK
+	}
+	if destination == "" {
+		destination = "%2F"
+	}
+	u, err := url.QueryUnescape(destination)
+	if err != nil {
+		log.Error("Unable to unescape destination", "destination", destination, "err", err)
+		u = "/"
+	}
+	http.Redirect(rw, req, u, http.StatusFound)
 
-	return http.StatusForbidden
+	return http.StatusFound
 }
 
-func (bc *CaptchaProtect) serveStatsPage(rw http.ResponseWriter, ip string) {
+func (bc *CaptchaProtect) serveStatsPage(rw http.ResponseWriter, ip netip.Addr) {
 	// only allow excluded IPs from viewing
-	if !helper.IsIpExcluded(ip, bc.exemptIps) {
+	if !bc.isExemptIp(ip) {
 		http.Error(rw, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	state := state.GetState(bc.rateCache.Items(), bc.botCache.Items(), bc.verifiedCache.Items())
+	c := bc.caches
+	state := state.GetState(c.rate.Items(), c.bots.Items(), c.verified.Items())
+	state.Evictions = map[string]uint64{
+		"rate":     c.rate.Evictions(),
+		"bot":      c.bots.Evictions(),
+		"verified": c.verified.Evictions(),
+	}
+	if bc.goodBotRanges != nil {
+		state.GoodBotRanges = bc.goodBotRanges.Status()
+	}
 	jsonData, err := json.Marshal(state)
 	if err != nil {
 		log.Error("failed to marshal JSON", "err", err)
@@ -429,25 +1610,19 @@ func (bc *CaptchaProtect) serveStatsPage(rw http.ResponseWriter, ip string) {
 
 }
 
-func (bc *CaptchaProtect) shouldApply(req *http.Request, clientIP string) bool {
+// isProtected checks the method, route and IP of a request
+// Good bots and exempt user agents are checked separately by ServeHTTP
+func (bc *CaptchaProtect) isProtected(req *http.Request, clientIP netip.Addr) bool {
 	if !slices.Contains(bc.config.ProtectHttpMethods, req.Method) {
 		return false
 	}
 
-	_, verified := bc.verifiedCache.Get(clientIP)
+	_, verified := bc.caches.verified.Get(hostPrefix(clientIP))
 	if verified {
 		return false
 	}
 
-	if helper.IsIpExcluded(clientIP, bc.exemptIps) {
-		return false
-	}
-
-	if bc.isGoodBot(req, clientIP) {
-		return false
-	}
-
-	if bc.isGoodUserAgent(req.UserAgent()) {
+	if bc.isExemptIp(clientIP) {
 		return false
 	}
 
@@ -572,93 +1747,158 @@ protected:
 	return false
 }
 
-func (bc *CaptchaProtect) trippedRateLimit(ip string) bool {
-	v, ok := bc.rateCache.Get(ip)
+func (bc *CaptchaProtect) trippedRateLimit(ip netip.Prefix, limit uint) bool {
+	v, ok := bc.caches.rate.Get(ip)
 	if !ok {
 		log.Error("IP not found, but should already be set", "ip", ip)
 		return false
 	}
-	return v.(uint) > bc.config.RateLimit
+	return v > limit
 }
 
-func (bc *CaptchaProtect) registerRequest(ip string) {
-	err := bc.rateCache.Add(ip, uint(1), lru.DefaultExpiration)
-	if err == nil {
-		bc.notifyStateChange()
-		return
+// rateLimit returns the countryRateLimits or asnRateLimits entry for a client, or rateLimit
+func (bc *CaptchaProtect) rateLimit(info geo.Info) uint {
+	if limit, ok := bc.geoLimits.Limit(info); ok {
+		return limit
+	}
+	return bc.config.RateLimit
+}
+
+// lookupGeo returns the country and ASN of a client, blank when no database is configured
+func (bc *CaptchaProtect) lookupGeo(clientIP netip.Addr) geo.Info {
+	if bc.geo == nil {
+		return geo.Info{}
 	}
 
-	_, err = bc.rateCache.IncrementUint(ip, uint(1))
+	info, err := bc.geo.Lookup(clientIP)
 	if err != nil {
-		log.Error("Unable to set rate cache", "ip", ip)
-	} else {
-		bc.notifyStateChange()
+		log.Debug("Unable to look up country and ASN", "clientIP", clientIP, "err", err)
 	}
+	return info
 }
 
-func (bc *CaptchaProtect) getClientIP(req *http.Request) (string, string) {
-	ip := req.Header.Get(bc.config.IPForwardedHeader)
-	if bc.config.IPForwardedHeader != "" && ip != "" {
-		components := strings.Split(ip, ",")
-		depth := bc.config.IPDepth
-		ip = ""
-		for i := len(components) - 1; i >= 0; i-- {
-			_ip := strings.TrimSpace(components[i])
-			if helper.IsIpExcluded(_ip, bc.exemptIps) {
-				continue
-			}
-			if depth == 0 {
-				ip = _ip
-				break
-			}
-			depth--
-		}
-		if ip == "" {
-			log.Debug("No non-exempt IPs in header. req.RemoteAddr", "ipDepth", bc.config.IPDepth, bc.config.IPForwardedHeader, req.Header.Get(bc.config.IPForwardedHeader))
-			ip = req.RemoteAddr
+// geoAttr groups the country and ASN for logs, it's dropped from the log when no database is configured
+func (bc *CaptchaProtect) geoAttr(info geo.Info) slog.Attr {
+	if bc.geo == nil {
+		return slog.Attr{}
+	}
+	return slog.Group("geo", "country", info.Country, "asn", info.ASN, "org", info.ASOrganization)
+}
+
+func (bc *CaptchaProtect) registerRequest(ip netip.Prefix) {
+	bc.caches.rate.Increment(ip, 1)
+	bc.notifyStateChange()
+}
+
+func (bc *CaptchaProtect) getClientIP(req *http.Request) (netip.Addr, netip.Prefix) {
+	remoteIP, ok := helper.ParseAddr(req.RemoteAddr)
+	if !ok {
+		log.Warn("Unable to parse remote address", "remoteAddr", req.RemoteAddr)
+	}
+
+	if len(bc.forwardedHeaders) == 0 {
+		return bc.ParseIp(remoteIP)
+	}
+
+	// use the first configured header present on the request
+	var header string
+	var values []string
+	for _, h := range bc.forwardedHeaders {
+		values = req.Header[h]
+		if len(values) > 0 {
+			header = h
+			break
 		}
-	} else {
-		if bc.config.IPForwardedHeader != "" {
-			log.Debug("Received a blank header value. Defaulting to real IP")
+	}
+	if header == "" {
+		log.Debug("Received a blank header value. Defaulting to real IP")
+		return bc.ParseIp(remoteIP)
+	}
+	hops := helper.NewHops(values, helper.IsRFC7239(header))
+
+	if bc.trustedProxies.Len() > 0 {
+		if ip, ok := bc.trustedForwardedIP(remoteIP, header, hops); ok {
+			return bc.ParseIp(ip)
 		}
-		ip = req.RemoteAddr
+		return bc.ParseIp(remoteIP)
 	}
-	if strings.Contains(ip, ":") {
-		host, _, _ := net.SplitHostPort(ip)
-		ip = host
+
+	depth := bc.config.IPDepth
+	for {
+		hop, ok := hops.Next()
+		if !ok {
+			break
+		}
+
+		ip, ok := helper.ParseAddr(hop)
+		if !ok || bc.isExemptIp(ip) {
+			continue
+		}
+		if depth == 0 {
+			return bc.ParseIp(ip)
+		}
+		depth--
 	}
+	log.Debug("No non-exempt IPs in header. req.RemoteAddr", "ipDepth", bc.config.IPDepth, "header", header, "values", values)
 
-	return bc.ParseIp(ip)
+	return bc.ParseIp(remoteIP)
 }
 
-func (bc *CaptchaProtect) ParseIp(ip string) (string, string) {
-	parsedIP := net.ParseIP(ip)
-	if parsedIP == nil {
-		return ip, ip
+// trustedForwardedIP only honours the forwarded header when the request came from a trusted proxy
+// The header is walked from the right, and the first hop that isn't a trusted proxy is the client
+func (bc *CaptchaProtect) trustedForwardedIP(remoteIP netip.Addr, header string, hops helper.Hops) (netip.Addr, bool) {
+	if !bc.trustedProxies.Contains(remoteIP) {
+		log.Debug("Ignoring forwarded header from untrusted peer", "remoteIP", remoteIP, "header", header)
+		return netip.Addr{}, false
 	}
 
-	// For IPv4 addresses
-	if parsedIP.To4() != nil {
-		subnet := parsedIP.Mask(bc.ipv4Mask)
-		return ip, subnet.String()
+	var client netip.Addr
+	for {
+		hop, ok := hops.Next()
+		if !ok {
+			break
+		}
+
+		ip, ok := helper.ParseAddr(hop)
+		if !ok {
+			// a trusted proxy passed along something we can't parse (or an obfuscated identifier)
+			// so nothing further left can be trusted
+			log.Debug("Invalid IP in forwarded header", "hop", hop, "header", header)
+			break
+		}
+		client = ip
+		if !bc.trustedProxies.Contains(ip) {
+			return ip, true
+		}
 	}
 
-	// For IPv6 addresses
-	if parsedIP.To16() != nil {
-		subnet := parsedIP.Mask(bc.ipv6Mask)
-		return ip, subnet.String()
+	// every hop was a trusted proxy, so the leftmost one is the client
+	return client, client.IsValid()
+}
+
+// ParseIp returns the IP along with the subnet it is rate limited in
+func (bc *CaptchaProtect) ParseIp(ip netip.Addr) (netip.Addr, netip.Prefix) {
+	bits := bc.ipv6Bits
+	if ip.Is4() {
+		bits = bc.ipv4Bits
 	}
 
-	log.Warn("Unknown ip version", "ip", ip)
+	// an invalid address returns the zero prefix
+	subnet, _ := ip.Prefix(bits)
+
+	return ip, subnet
+}
 
-	return ip, ip
+// hostPrefix is the cache key for a single IP
+func hostPrefix(ip netip.Addr) netip.Prefix {
+	return netip.PrefixFrom(ip, ip.BitLen())
 }
 
 func (bc *CaptchaProtect) SetIpv4Mask(m int) error {
 	if m < 8 || m > 32 {
 		return fmt.Errorf("invalid ipv4 mask: %d. Must be between 8 and 32", m)
 	}
-	bc.ipv4Mask = net.CIDRMask(m, 32)
+	bc.ipv4Bits = m
 
 	return nil
 }
@@ -667,31 +1907,216 @@ func (bc *CaptchaProtect) SetIpv6Mask(m int) error {
 	if m < 8 || m > 128 {
 		return fmt.Errorf("invalid ipv6 mask: %d. Must be between 8 and 128", m)
 	}
-	bc.ipv6Mask = net.CIDRMask(m, 128)
+	bc.ipv6Bits = m
 
 	return nil
 }
 
-func (bc *CaptchaProtect) isGoodBot(req *http.Request, clientIP string) bool {
-	if bc.config.ProtectParameters == "true" {
-		if len(req.URL.Query()) > 0 {
-			return false
+// protectsParameters reports whether even good bots are rate limited on this request
+func (bc *CaptchaProtect) protectsParameters(req *http.Request) bool {
+	return bc.config.ProtectParameters == "true" && len(req.URL.Query()) > 0
+}
+
+func (bc *CaptchaProtect) isGoodBot(req *http.Request, clientIP netip.Addr) bool {
+	if bc.protectsParameters(req) {
+		return false
+	}
+
+	// published ranges are a binary search, so they are checked before the cache and
+	// never cached, and ranges added by a refresh apply to IPs that were already seen
+	if bc.goodBotRanges != nil {
+		if src, ok := bc.goodBotRanges.Lookup(clientIP); ok {
+			log.Debug("Good bot found in published IP ranges", "clientIP", clientIP, "source", src)
+			return true
 		}
 	}
 
-	bot, ok := bc.botCache.Get(clientIP)
+	if len(bc.config.GoodBots) == 0 {
+		return false
+	}
+
+	bot, ok := bc.caches.bots.Get(hostPrefix(clientIP))
 	if ok {
 		return bot.(bool)
 	}
 
-	v := helper.IsIpGoodBot(clientIP, bc.config.GoodBots)
-	bc.botCache.Set(clientIP, v, lru.DefaultExpiration)
-	bc.notifyStateChange()
+	// a client that can make its own lookup time out must not skip the rate limit,
+	// so after a failure it isn't a good bot, even with goodBotPending: allow
+	if _, failed := bc.botFailures.Get(hostPrefix(clientIP)); failed {
+		return false
+	}
+
+	// concurrent requests from the same IP share one lookup
+	call, err := bc.botLookups.Do(lookup.Key{IP: clientIP}, func() (bool, error) {
+		return bc.verifyGoodBot(clientIP)
+	})
+	if err != nil {
+		// never allow when busy, or a flood of new IPs would all be let through
+		log.Debug("Unable to verify good bot", "clientIP", clientIP, "err", err)
+		return false
+	}
+
+	switch bc.config.GoodBotPending {
+	case "allow":
+		return true
+	case "challenge":
+		return false
+	}
+
+	v, err := call.Wait(req.Context())
+	if err != nil {
+		return false
+	}
 	return v
 }
 
-func (bc *CaptchaProtect) SetExemptIps(exemptIps []*net.IPNet) {
-	bc.exemptIps = exemptIps
+// verifyGoodBot runs the reverse DNS lookup for clientIP and caches the result
+func (bc *CaptchaProtect) verifyGoodBot(clientIP netip.Addr) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bc.dnsTimeout)
+	defer cancel()
+
+	v, err := helper.IsIpGoodBot(ctx, bc.resolver, clientIP, bc.config.GoodBots)
+	if err != nil {
+		// don't remember a bot as bad for long because DNS was slow
+		log.Debug("Unable to verify good bot", "clientIP", clientIP, "err", err)
+		bc.botFailures.Set(hostPrefix(clientIP), true, lru.DefaultExpiration)
+		return false, err
+	}
+
+	ttl := bc.notGoodBotTTL
+	if v {
+		ttl = bc.goodBotTTL
+	}
+	bc.caches.bots.Set(hostPrefix(clientIP), v, ttl)
+	bc.notifyStateChange()
+
+	return v, nil
+}
+
+// isDenied checks the request against denyIps, denyUserAgents and denyRoutes
+func (bc *CaptchaProtect) isDenied(req *http.Request, clientIP netip.Addr) (string, bool) {
+	list, _ := bc.denyList.Load().(*deny.List)
+	if list == nil {
+		return "", false
+	}
+
+	reason, denied := list.Match(clientIP, req.UserAgent(), req.URL.Path)
+	if !denied {
+		return "", false
+	}
+
+	// a denied client that passed the challenge isn't challenged again
+	if bc.config.DenyAction == "challenge" {
+		if _, verified := bc.caches.verified.Get(hostPrefix(clientIP)); verified {
+			return "", false
+		}
+	}
+
+	return reason, true
+}
+
+func (bc *CaptchaProtect) deny(rw http.ResponseWriter, req *http.Request, clientIP netip.Addr, reason string) {
+	info := bc.lookupGeo(clientIP)
+	log.Info("Denied", "clientIP", clientIP, "method", req.Method, "path", req.URL.Path, "useragent", req.UserAgent(), "reason", reason, "action", bc.config.DenyAction, bc.geoAttr(info))
+	if bc.config.DenyAction == "block" {
+		bc.servePage(rw, req, pageBlocked, http.StatusForbidden, bc.challengeData(req, clientIP, "", info))
+		return
+	}
+
+	bc.challenge(rw, req, clientIP)
+}
+
+// claimedBot returns the bot a user agent claims to be
+func (bc *CaptchaProtect) claimedBot(ua string) *botClaim {
+	if len(bc.botClaims) == 0 {
+		return nil
+	}
+
+	ua = strings.ToLower(ua)
+	for i := range bc.botClaims {
+		if strings.Contains(ua, bc.botClaims[i].userAgent) {
+			return &bc.botClaims[i]
+		}
+	}
+
+	return nil
+}
+
+// verifyClaim checks a client is the bot its user agent claims to be
+// Lookups are shared with good bot verification and follow goodBotPending
+func (bc *CaptchaProtect) verifyClaim(req *http.Request, clientIP netip.Addr, claim *botClaim) claimStatus {
+	if v, ok := bc.claims.Get(hostPrefix(clientIP)); ok {
+		result := v.(claimResult)
+		if result.userAgent == claim.userAgent {
+			if result.verified {
+				return claimVerified
+			}
+			return claimFailed
+		}
+	}
+
+	// after a failed lookup the claim stays unverified for a while instead of starting another lookup
+	if _, failed := bc.botFailures.Get(hostPrefix(clientIP)); failed {
+		return claimPending
+	}
+
+	call, err := bc.botLookups.Do(lookup.Key{IP: clientIP, Name: claim.userAgent}, func() (bool, error) {
+		return bc.verifyClaimedBot(clientIP, claim)
+	})
+	if err != nil || bc.config.GoodBotPending != "wait" {
+		return claimPending
+	}
+
+	verified, err := call.Wait(req.Context())
+	if err != nil {
+		return claimPending
+	}
+	if verified {
+		return claimVerified
+	}
+	return claimFailed
+}
+
+// verifyClaimedBot runs the reverse DNS lookup for a claimed bot and caches the result
+func (bc *CaptchaProtect) verifyClaimedBot(clientIP netip.Addr, claim *botClaim) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bc.dnsTimeout)
+	defer cancel()
+
+	v, err := helper.IsIpGoodBot(ctx, bc.resolver, clientIP, claim.goodBots)
+	if err != nil {
+		log.Debug("Unable to verify bot user agent", "clientIP", clientIP, "useragent", claim.userAgent, "err", err)
+		bc.botFailures.Set(hostPrefix(clientIP), true, lru.DefaultExpiration)
+		return false, err
+	}
+
+	ttl := bc.notGoodBotTTL
+	if v {
+		ttl = bc.goodBotTTL
+	}
+	bc.claims.Set(hostPrefix(clientIP), claimResult{userAgent: claim.userAgent, verified: v}, ttl)
+
+	return v, nil
+}
+
+// rejectClaim handles a client whose user agent claims to be a bot it isn't
+func (bc *CaptchaProtect) rejectClaim(rw http.ResponseWriter, req *http.Request, clientIP netip.Addr) {
+	log.Info("Bot user agent failed verification", "clientIP", clientIP, "method", req.Method, "path", req.URL.Path, "useragent", req.UserAgent(), "action", bc.config.BotUserAgentAction)
+	if bc.config.BotUserAgentAction == "block" {
+		bc.servePage(rw, req, pageBlocked, http.StatusForbidden, bc.challengeData(req, clientIP, "", bc.lookupGeo(clientIP)))
+		return
+	}
+
+	bc.challenge(rw, req, clientIP)
+}
+
+// SetExemptIps swaps in a new list of exempt IPs, safe to call while serving requests
+func (bc *CaptchaProtect) SetExemptIps(exemptIps []netip.Prefix) {
+	bc.exemptIps.Store(cidrset.New(exemptIps))
+}
+
+func (bc *CaptchaProtect) isExemptIp(ip netip.Addr) bool {
+	ips, _ := bc.exemptIps.Load().(*cidrset.Set)
+	return ips.Contains(ip)
 }
 
 // log a warning if protected methods contains an invalid method
@@ -733,13 +2158,22 @@ func (bc *CaptchaProtect) saveStateWithLock() {
 	bc.stateMutex.Lock()
 	defer bc.stateMutex.Unlock()
 
+	// Check for writes from other instances before overwriting the file
+	fileChanged := bc.stateWatcher.Changed()
+
 	// Read current file state and reconcile differences
 	currentState := bc.readStateFromFile()
-	newState := state.GetState(bc.rateCache.Items(), bc.botCache.Items(), bc.verifiedCache.Items())
+	c := bc.caches
+	newState := state.GetState(c.rate.Items(), c.bots.Items(), c.verified.Items())
 
 	// Reconcile the states - merge current file state with new state
 	reconciledState := bc.reconcileStates(currentState, newState)
 
+	// Our write will be marked as seen, so pick up those changes now
+	if fileChanged {
+		bc.mergeCaches(c, currentState)
+	}
+
 	// Acquire file lock and write
 	err := bc.writeStateToFile(reconciledState)
 	if err != nil {
@@ -774,6 +2208,9 @@ func (bc *CaptchaProtect) writeStateToFile(state state.State) error {
 		return fmt.Errorf("failed writing state data: %w", err)
 	}
 
+	// don't reload what we just wrote
+	bc.stateWatcher.MarkSeen()
+
 	return nil
 }
 
@@ -904,17 +2341,8 @@ func (bc *CaptchaProtect) loadState() {
 		return
 	}
 
-	for k, v := range state.Rate {
-		bc.rateCache.Set(k, v, lru.DefaultExpiration)
-	}
-
-	for k, v := range state.Bots {
-		bc.botCache.Set(k, v, lru.DefaultExpiration)
-	}
-
-	for k, v := range state.Verified {
-		bc.verifiedCache.Set(k, v, lru.DefaultExpiration)
-	}
+	bc.mergeCaches(bc.caches, state)
+	bc.stateWatcher.MarkSeen()
 
 	log.Info("Loaded previous state",
 		"rateEntries", len(state.Rate),
@@ -923,33 +2351,46 @@ func (bc *CaptchaProtect) loadState() {
 		"stateFile", bc.config.PersistentStateFile)
 }
 
-func (bc *CaptchaProtect) reloadStateIfNeeded() {
-	// Check if 5 seconds have passed since last reload (with read lock for thread safety)
-	bc.stateMutex.RLock()
-	lastReload := bc.lastStateReload
-	bc.stateMutex.RUnlock()
-
-	now := time.Now()
-	if now.Sub(lastReload) < 5*time.Second {
-		return
+// mergeCaches upserts the given state into the caches
+// Counts are only raised and entries only added, so nothing a request
+// writes at the same time is overwritten. Entries that aren't valid IPs are skipped
+func (bc *CaptchaProtect) mergeCaches(c *cacheSet, s state.State) {
+	for k, v := range s.Rate {
+		if ip, ok := helper.ParseAddr(k); ok {
+			_, subnet := bc.ParseIp(ip)
+			c.rate.Raise(subnet, v)
+		}
 	}
 
-	// Double-check with write lock to avoid race conditions
-	bc.stateMutex.Lock()
-	if now.Sub(bc.lastStateReload) < 5*time.Second {
-		bc.stateMutex.Unlock()
-		return
+	for k, v := range s.Bots {
+		if ip, ok := helper.ParseAddr(k); ok {
+			ttl := bc.notGoodBotTTL
+			if v {
+				ttl = bc.goodBotTTL
+			}
+			// keep the result this instance already has
+			_ = c.bots.Add(hostPrefix(ip), v, ttl)
+		}
 	}
-	bc.lastStateReload = now
-	bc.stateMutex.Unlock()
 
-	bc.reloadStateFromFile()
+	for k, v := range s.Verified {
+		if ip, ok := helper.ParseAddr(k); ok {
+			_ = c.verified.Add(hostPrefix(ip), v, lru.DefaultExpiration)
+		}
+	}
 }
 
+// reloadStateFromFile merges state written by other instances into memory
+// It is called by the state file watcher, never on the request path
 func (bc *CaptchaProtect) reloadStateFromFile() {
 	bc.stateMutex.Lock()
 	defer bc.stateMutex.Unlock()
 
+	// Skip the reload if the file hasn't changed since our last read or write
+	if !bc.stateWatcher.Changed() {
+		return
+	}
+
 	// Read current file state
 	fileState := bc.readStateFromFile()
 	if len(fileState.Rate) == 0 && len(fileState.Bots) == 0 && len(fileState.Verified) == 0 {
@@ -957,36 +2398,14 @@ func (bc *CaptchaProtect) reloadStateFromFile() {
 		return
 	}
 
-	// Get current memory state
-	memoryState := state.GetState(bc.rateCache.Items(), bc.botCache.Items(), bc.verifiedCache.Items())
-
-	// Reconcile file state with memory state
-	reconciledState := bc.reconcileStates(fileState, memoryState)
-
-	// Clear current caches
-	bc.rateCache.Flush()
-	bc.botCache.Flush()
-	bc.verifiedCache.Flush()
-
-	// Load reconciled state into caches
-	for k, v := range reconciledState.Rate {
-		bc.rateCache.Set(k, v, lru.DefaultExpiration)
-	}
-
-	for k, v := range reconciledState.Bots {
-		bc.botCache.Set(k, v, lru.DefaultExpiration)
-	}
-
-	for k, v := range reconciledState.Verified {
-		bc.verifiedCache.Set(k, v, lru.DefaultExpiration)
-	}
+	bc.mergeCaches(bc.caches, fileState)
 
 	log.Debug("Reloaded state from file",
-		"rateEntries", len(reconciledState.Rate),
-		"botEntries", len(reconciledState.Bots),
-		"verifiedEntries", len(reconciledState.Verified))
+		"rateEntries", len(fileState.Rate),
+		"botEntries", len(fileState.Bots),
+		"verifiedEntries", len(fileState.Verified))
 }
 
 func (bc *CaptchaProtect) ChallengeOnPage() bool {
-	return bc.config.ChallengeURL == "?challenge=true"
+	return bc.site.challengeOnPage()
 }
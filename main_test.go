@@ -2,14 +2,27 @@ package captcha_protect
 
 import (
 	"context"
+	"fmt"
+	"html/template"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"net/url"
 	"os"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/dararish/captcha-protect/internal/geo"
+	"github.com/dararish/captcha-protect/internal/helper"
+	"github.com/dararish/captcha-protect/internal/lru"
+	"github.com/dararish/captcha-protect/internal/pow"
+	"github.com/dararish/captcha-protect/internal/watcher"
 )
 
 func init() {
@@ -73,23 +86,31 @@ func TestParseIp(t *testing.T) {
 			name:       "IPv6 /64",
 			ip:         "2001:0db8:85a3:1234:5678:8a2e:0370:7334",
 			ipv6Mask:   64,
-			wantFull:   "2001:0db8:85a3:1234:5678:8a2e:0370:7334",
+			wantFull:   "2001:db8:85a3:1234:5678:8a2e:370:7334",
 			wantSubnet: "2001:db8:85a3:1234::",
 		},
 		{
 			name:       "IPv6 /48",
 			ip:         "2001:0db8:85a3:1234:5678:8a2e:0370:7334",
 			ipv6Mask:   48,
-			wantFull:   "2001:0db8:85a3:1234:5678:8a2e:0370:7334",
+			wantFull:   "2001:db8:85a3:1234:5678:8a2e:370:7334",
 			wantSubnet: "2001:db8:85a3::",
 		},
 		{
-			name:       "Invalid IP returns same string",
+			name:       "IPv4-mapped IPv6 is treated as IPv4",
+			ip:         "::ffff:192.168.1.1",
+			ipv4Mask:   16,
+			ipv6Mask:   64,
+			wantFull:   "192.168.1.1",
+			wantSubnet: "192.168.0.0",
+		},
+		{
+			name:       "Invalid IP returns invalid address",
 			ip:         "not.an.ip",
 			ipv4Mask:   16,
 			ipv6Mask:   64,
-			wantFull:   "not.an.ip",
-			wantSubnet: "not.an.ip",
+			wantFull:   "invalid IP",
+			wantSubnet: "invalid IP",
 		},
 	}
 
@@ -98,14 +119,15 @@ func TestParseIp(t *testing.T) {
 			c := CreateConfig()
 			bc := &CaptchaProtect{
 				config:   c,
-				ipv4Mask: net.CIDRMask(tc.ipv4Mask, 32),
-				ipv6Mask: net.CIDRMask(tc.ipv6Mask, 128),
+				ipv4Bits: tc.ipv4Mask,
+				ipv6Bits: tc.ipv6Mask,
 			}
-			gotFull, gotSubnet := bc.ParseIp(tc.ip)
-			if gotFull != tc.wantFull {
+			ip, _ := helper.ParseAddr(tc.ip)
+			gotFull, gotSubnet := bc.ParseIp(ip)
+			if gotFull.String() != tc.wantFull {
 				t.Errorf("ParseIp(%q, %d, %d) got full = %q, want %q", tc.ip, tc.ipv4Mask, tc.ipv6Mask, gotFull, tc.wantFull)
 			}
-			if gotSubnet != tc.wantSubnet {
+			if gotSubnet.Addr().String() != tc.wantSubnet {
 				t.Errorf("ParseIp(%q, %d, %d) got subnet = %q, want %q", tc.ip, tc.ipv4Mask, tc.ipv6Mask, gotSubnet, tc.wantSubnet)
 			}
 		})
@@ -362,6 +384,7 @@ func TestGetClientIP(t *testing.T) {
 		name        string
 		config      Config
 		headerValue string
+		headers     http.Header
 		remoteAddr  string
 		expectedIP  string
 	}{
@@ -437,28 +460,164 @@ func TestGetClientIP(t *testing.T) {
 			remoteAddr:  "5.5.5.5:4321",
 			expectedIP:  "5.5.5.5",
 		},
+		{
+			name: "Trusted proxies, header from untrusted peer is ignored",
+			config: Config{
+				IPForwardedHeader: "X-Forwarded-For",
+				TrustedProxies:    []string{"10.0.0.0/8"},
+			},
+			headerValue: "1.1.1.1",
+			remoteAddr:  "5.5.5.5:4321",
+			expectedIP:  "5.5.5.5",
+		},
+		{
+			name: "Trusted proxies, rightmost untrusted hop is the client",
+			config: Config{
+				IPForwardedHeader: "X-Forwarded-For",
+				TrustedProxies:    []string{"10.0.0.0/8", "2.2.2.0/24"},
+			},
+			headerValue: "9.9.9.9, 1.1.1.1, 2.2.2.2, 10.0.0.5",
+			remoteAddr:  "10.0.0.1:4321",
+			expectedIP:  "1.1.1.1",
+		},
+		{
+			name: "Trusted proxies, spoofed leftmost entries are not used",
+			config: Config{
+				IPForwardedHeader: "X-Forwarded-For",
+				TrustedProxies:    []string{"10.0.0.0/8"},
+				IPDepth:           1,
+			},
+			headerValue: "127.0.0.1, 1.1.1.1",
+			remoteAddr:  "10.0.0.1:4321",
+			expectedIP:  "1.1.1.1",
+		},
+		{
+			name: "Trusted proxies, exempt IPs are not treated as proxies",
+			config: Config{
+				IPForwardedHeader: "X-Forwarded-For",
+				TrustedProxies:    []string{"10.0.0.1/32"},
+			},
+			headerValue: "1.1.1.1, 192.168.1.1",
+			remoteAddr:  "10.0.0.1:4321",
+			expectedIP:  "192.168.1.1",
+		},
+		{
+			name: "Trusted proxies, all hops trusted picks the leftmost",
+			config: Config{
+				IPForwardedHeader: "X-Forwarded-For",
+				TrustedProxies:    []string{"10.0.0.0/8"},
+			},
+			headerValue: "10.1.1.1, 10.2.2.2",
+			remoteAddr:  "10.0.0.1:4321",
+			expectedIP:  "10.1.1.1",
+		},
+		{
+			name: "Forwarded header with quoted IPv6 and port",
+			config: Config{
+				IPForwardedHeader: "Forwarded",
+			},
+			headers: http.Header{
+				"Forwarded": {`for=1.1.1.1;proto=http, for="[2001:db8::1]:443";proto=https`},
+			},
+			remoteAddr: "3.3.3.3:1234",
+			expectedIP: "2001:db8::1",
+		},
+		{
+			name: "Forwarded header from trusted proxies",
+			config: Config{
+				IPForwardedHeader: "forwarded",
+				TrustedProxies:    []string{"10.0.0.0/8"},
+			},
+			headers: http.Header{
+				"Forwarded": {`for=9.9.9.9, for=1.1.1.1;by=10.0.0.2`, `for=10.0.0.2;proto=https`},
+			},
+			remoteAddr: "10.0.0.1:1234",
+			expectedIP: "1.1.1.1",
+		},
+		{
+			name: "Forwarded header with obfuscated identifier stops the walk",
+			config: Config{
+				IPForwardedHeader: "Forwarded",
+				TrustedProxies:    []string{"10.0.0.0/8"},
+			},
+			headers: http.Header{
+				"Forwarded": {`for=1.1.1.1, for=_hidden, for=10.0.0.2`},
+			},
+			remoteAddr: "10.0.0.1:1234",
+			expectedIP: "10.0.0.2",
+		},
+		{
+			name: "First candidate header present is used",
+			config: Config{
+				IPForwardedHeaders: []string{"CF-Connecting-IP", "True-Client-IP", "X-Forwarded-For"},
+			},
+			headers: http.Header{
+				"True-Client-Ip":  {"6.6.6.6"},
+				"X-Forwarded-For": {"7.7.7.7"},
+			},
+			remoteAddr: "3.3.3.3:1234",
+			expectedIP: "6.6.6.6",
+		},
+		{
+			name: "ipForwardedHeader is checked before candidate headers",
+			config: Config{
+				IPForwardedHeader:  "X-Forwarded-For",
+				IPForwardedHeaders: []string{"CF-Connecting-IP"},
+			},
+			headers: http.Header{
+				"Cf-Connecting-Ip": {"6.6.6.6"},
+				"X-Forwarded-For":  {"7.7.7.7"},
+			},
+			remoteAddr: "3.3.3.3:1234",
+			expectedIP: "7.7.7.7",
+		},
+		{
+			name: "No candidate header present falls back to RemoteAddr",
+			config: Config{
+				IPForwardedHeaders: []string{"CF-Connecting-IP", "True-Client-IP"},
+			},
+			headers:    http.Header{},
+			remoteAddr: "3.3.3.3:1234",
+			expectedIP: "3.3.3.3",
+		},
+		{
+			name: "Trusted proxies, invalid hop stops the walk",
+			config: Config{
+				IPForwardedHeader: "X-Forwarded-For",
+				TrustedProxies:    []string{"10.0.0.0/8"},
+			},
+			headerValue: "1.1.1.1, garbage, 10.2.2.2",
+			remoteAddr:  "10.0.0.1:4321",
+			expectedIP:  "10.2.2.2",
+		},
 	}
 	for _, tc := range tests {
 
 		t.Run(tc.name, func(t *testing.T) {
 			// Create a dummy request
 			req := httptest.NewRequest("GET", "http://example.com", nil)
-			req.Header.Set("X-Forwarded-For", tc.headerValue)
+			if tc.headers != nil {
+				req.Header = tc.headers
+			} else {
+				req.Header.Set("X-Forwarded-For", tc.headerValue)
+			}
 
 			req.RemoteAddr = tc.remoteAddr
 
 			c := CreateConfig()
 			c.IPForwardedHeader = tc.config.IPForwardedHeader
+			c.IPForwardedHeaders = tc.config.IPForwardedHeaders
 			c.IPDepth = tc.config.IPDepth
 			c.ProtectRoutes = []string{"/"}
 			c.ExemptIPs = tc.config.ExemptIPs
+			c.TrustedProxies = tc.config.TrustedProxies
 			bc, err := NewCaptchaProtect(context.Background(), nil, c, "captcha-protect")
 			if err != nil {
 				t.Errorf("unexpected error %v", err)
 			}
 
 			ip, _ := bc.getClientIP(req)
-			if ip != tc.expectedIP {
+			if ip.String() != tc.expectedIP {
 				t.Errorf("expected ip %s, got %s", tc.expectedIP, ip)
 			}
 		})
@@ -586,3 +745,1617 @@ func TestIsGoodUserAgent(t *testing.T) {
 		}
 	}
 }
+
+func TestReloadStateFromFile(t *testing.T) {
+	stateFile := t.TempDir() + "/state.json"
+	err := os.WriteFile(stateFile, []byte(`{"rate":{"1.2.0.0":5},"bots":{"1.2.3.4":true},"verified":{"5.6.7.8":true}}`), 0644)
+	if err != nil {
+		t.Fatalf("unable to write state file: %v", err)
+	}
+
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// set up the state file without starting the background save and watch goroutines
+	bc.config.PersistentStateFile = stateFile
+	bc.stateWatcher = watcher.New(stateFile, time.Second)
+	bc.loadState()
+
+	if _, ok := bc.caches.rate.Get(netip.MustParsePrefix("1.2.0.0/16")); !ok {
+		t.Fatalf("expected state file to be loaded on startup")
+	}
+
+	c := bc.caches
+	subnet := netip.MustParsePrefix("1.2.0.0/16")
+	c.rate.Increment(subnet, 1)
+
+	// unchanged file is not reloaded
+	bc.reloadStateFromFile()
+	if v, _ := c.rate.Get(subnet); v != 6 {
+		t.Fatalf("expected unchanged state file to be skipped, got %d", v)
+	}
+
+	// requests keep writing to the same caches while they are reloaded
+	c.rate.Increment(netip.MustParsePrefix("9.9.0.0/16"), 20)
+	c.verified.Set(netip.MustParsePrefix("9.9.9.9/32"), true, 0)
+
+	// simulate a write from another instance
+	err = os.WriteFile(stateFile, []byte(`{"rate":{"1.2.0.0":8,"9.9.0.0":3},"bots":{"1.2.3.4":true},"verified":{"5.6.7.8":true,"5.6.7.9":true}}`), 0644)
+	if err != nil {
+		t.Fatalf("unable to write state file: %v", err)
+	}
+
+	bc.reloadStateFromFile()
+
+	if bc.caches != c {
+		t.Fatalf("expected the state to be merged into the live caches")
+	}
+	if v, ok := c.rate.Get(subnet); !ok || v != 8 {
+		t.Errorf("expected rate to be raised from file, got %v", v)
+	}
+	if v, ok := c.rate.Get(netip.MustParsePrefix("9.9.0.0/16")); !ok || v != 20 {
+		t.Errorf("expected higher rate from memory to be kept, got %v", v)
+	}
+	for _, ip := range []string{"5.6.7.8", "5.6.7.9", "9.9.9.9"} {
+		if _, ok := c.verified.Get(netip.MustParsePrefix(ip + "/32")); !ok {
+			t.Errorf("expected %s to remain verified after reload", ip)
+		}
+	}
+	if _, ok := c.bots.Get(netip.MustParsePrefix("1.2.3.4/32")); !ok {
+		t.Errorf("expected bot from file to be loaded")
+	}
+}
+
+func TestMaxRateEntries(t *testing.T) {
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.MaxRateEntries = 128
+	bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// a busy subnet survives a flood of new subnets
+	busy := netip.MustParsePrefix("1.1.0.0/16")
+	for i := 0; i < 10; i++ {
+		bc.registerRequest(busy)
+	}
+	for i := 0; i < 1000; i++ {
+		bc.registerRequest(netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 0}), 16))
+	}
+
+	c := bc.caches
+	if c.rate.ItemCount() > 128 {
+		t.Errorf("expected at most 128 rate entries, got %d", c.rate.ItemCount())
+	}
+	if v, ok := c.rate.Get(busy); !ok || v != 10 {
+		t.Errorf("expected busy subnet to be kept, got %v", v)
+	}
+	if c.rate.Evictions() == 0 {
+		t.Errorf("expected evictions")
+	}
+}
+
+func TestGoodBotRanges(t *testing.T) {
+	ranges := t.TempDir() + "/googlebot.json"
+	err := os.WriteFile(ranges, []byte(`{"prefixes": [{"ipv4Prefix": "66.249.64.0/27"}, {"ipv6Prefix": "2001:4860:4801:10::/64"}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.GoodBotRanges = []string{ranges}
+	bc, err := NewCaptchaProtect(ctx, nil, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	for ip, expected := range map[string]bool{
+		"66.249.64.1":          true,
+		"2001:4860:4801:10::1": true,
+		"66.249.65.1":          false,
+	} {
+		if got := bc.isGoodBot(req, netip.MustParseAddr(ip)); got != expected {
+			t.Errorf("isGoodBot(%s) = %v; expected %v", ip, got, expected)
+		}
+	}
+
+	// a miss isn't cached, so a refresh that adds the IP applies right away
+	err = os.WriteFile(ranges, []byte(`{"prefixes": [{"ipv4Prefix": "66.249.64.0/23"}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.goodBotRanges.Update(ctx, ranges); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !bc.isGoodBot(req, netip.MustParseAddr("66.249.65.1")) {
+		t.Error("expected an IP added by a refresh to be a good bot")
+	}
+	if n := bc.caches.bots.ItemCount(); n != 0 {
+		t.Errorf("expected range lookups not to be cached, got %d entries", n)
+	}
+
+	config = CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.GoodBotRanges = []string{t.TempDir() + "/missing.json"}
+	if _, err := NewCaptchaProtect(ctx, nil, config, "captcha-protect"); err == nil {
+		t.Error("expected an error for a missing goodBotRanges file")
+	}
+}
+
+// blockingResolver answers every PTR lookup with crawl.google.com once released
+type blockingResolver struct {
+	release chan struct{}
+	lookups atomic.Int32
+}
+
+func (r *blockingResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.lookups.Add(1)
+	select {
+	case <-r.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return []string{"crawl.google.com."}, nil
+}
+
+func (r *blockingResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	return []netip.Addr{netip.MustParseAddr("66.249.64.1")}, nil
+}
+
+func TestGoodBotLookups(t *testing.T) {
+	tests := []struct {
+		name     string
+		pending  string
+		ip       string
+		first    bool
+		verified bool
+	}{
+		{name: "Wait for the lookup", pending: "wait", ip: "66.249.64.1", first: true, verified: true},
+		{name: "Allow while verifying a good bot", pending: "allow", ip: "66.249.64.1", first: true, verified: true},
+		{name: "Allow while verifying a spoofed bot", pending: "allow", ip: "1.2.3.4", first: true, verified: false},
+		{name: "Challenge while verifying", pending: "challenge", ip: "66.249.64.1", first: false, verified: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.ProtectRoutes = []string{"/"}
+			config.GoodBots = []string{"google.com"}
+			config.GoodBotPending = tc.pending
+			bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			resolver := &blockingResolver{release: make(chan struct{})}
+			bc.resolver = resolver
+			ip := netip.MustParseAddr(tc.ip)
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+
+			// concurrent first requests share a single lookup
+			var wg sync.WaitGroup
+			results := make([]bool, 10)
+			for i := range results {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					results[i] = bc.isGoodBot(req, ip)
+				}(i)
+			}
+			if tc.pending != "wait" {
+				wg.Wait()
+			}
+			close(resolver.release)
+			wg.Wait()
+
+			for _, r := range results {
+				if r != tc.first {
+					t.Errorf("expected first requests to return %v, got %v", tc.first, r)
+				}
+			}
+
+			// once verified the result is cached
+			deadline := time.Now().Add(time.Second)
+			for bc.botLookups.Pending() > 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if resolver.lookups.Load() != 1 {
+				t.Errorf("expected 1 lookup, got %d", resolver.lookups.Load())
+			}
+			if v := bc.isGoodBot(req, ip); v != tc.verified {
+				t.Errorf("expected %v once verified, got %v", tc.verified, v)
+			}
+			for bc.botLookups.Pending() > 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if resolver.lookups.Load() != 1 {
+				t.Errorf("expected the result to be cached, got %d lookups", resolver.lookups.Load())
+			}
+		})
+	}
+}
+
+// timeoutResolver times out every lookup
+type timeoutResolver struct {
+	lookups atomic.Int32
+}
+
+func (r *timeoutResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.lookups.Add(1)
+	return nil, &net.DNSError{Err: "i/o timeout", Name: addr, IsTimeout: true}
+}
+
+func (r *timeoutResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+}
+
+func TestGoodBotLookupFailure(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.GoodBots = []string{"google.com"}
+	config.GoodBotPending = "allow"
+	config.RateLimit = 2
+	bc, err := NewCaptchaProtect(context.Background(), next, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resolver := &timeoutResolver{}
+	bc.resolver = resolver
+
+	// a client whose reverse DNS always times out is rate limited like any other
+	passed := 0
+	for i := 0; i < 50; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "1.2.3.4:1234"
+		rr := httptest.NewRecorder()
+		bc.ServeHTTP(rr, req)
+		if rr.Code == http.StatusOK {
+			passed++
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for bc.botLookups.Pending() > 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// the pending lookup lets the first request through
+	if passed != 1+int(config.RateLimit) {
+		t.Errorf("expected %d requests to pass, got %d", 1+config.RateLimit, passed)
+	}
+	if resolver.lookups.Load() != 1 {
+		t.Errorf("expected a failed lookup not to be retried right away, got %d lookups", resolver.lookups.Load())
+	}
+	if _, ok := bc.caches.bots.Get(netip.MustParsePrefix("1.2.3.4/32")); ok {
+		t.Error("expected a failed lookup to be kept out of the bot cache")
+	}
+}
+
+// mapResolver answers PTR lookups from a map, and confirms them with the same IP
+type mapResolver map[string]string
+
+func (r mapResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if host, ok := r[addr]; ok {
+		return []string{host}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func (r mapResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	for ip, h := range r {
+		if h == host {
+			return []netip.Addr{netip.MustParseAddr(ip)}, nil
+		}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestBotUserAgents(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	googlebot := "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	browser := "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+
+	tests := []struct {
+		name     string
+		action   string
+		ip       string
+		ua       string
+		expected int
+	}{
+		{name: "Verified claim", action: "challenge", ip: "66.249.64.1", ua: googlebot, expected: http.StatusOK},
+		{name: "Claim from the wrong domain is challenged", action: "challenge", ip: "1.2.3.4", ua: googlebot, expected: http.StatusFound},
+		{name: "Claim without reverse DNS is challenged", action: "challenge", ip: "5.6.7.8", ua: googlebot, expected: http.StatusFound},
+		{name: "Claim from the wrong domain is blocked", action: "block", ip: "1.2.3.4", ua: googlebot, expected: http.StatusForbidden},
+		{name: "No claim is rate limited as usual", action: "block", ip: "1.2.3.4", ua: browser, expected: http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.ProtectRoutes = []string{"/"}
+			config.RateLimit = 100
+			// the user agent exemption must not let an unverified claim through
+			config.ExemptUserAgents = []string{"mozilla/5.0 (compatible; googlebot"}
+			config.BotUserAgents = map[string]string{"Googlebot": "googlebot.com,google.com"}
+			config.BotUserAgentAction = tc.action
+			bc, err := NewCaptchaProtect(context.Background(), next, config, "captcha-protect")
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			bc.resolver = mapResolver{
+				"66.249.64.1": "crawl-66-249-64-1.googlebot.com.",
+				"1.2.3.4":     "host.example.com.",
+			}
+
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/somepath", nil)
+				req.RemoteAddr = tc.ip + ":1234"
+				req.Header.Set("User-Agent", tc.ua)
+				rr := httptest.NewRecorder()
+				bc.ServeHTTP(rr, req)
+				if rr.Code != tc.expected {
+					t.Errorf("request %d: expected %d got %d", i+1, tc.expected, rr.Code)
+				}
+			}
+		})
+	}
+
+	// a claim whose lookup fails is rate limited as usual without a lookup for every request
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.RateLimit = 100
+	config.BotUserAgents = map[string]string{"Googlebot": "googlebot.com,google.com"}
+	bc, err := NewCaptchaProtect(context.Background(), next, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resolver := &timeoutResolver{}
+	bc.resolver = resolver
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/somepath", nil)
+		req.RemoteAddr = "1.2.3.4:1234"
+		req.Header.Set("User-Agent", googlebot)
+		rr := httptest.NewRecorder()
+		bc.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("request %d: expected %d got %d", i+1, http.StatusOK, rr.Code)
+		}
+	}
+	if resolver.lookups.Load() != 1 {
+		t.Errorf("expected a failed claim lookup not to be retried right away, got %d lookups", resolver.lookups.Load())
+	}
+
+	config = CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.BotUserAgents = map[string]string{"Googlebot": "com"}
+	if _, err := NewCaptchaProtect(context.Background(), next, config, "captcha-protect"); err == nil {
+		t.Error("expected an error for a botUserAgents entry matching a public suffix")
+	}
+}
+
+func TestDenyList(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name     string
+		action   string
+		ip       string
+		ua       string
+		path     string
+		verified bool
+		expected int
+	}{
+		{name: "Not denied", action: "block", ip: "1.2.3.4", path: "/", expected: http.StatusOK},
+		{name: "Denied IP is blocked", action: "block", ip: "192.0.2.1", path: "/", expected: http.StatusForbidden},
+		{name: "Denied IP is challenged", action: "challenge", ip: "192.0.2.1", path: "/", expected: http.StatusFound},
+		{name: "Denied IP wins over exempt IP", action: "block", ip: "10.0.0.1", path: "/", expected: http.StatusForbidden},
+		{name: "Denied user agent", action: "block", ip: "1.2.3.4", ua: "python-requests/2.32", path: "/", expected: http.StatusForbidden},
+		{name: "Denied route", action: "block", ip: "1.2.3.4", path: "/wp-login.php", expected: http.StatusForbidden},
+		{name: "Denied route outside protectRoutes", action: "block", ip: "1.2.3.4", path: "/.env", expected: http.StatusForbidden},
+		{name: "Verified client is not challenged again", action: "challenge", ip: "192.0.2.1", path: "/", verified: true, expected: http.StatusOK},
+		{name: "Verified client is still blocked", action: "block", ip: "192.0.2.1", path: "/", verified: true, expected: http.StatusForbidden},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.ProtectRoutes = []string{"/"}
+			config.ExcludeRoutes = []string{"/.env"}
+			config.RateLimit = 100
+			config.DenyIPs = []string{"192.0.2.0/24", "10.0.0.1"}
+			config.DenyUserAgents = []string{"Python-Requests"}
+			config.DenyRoutes = []string{"/wp-login", "/.env"}
+			config.DenyAction = tc.action
+			bc, err := NewCaptchaProtect(context.Background(), next, config, "captcha-protect")
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if tc.verified {
+				bc.caches.verified.Set(hostPrefix(netip.MustParseAddr(tc.ip)), true, lru.DefaultExpiration)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com"+tc.path, nil)
+			req.RemoteAddr = tc.ip + ":1234"
+			req.Header.Set("User-Agent", tc.ua)
+			rr := httptest.NewRecorder()
+			bc.ServeHTTP(rr, req)
+			if rr.Code != tc.expected {
+				t.Errorf("expected %d got %d", tc.expected, rr.Code)
+			}
+		})
+	}
+}
+
+func TestReloadDenyList(t *testing.T) {
+	denyFile := t.TempDir() + "/deny.txt"
+	if err := os.WriteFile(denyFile, []byte("192.0.2.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.DenyIPs = []string{"198.51.100.1"}
+	config.DenyAction = "block"
+	bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// set the file after construction so no watcher goroutines are started
+	bc.config.DenyIPsFile = denyFile
+
+	denied := func(ip string) bool {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		_, ok := bc.isDenied(req, netip.MustParseAddr(ip))
+		return ok
+	}
+
+	bc.reloadDenyList(watcher.New(denyFile, time.Second))
+	if !denied("192.0.2.1") || !denied("198.51.100.1") {
+		t.Error("expected the file and inline entries to be denied after a reload")
+	}
+
+	// a file that can't be parsed keeps the previous list
+	if err := os.WriteFile(denyFile, []byte("192.0.2.0/24\nnot-an-ip\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bc.reloadDenyList(watcher.New(denyFile, time.Second))
+	if !denied("192.0.2.1") {
+		t.Error("expected the previous deny list to be kept")
+	}
+
+	if err := os.WriteFile(denyFile, []byte("203.0.113.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bc.reloadDenyList(watcher.New(denyFile, time.Second))
+	if denied("192.0.2.1") || !denied("203.0.113.1") {
+		t.Error("expected the updated file to replace the previous entries")
+	}
+}
+
+func TestReloadExemptIps(t *testing.T) {
+	exemptFile := t.TempDir() + "/exempt.txt"
+	if err := os.WriteFile(exemptFile, []byte("# partners\n192.0.2.0/24\n198.51.100.7\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.ExemptIPs = []string{"203.0.113.0/24"}
+	bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// set the file after construction so no watcher goroutines are started
+	bc.config.ExemptIPsFile = exemptFile
+	bc.reloadExemptIps(watcher.New(exemptFile, time.Second))
+
+	exempt := func(ip string) bool {
+		return bc.isExemptIp(netip.MustParseAddr(ip))
+	}
+	for _, ip := range []string{"10.0.0.1", "203.0.113.1", "192.0.2.1", "198.51.100.7"} {
+		if !exempt(ip) {
+			t.Errorf("expected %s to be exempt", ip)
+		}
+	}
+	if exempt("198.51.100.8") {
+		t.Error("expected a single IP to only exempt itself")
+	}
+
+	// a file that can't be parsed keeps the previous list
+	if err := os.WriteFile(exemptFile, []byte("192.0.2.0/24\nnot-an-ip\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bc.reloadExemptIps(watcher.New(exemptFile, time.Second))
+	if !exempt("198.51.100.7") {
+		t.Error("expected the previous exempt IPs to be kept")
+	}
+
+	if err := os.WriteFile(exemptFile, []byte("198.51.100.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bc.reloadExemptIps(watcher.New(exemptFile, time.Second))
+	if exempt("192.0.2.1") || !exempt("198.51.100.8") || !exempt("203.0.113.1") {
+		t.Error("expected the updated file to replace the previous entries")
+	}
+
+	if _, err := loadExemptIps(&Config{ExemptIPsFile: "/nonexistent/exempt.txt"}); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestSetExemptIpsConcurrently(t *testing.T) {
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.RateLimit = 1 << 30
+	bc, err := NewCaptchaProtect(context.Background(), http.NotFoundHandler(), config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			bc.SetExemptIps([]netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		bc.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	wg.Wait()
+}
+
+func TestChallengeLanguage(t *testing.T) {
+	tests := []struct {
+		name           string
+		provider       string
+		language       string
+		acceptLanguage string
+		expected       []string
+	}{
+		{name: "Fallback", acceptLanguage: "", expected: []string{`<html lang="en">`, "Verifying connection", `data-language="en"`}},
+		{name: "Accept-Language", acceptLanguage: "de-DE,de;q=0.9,en;q=0.8", expected: []string{`<html lang="de">`, "Verbindung wird überprüft", `data-language="de"`}},
+		{name: "Unsupported Accept-Language", acceptLanguage: "xx", expected: []string{"Verifying connection"}},
+		{name: "Override", language: "FR", acceptLanguage: "de", expected: []string{"Vérification de la connexion", `data-language="fr"`}},
+		{name: "Language in the recaptcha script", provider: "recaptcha", acceptLanguage: "es", expected: []string{"https://www.google.com/recaptcha/api.js?hl=es"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.ProtectRoutes = []string{"/"}
+			config.Language = tc.language
+			if tc.provider != "" {
+				config.CaptchaProvider = tc.provider
+			}
+			bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/challenge?destination=%2F", nil)
+			req.RemoteAddr = "1.2.3.4:1234"
+			req.Header.Set("Accept-Language", tc.acceptLanguage)
+			rr := httptest.NewRecorder()
+			bc.ServeHTTP(rr, req)
+			for _, e := range tc.expected {
+				if !strings.Contains(rr.Body.String(), e) {
+					t.Errorf("expected the challenge page to contain %q", e)
+				}
+			}
+		})
+	}
+
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.DefaultLanguage = "xx"
+	if _, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect"); err == nil {
+		t.Error("expected an error for an unsupported defaultLanguage")
+	}
+}
+
+func TestChallengeData(t *testing.T) {
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.ShowClientIp = "true"
+	config.SiteKey = "site-key"
+	bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	bc.site.tmpl.parsed.Store(template.Must(template.New("challenge").Parse(
+		"{{ .SiteKey }}|{{ .Provider }}|{{ .Host }}|{{ .Method }}|{{ .Path }}|{{ .ClientIP }}|{{ .RequestID }}|{{ .Retry }}|{{ len .Nonce }}")))
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/challenge?destination=%252Fshop%253Fpage%253D2", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	req.Header.Set("X-Request-Id", "abc123")
+	rr := httptest.NewRecorder()
+	bc.ServeHTTP(rr, req)
+
+	expected := "site-key|turnstile|example.com|GET|/shop|1.2.3.4|abc123|0|22"
+	if rr.Body.String() != expected {
+		t.Errorf("expected %q got %q", expected, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+
+	// the challenged method goes through the redirect and is posted back with the form
+	bc.config.ProtectHttpMethods = []string{"POST"}
+	bc.config.RateLimit = 0
+	req = httptest.NewRequest(http.MethodPost, "http://example.com/shop", strings.NewReader("q=1"))
+	req.RemoteAddr = "1.2.3.4:1234"
+	rr = httptest.NewRecorder()
+	bc.ServeHTTP(rr, req)
+	if loc := rr.Header().Get("Location"); !strings.Contains(loc, "&method=POST") {
+		t.Fatalf("expected the method in the redirect, got %q", loc)
+	}
+
+	for _, tc := range []struct {
+		method string
+		url    string
+		body   string
+	}{
+		{method: http.MethodGet, url: "http://example.com/challenge?destination=%2Fshop&method=POST"},
+		{method: http.MethodPost, url: "http://example.com/challenge", body: "destination=%2Fshop&method=POST"},
+	} {
+		req = httptest.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Request-Id", "abc123")
+		req.RemoteAddr = "1.2.3.4:1234"
+		rr = httptest.NewRecorder()
+		bc.ServeHTTP(rr, req)
+		if !strings.HasPrefix(rr.Body.String(), "site-key|turnstile|example.com|POST|/shop|") {
+			t.Errorf("%s %s: expected the challenged method, got %q", tc.method, tc.url, rr.Body.String())
+		}
+	}
+
+	for m, expected := range map[string]string{"": "GET", "PUT": "PUT", "post": "GET", "<b>": "GET"} {
+		if got := challengedMethod(m); got != expected {
+			t.Errorf("challengedMethod(%q) = %q; expected %q", m, got, expected)
+		}
+	}
+}
+
+func TestChallengePageEscaping(t *testing.T) {
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/challenge?destination=%22%3E%3Cscript%3Ealert(1)%3C/script%3E", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	rr := httptest.NewRecorder()
+	bc.ServeHTTP(rr, req)
+
+	if strings.Contains(rr.Body.String(), "<script>alert(1)") {
+		t.Errorf("expected the destination to be escaped, got %s", rr.Body.String())
+	}
+}
+
+func TestTemplatePages(t *testing.T) {
+	tmplFile := t.TempDir() + "/challenge.tmpl.html"
+	tmpl := `<p>{{ T .Language "title" }} {{ .SiteKey }}</p>{{ define "blocked" }}blocked {{ .Path }}{{ end }}`
+	if err := os.WriteFile(tmplFile, []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.ChallengeTmpl = tmplFile
+	config.SiteKey = "site-key"
+	config.DenyIPs = []string{"192.0.2.1"}
+	config.DenyAction = "block"
+	config.MaxChallengeAttempts = 1
+	// stop the template watcher before it polls, the template is reloaded by TestReloadTemplate
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bc, err := NewCaptchaProtect(ctx, nil, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	bc.site.captchaConfig.validate = siteverify(t, `{"success": false}`)
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		ip       string
+		expected int
+		body     string
+	}{
+		{name: "Challenge page from the file", method: http.MethodGet, url: "/challenge?destination=%2F", ip: "1.2.3.4", expected: http.StatusOK, body: "<p>Verifying connection site-key</p>"},
+		{name: "Blocked page from the file", method: http.MethodGet, url: "/admin", ip: "192.0.2.1", expected: http.StatusForbidden, body: "blocked /admin"},
+		{name: "Default failed page", method: http.MethodPost, url: "/challenge?cf-turnstile-response=bad", ip: "1.2.3.4", expected: http.StatusTooManyRequests, body: "Verification failed"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "http://example.com"+tc.url, nil)
+			req.RemoteAddr = tc.ip + ":1234"
+			rr := httptest.NewRecorder()
+			bc.ServeHTTP(rr, req)
+			if rr.Code != tc.expected || !strings.Contains(rr.Body.String(), tc.body) {
+				t.Errorf("expected %d %q, got %d %q", tc.expected, tc.body, rr.Code, rr.Body.String())
+			}
+			if rr.Header().Get("Cache-Control") != "no-store" {
+				t.Errorf("expected the page headers, got %v", rr.Header())
+			}
+		})
+	}
+}
+
+func TestReloadTemplate(t *testing.T) {
+	tmplFile := t.TempDir() + "/challenge.tmpl.html"
+	if err := os.WriteFile(tmplFile, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.ChallengeTmpl = tmplFile
+	// stop the template watcher before it polls, the template is reloaded by hand
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bc, err := NewCaptchaProtect(ctx, nil, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	page := func() string {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/challenge?destination=%2F", nil)
+		req.RemoteAddr = "1.2.3.4:1234"
+		rr := httptest.NewRecorder()
+		bc.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+	reload := func(content string) {
+		if err := os.WriteFile(tmplFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		bc.site.tmpl.watcher = watcher.New(tmplFile, time.Second)
+		bc.site.tmpl.reload()
+	}
+
+	if page() != "first" {
+		t.Fatalf("unexpected page %q", page())
+	}
+
+	reload("second {{ .Provider }}")
+	if page() != "second turnstile" {
+		t.Errorf("expected the updated template, got %q", page())
+	}
+
+	// a template that doesn't parse keeps the last good one
+	reload("third {{ .Provider ")
+	if page() != "second turnstile" {
+		t.Errorf("expected the previous template to be kept, got %q", page())
+	}
+
+	// a template that parses but can't be escaped keeps the last good one too
+	reload(`fourth <a href="{{ .Path }}`)
+	if page() != "second turnstile" {
+		t.Errorf("expected the previous template to be kept, got %q", page())
+	}
+
+	// an unchanged file isn't parsed again
+	bc.site.tmpl.reload()
+	if page() != "second turnstile" {
+		t.Errorf("unexpected page %q", page())
+	}
+
+	config.StateReloadInterval = 0
+	if _, err := NewCaptchaProtect(ctx, nil, config, "captcha-protect"); err == nil {
+		t.Error("expected an error for a stateReloadInterval of 0")
+	}
+}
+
+func TestChallengeHeaders(t *testing.T) {
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.CaptchaProvider = "hcaptcha"
+	config.ChallengeHeaders = map[string]string{
+		"x-frame-options":    "",
+		"Permissions-Policy": "camera=()",
+		"X-Nonce":            "{nonce}",
+	}
+	bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/challenge?destination=%2F", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	rr := httptest.NewRecorder()
+	bc.ServeHTTP(rr, req)
+
+	nonce := rr.Header().Get("X-Nonce")
+	if nonce == "" {
+		t.Fatal("expected {nonce} to be replaced in custom headers")
+	}
+	csp := rr.Header().Get("Content-Security-Policy")
+	for _, e := range []string{"default-src 'none'", "script-src 'nonce-" + nonce + "' https://hcaptcha.com https://*.hcaptcha.com", "frame-ancestors 'none'"} {
+		if !strings.Contains(csp, e) {
+			t.Errorf("expected the CSP to contain %q, got %q", e, csp)
+		}
+	}
+	if strings.Count(rr.Body.String(), `nonce="`+nonce+`"`) != 2 {
+		t.Errorf("expected both scripts on the page to have the nonce")
+	}
+	if rr.Header().Get("Cache-Control") != "no-store" || rr.Header().Get("Referrer-Policy") != "same-origin" {
+		t.Errorf("unexpected headers %v", rr.Header())
+	}
+	if rr.Header().Get("X-Frame-Options") != "" || rr.Header().Get("Permissions-Policy") != "camera=()" {
+		t.Errorf("expected challengeHeaders to override the defaults, got %v", rr.Header())
+	}
+
+	// a nonce is never reused
+	rr2 := httptest.NewRecorder()
+	bc.ServeHTTP(rr2, req)
+	if rr2.Header().Get("X-Nonce") == nonce {
+		t.Error("expected a new nonce for every response")
+	}
+
+	// the redirect to the challenge isn't cached either
+	bc.config.RateLimit = 0
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	rr = httptest.NewRecorder()
+	bc.ServeHTTP(rr, req)
+	if rr.Code != http.StatusFound || rr.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("expected an uncached redirect, got %d %v", rr.Code, rr.Header())
+	}
+}
+
+// geoDatabase answers MaxMind DB lookups from records keyed by IP and path
+type geoDatabase map[string]map[string]interface{}
+
+func (g geoDatabase) Lookup(ip netip.Addr, path ...string) (interface{}, bool, error) {
+	v, ok := g[ip.String()][strings.Join(path, ".")]
+	return v, ok, nil
+}
+
+func TestHosts(t *testing.T) {
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.RateLimit = 0
+	config.SiteKey = "default-key"
+	config.Hosts = map[string]HostConfig{
+		"shop.example.com": {SiteKey: "shop-key", CaptchaProvider: "hcaptcha"},
+		"*.example.com":    {SiteKey: "wildcard-key", ChallengeURL: "/verify"},
+		"*.eu.example.com": {SiteKey: "eu-key", ChallengeURL: ""},
+	}
+	bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	tmpl := template.Must(template.New("challenge").Parse("{{ .SiteKey }}|{{ .Provider }}|{{ .ChallengeURL }}"))
+	bc.site.tmpl.parsed.Store(tmpl)
+	for _, s := range bc.hosts {
+		s.tmpl.parsed.Store(tmpl)
+	}
+	for _, w := range bc.wildcardHosts {
+		w.site.tmpl.parsed.Store(tmpl)
+	}
+
+	tests := []struct {
+		host     string
+		location string
+		page     string
+	}{
+		{host: "shop.example.com", location: "/challenge", page: "shop-key|hcaptcha|/challenge"},
+		{host: "SHOP.example.com.:8443", location: "/challenge", page: "shop-key|hcaptcha|/challenge"},
+		{host: "blog.example.com", location: "/verify", page: "wildcard-key|turnstile|/verify"},
+		{host: "a.b.example.com", location: "/verify", page: "wildcard-key|turnstile|/verify"},
+		{host: "de.eu.example.com", location: "/challenge", page: "eu-key|turnstile|/challenge"},
+		{host: "example.com", location: "/challenge", page: "default-key|turnstile|/challenge"},
+		{host: "other.com", location: "/challenge", page: "default-key|turnstile|/challenge"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.host, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://"+tc.host+"/page", nil)
+			req.RemoteAddr = "1.2.3.4:1234"
+			rr := httptest.NewRecorder()
+			bc.ServeHTTP(rr, req)
+			if location := rr.Header().Get("Location"); rr.Code != http.StatusFound || !strings.HasPrefix(location, tc.location+"?destination=") {
+				t.Fatalf("expected a redirect to %s, got %d %s", tc.location, rr.Code, location)
+			}
+
+			req = httptest.NewRequest(http.MethodGet, "http://"+tc.host+tc.location+"?destination=%2Fpage", nil)
+			req.RemoteAddr = "1.2.3.4:1234"
+			rr = httptest.NewRecorder()
+			bc.ServeHTTP(rr, req)
+			if rr.Body.String() != tc.page {
+				t.Errorf("expected %q got %q", tc.page, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestHostsConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		hosts map[string]HostConfig
+	}{
+		{name: "Unknown provider", hosts: map[string]HostConfig{"example.com": {CaptchaProvider: "nocaptcha"}}},
+		{name: "Challenge URL is the whole site", hosts: map[string]HostConfig{"example.com": {ChallengeURL: "/"}}},
+		{name: "Challenge URL is not a path", hosts: map[string]HostConfig{"example.com": {ChallengeURL: "challenge"}}},
+		{name: "Wildcard in the middle", hosts: map[string]HostConfig{"www.*.example.com": {}}},
+		{name: "Bare wildcard", hosts: map[string]HostConfig{"*": {}}},
+		{name: "Blank host", hosts: map[string]HostConfig{"": {}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.ProtectRoutes = []string{"/"}
+			config.Hosts = tc.hosts
+			if _, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect"); err == nil || !strings.Contains(err.Error(), "invalid") {
+				t.Errorf("expected an invalid hosts error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestChallengeAccessibility(t *testing.T) {
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/challenge?destination=%2F", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	req.Header.Set("Accept-Language", "de")
+	rr := httptest.NewRecorder()
+	bc.ServeHTTP(rr, req)
+
+	page := rr.Body.String()
+	for _, e := range []string{
+		"<noscript>",
+		"Zur Überprüfung Ihrer Verbindung wird JavaScript benötigt.",
+		`role="status" aria-live="polite"`,
+		`data-error-callback="captchaError"`,
+		`<button type="submit" id="captcha-submit" hidden>Weiter</button>`,
+	} {
+		if !strings.Contains(page, e) {
+			t.Errorf("expected the challenge page to contain %s", e)
+		}
+	}
+	if strings.Contains(page, `id="pow-start"`) {
+		t.Error("expected no proof of work without powFallback")
+	}
+	if strings.Contains(page, `id="captcha-help"`) || strings.Contains(page, "api/fallback") {
+		t.Error("expected no provider help for turnstile")
+	}
+}
+
+func TestChallengeWithoutJavaScript(t *testing.T) {
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.CaptchaProvider = "recaptcha"
+	config.SiteKey = "site-key"
+	bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/challenge?destination=%2Fshop", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	rr := httptest.NewRecorder()
+	bc.ServeHTTP(rr, req)
+
+	// reCAPTCHA can be solved in a frame, and its code pasted into the form
+	page := rr.Body.String()
+	for _, e := range []string{
+		`<iframe src="https://www.google.com/recaptcha/api/fallback?k=site-key&amp;hl=en"`,
+		`<textarea name="g-recaptcha-response"`,
+		"copy the code it shows into the box",
+		`<p id="captcha-help">If you can&#39;t solve the pictures, select the headphones button`,
+	} {
+		if !strings.Contains(page, e) {
+			t.Errorf("expected the challenge page to contain %s, got %s", e, page)
+		}
+	}
+	if csp := rr.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "frame-src https://www.google.com/recaptcha/") {
+		t.Errorf("expected the fallback frame to be allowed, got %s", csp)
+	}
+
+	// the form posts the pasted code like the widget would
+	bc.site.captchaConfig.validate = siteverify(t, `{"success": true}`)
+	form := url.Values{"g-recaptcha-response": {"pasted"}, "destination": {"%2Fshop"}}
+	req = httptest.NewRequest(http.MethodPost, "http://example.com/challenge", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "1.2.3.4:1234"
+	rr = httptest.NewRecorder()
+	bc.ServeHTTP(rr, req)
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "/shop" {
+		t.Errorf("expected a redirect to the destination, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+}
+
+func TestPowFallback(t *testing.T) {
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.PowFallback = "true"
+	config.PowDifficulty = 4
+	bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/challenge?destination=%2Fshop", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	rr := httptest.NewRecorder()
+	bc.ServeHTTP(rr, req)
+
+	m := regexp.MustCompile(`id="pow-start" data-challenge="([^"]+)" data-difficulty="4"`).FindStringSubmatch(rr.Body.String())
+	if m == nil {
+		t.Fatalf("expected a proof of work on the challenge page, got %s", rr.Body.String())
+	}
+	challenge := m[1]
+
+	verify := func(ip, nonce string) int {
+		form := url.Values{"pow": {challenge}, "pow-nonce": {nonce}, "destination": {"%2Fshop"}}
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/challenge", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = ip + ":1234"
+		rr := httptest.NewRecorder()
+		bc.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	nonce := pow.Solve(challenge, 4)
+	if code := verify("5.6.7.8", nonce); code != http.StatusForbidden {
+		t.Errorf("expected a solution from another IP to fail, got %d", code)
+	}
+	unsolved := "x"
+	for pow.Solved(challenge, unsolved, 4) {
+		unsolved += "x"
+	}
+	if code := verify("1.2.3.4", unsolved); code != http.StatusForbidden {
+		t.Errorf("expected an unsolved nonce to fail, got %d", code)
+	}
+	if code := verify("1.2.3.4", nonce); code != http.StatusFound {
+		t.Fatalf("expected the solution to pass, got %d", code)
+	}
+	if _, ok := bc.caches.verified.Get(netip.MustParsePrefix("1.2.3.4/32")); !ok {
+		t.Error("expected the client to be verified")
+	}
+
+	// without powFallback a proof of work is not a response
+	bc.pow = nil
+	if code := verify("1.2.3.4", nonce); code != http.StatusBadRequest {
+		t.Errorf("expected a proof of work to be ignored, got %d", code)
+	}
+
+	config.PowDifficulty = 33
+	if _, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect"); err == nil {
+		t.Error("expected an error for powDifficulty 33")
+	}
+}
+
+// siteverify answers captcha verifications with response
+func siteverify(t *testing.T, response string) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(rw, response)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestChallengeRetry(t *testing.T) {
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.MaxChallengeAttempts = 3
+	bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ip := netip.MustParseAddr("1.2.3.4")
+
+	verify := func(response string) *httptest.ResponseRecorder {
+		form := url.Values{"cf-turnstile-response": {response}, "destination": {"/shop?page=2"}}
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/challenge", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "1.2.3.4:1234"
+		rr := httptest.NewRecorder()
+		bc.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rejected := `{"success": false, "error-codes": ["invalid-input-response"]}`
+	tests := []struct {
+		name       string
+		siteverify string
+		response   string
+		expected   int
+		body       string
+		attempts   int
+	}{
+		{name: "Missing response", response: "", expected: http.StatusBadRequest, body: "Please complete the verification before continuing."},
+		{name: "Rejected", siteverify: rejected, response: "bad", expected: http.StatusForbidden, body: "The verification didn&#39;t succeed.", attempts: 1},
+		{name: "Missing response isn't counted", response: "", expected: http.StatusBadRequest, body: "Please complete the verification before continuing.", attempts: 1},
+		{name: "Expired", siteverify: `{"success": false, "error-codes": ["timeout-or-duplicate"]}`, response: "old", expected: http.StatusForbidden, body: "The verification expired.", attempts: 2},
+		{name: "Too many attempts", siteverify: rejected, response: "bad", expected: http.StatusTooManyRequests, body: "Verification failed", attempts: 3},
+	}
+
+	for _, tc := range tests {
+		if tc.siteverify != "" {
+			bc.site.captchaConfig.validate = siteverify(t, tc.siteverify)
+		}
+		rr := verify(tc.response)
+		if rr.Code != tc.expected || !strings.Contains(rr.Body.String(), tc.body) {
+			t.Fatalf("%s: expected %d %q, got %d %s", tc.name, tc.expected, tc.body, rr.Code, rr.Body.String())
+		}
+		if bc.failedAttempts(ip) != tc.attempts {
+			t.Errorf("%s: expected %d failed attempts, got %d", tc.name, tc.attempts, bc.failedAttempts(ip))
+		}
+		if rr.Code != http.StatusTooManyRequests {
+			// the challenge is shown again for the same destination
+			for _, e := range []string{`role="alert"`, `name="destination" value="/shop?page=2"`} {
+				if !strings.Contains(rr.Body.String(), e) {
+					t.Errorf("%s: expected the page to contain %s", tc.name, e)
+				}
+			}
+		}
+	}
+
+	// the limit is kept until the attempts expire, without asking the provider
+	bc.site.captchaConfig.validate = siteverify(t, `{"success": true}`)
+	if rr := verify("good"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected a client over the limit to be refused, got %d", rr.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/challenge?destination=%2F", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	rr := httptest.NewRecorder()
+	bc.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the failed page instead of a challenge, got %d", rr.Code)
+	}
+
+	// passing resets the count
+	bc.attempts.Set(hostPrefix(ip), 1, lru.DefaultExpiration)
+	if rr := verify("good"); rr.Code != http.StatusFound || rr.Header().Get("Location") != "/shop?page=2" {
+		t.Errorf("expected a redirect to the destination, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+	if bc.failedAttempts(ip) != 0 {
+		t.Errorf("expected the failed attempts to be reset, got %d", bc.failedAttempts(ip))
+	}
+
+	config.MaxChallengeAttempts = -1
+	if _, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect"); err == nil {
+		t.Error("expected an error for maxChallengeAttempts -1")
+	}
+	config.MaxChallengeAttempts = 5
+	config.ChallengeAttemptsTTL = 0
+	if _, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect"); err == nil {
+		t.Error("expected an error for challengeAttemptsTTL 0")
+	}
+	config.ChallengeAttemptsTTL = 3600
+	config.MaxAttemptEntries = -1
+	if _, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect"); err == nil {
+		t.Error("expected an error for maxAttemptEntries -1")
+	}
+}
+
+func TestChallengeRetryData(t *testing.T) {
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.MaxChallengeAttempts = 0
+	bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	bc.site.tmpl.parsed.Store(template.Must(template.New("challenge").Parse("{{ .Retry }} {{ .Error }} {{ .Destination }}")))
+	bc.site.captchaConfig.validate = siteverify(t, `{"success": false}`)
+
+	verify := func(form string) string {
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/challenge", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "1.2.3.4:1234"
+		rr := httptest.NewRecorder()
+		bc.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+
+	// without a limit the challenge is shown again however often it fails
+	for i := 1; i <= 10; i++ {
+		if got, expected := verify("cf-turnstile-response=bad&destination=%2Fshop"), fmt.Sprintf("%d failed /shop", i); got != expected {
+			t.Fatalf("expected %q got %q", expected, got)
+		}
+	}
+	if got := verify("destination=%2Fshop"); got != "10 missing /shop" {
+		t.Errorf("expected a missing response not to be counted, got %q", got)
+	}
+}
+
+func TestPreserveBody(t *testing.T) {
+	for _, challengeURL := range []string{"/challenge", ""} {
+		t.Run("challengeURL "+challengeURL, func(t *testing.T) {
+			config := CreateConfig()
+			config.ProtectRoutes = []string{"/"}
+			config.ProtectHttpMethods = []string{"GET", "POST"}
+			config.ChallengeURL = challengeURL
+			config.RateLimit = 0
+			config.PreserveBody = "true"
+			bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			bc.site.captchaConfig.validate = siteverify(t, `{"success": true}`)
+
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/comment?id=1", strings.NewReader("name=a&text=%3Cb%3Ehi%3C%2Fb%3E&name=b"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.RemoteAddr = "1.2.3.4:1234"
+			rr := httptest.NewRecorder()
+			bc.ServeHTTP(rr, req)
+
+			// the challenge page posts the token back
+			page := rr.Body.String()
+			if challengeURL != "" {
+				location := rr.Header().Get("Location")
+				if !strings.Contains(location, "&body=") {
+					t.Fatalf("expected the body token in the redirect, got %s", location)
+				}
+				req = httptest.NewRequest(http.MethodGet, "http://example.com"+location, nil)
+				req.RemoteAddr = "1.2.3.4:1234"
+				rr = httptest.NewRecorder()
+				bc.ServeHTTP(rr, req)
+				page = rr.Body.String()
+			}
+			token := regexp.MustCompile(`name="body" value="([^"]+)"`).FindStringSubmatch(page)
+			if token == nil {
+				t.Fatalf("expected the body token on the challenge page, got %s", page)
+			}
+			if strings.Contains(page, "%3Cb%3Ehi") {
+				t.Error("expected the body to stay on the server")
+			}
+
+			verify := func(token string) *httptest.ResponseRecorder {
+				form := "cf-turnstile-response=ok&destination=" + url.QueryEscape(url.QueryEscape("/comment?id=1")) + "&body=" + token
+				req := httptest.NewRequest(http.MethodPost, "http://example.com/challenge", strings.NewReader(form))
+				if challengeURL == "" {
+					req = httptest.NewRequest(http.MethodPost, "http://example.com/comment?challenge=true", strings.NewReader(form))
+				}
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				req.RemoteAddr = "1.2.3.4:1234"
+				rr := httptest.NewRecorder()
+				bc.ServeHTTP(rr, req)
+				return rr
+			}
+
+			// a wrong token is redirected without the body, and doesn't use it up
+			if rr := verify("d3Jvbmc"); rr.Code != http.StatusFound {
+				t.Fatalf("expected a redirect for a wrong token, got %d", rr.Code)
+			}
+
+			rr = verify(token[1])
+			body := rr.Body.String()
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected the replay page, got %d %s", rr.Code, body)
+			}
+			for _, e := range []string{
+				`action="/comment?id=1"`,
+				`<input type="hidden" name="name" value="a">`,
+				`<input type="hidden" name="text" value="&lt;b&gt;hi&lt;/b&gt;">`,
+				`<input type="hidden" name="name" value="b">`,
+			} {
+				if !strings.Contains(body, e) {
+					t.Errorf("expected the replay page to contain %s, got %s", e, body)
+				}
+			}
+			if strings.Index(body, `value="a"`) > strings.Index(body, `value="b"`) {
+				t.Error("expected the fields in their original order")
+			}
+
+			// a body is only replayed once
+			if rr := verify(token[1]); rr.Code != http.StatusFound {
+				t.Errorf("expected a redirect the second time, got %d", rr.Code)
+			}
+		})
+	}
+}
+
+func TestPreserveBodyTokens(t *testing.T) {
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.ProtectHttpMethods = []string{"POST"}
+	config.RateLimit = 0
+	config.PreserveBody = "true"
+	bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	bc.site.captchaConfig.validate = siteverify(t, `{"success": true}`)
+
+	// tabs behind the same IP post before any passes the challenge
+	var tokens []string
+	for _, text := range []string{"first", "second", "third"} {
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/comment", strings.NewReader("text="+text))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "1.2.3.4:1234"
+		rr := httptest.NewRecorder()
+		bc.ServeHTTP(rr, req)
+		u, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil || u.Query().Get("body") == "" {
+			t.Fatalf("expected the body token in the redirect, got %s", rr.Header().Get("Location"))
+		}
+		tokens = append(tokens, u.Query().Get("body"))
+	}
+
+	tests := []struct {
+		name        string
+		ip          string
+		destination string
+		token       string
+		expected    string
+	}{
+		{name: "Another client", ip: "5.6.7.8", destination: "%2Fcomment", token: tokens[0]},
+		{name: "Another path", ip: "1.2.3.4", destination: "%2Faccount%2Fdelete", token: tokens[1]},
+		{name: "Same client and path", ip: "1.2.3.4", destination: "%2Fcomment%3Fpage%3D2", token: tokens[2], expected: `value="third"`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			form := url.Values{"cf-turnstile-response": {"ok"}, "destination": {tc.destination}, "body": {tc.token}}
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/challenge", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.RemoteAddr = tc.ip + ":1234"
+			rr := httptest.NewRecorder()
+			bc.ServeHTTP(rr, req)
+			if tc.expected == "" {
+				if rr.Code != http.StatusFound || strings.Contains(rr.Body.String(), "text") {
+					t.Errorf("expected a redirect without the post, got %d %s", rr.Code, rr.Body.String())
+				}
+				return
+			}
+			if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), tc.expected) {
+				t.Errorf("expected the post to be replayed, got %d %s", rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestPreserveBodySkipped(t *testing.T) {
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.ProtectHttpMethods = []string{"POST"}
+	config.RateLimit = 0
+	config.PreserveBody = "true"
+	config.MaxBodySize = 16
+	bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{name: "Too large", contentType: "application/x-www-form-urlencoded", body: "text=" + strings.Repeat("a", 16)},
+		{name: "JSON", contentType: "application/json", body: `{"a":1}`},
+		{name: "Multipart", contentType: "multipart/form-data; boundary=x", body: "--x--"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/form", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", tc.contentType)
+			req.RemoteAddr = "1.2.3.4:1234"
+			rr := httptest.NewRecorder()
+			bc.ServeHTTP(rr, req)
+			if location := rr.Header().Get("Location"); rr.Code != http.StatusFound || strings.Contains(location, "body=") {
+				t.Errorf("expected a redirect without a body token, got %d %s", rr.Code, location)
+			}
+		})
+	}
+
+	config.MaxBodySize = 0
+	if _, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect"); err == nil {
+		t.Error("expected an error for maxBodySize 0")
+	}
+}
+
+func TestGeoRules(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	countries := geoDatabase{
+		"192.0.2.1":    {"country.iso_code": "CA"},
+		"198.51.100.1": {"country.iso_code": "US"},
+		"203.0.113.1":  {"country.iso_code": "US"},
+		"203.0.113.2":  {"registered_country.iso_code": "KP"},
+	}
+	asns := geoDatabase{
+		"198.51.100.1": {"autonomous_system_number": uint64(16509), "autonomous_system_organization": "AMAZON-02"},
+		"203.0.113.1":  {"autonomous_system_number": uint64(7922), "autonomous_system_organization": "COMCAST-7922"},
+	}
+
+	tests := []struct {
+		name     string
+		ip       string
+		requests int
+		expected int
+		body     string
+	}{
+		{name: "Exempt country", ip: "192.0.2.1", requests: 5, expected: http.StatusOK},
+		{name: "Lower rate limit for a hosting ASN", ip: "198.51.100.1", requests: 2, expected: http.StatusTooManyRequests, body: "US 16509 AMAZON-02"},
+		{name: "Country rate limit", ip: "203.0.113.1", requests: 3, expected: http.StatusOK},
+		{name: "Country rate limit tripped", ip: "203.0.113.1", requests: 4, expected: http.StatusTooManyRequests},
+		{name: "Challenged country", ip: "203.0.113.2", requests: 1, expected: http.StatusTooManyRequests, body: "KP 0 "},
+		{name: "Unknown IP uses rateLimit", ip: "1.2.3.4", requests: 5, expected: http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.ProtectRoutes = []string{"/"}
+			config.ChallengeURL = ""
+			config.RateLimit = 100
+			bc, err := NewCaptchaProtect(context.Background(), next, config, "captcha-protect")
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			bc.geo = geo.New(countries, asns)
+			bc.geoExempt, _ = geo.NewRules([]string{"ca"}, nil)
+			bc.geoChallenge, _ = geo.NewRules([]string{"KP"}, []string{"AS4134"})
+			bc.geoLimits, _ = geo.NewLimits(map[string]uint{"US": 3}, map[string]uint{"amazon": 1})
+			bc.site.tmpl.parsed.Store(template.Must(template.New("challenge").Parse("{{ .Country }} {{ .ASN }} {{ .ASOrganization }}")))
+
+			var rr *httptest.ResponseRecorder
+			for i := 0; i < tc.requests; i++ {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+				req.RemoteAddr = tc.ip + ":1234"
+				rr = httptest.NewRecorder()
+				bc.ServeHTTP(rr, req)
+			}
+			if rr.Code != tc.expected {
+				t.Errorf("expected %d got %d", tc.expected, rr.Code)
+			}
+			if tc.body != "" && rr.Body.String() != tc.body {
+				t.Errorf("expected body %q got %q", tc.body, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestGeoConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(*Config)
+	}{
+		{name: "Countries without geoipDatabase", config: func(c *Config) { c.ChallengeCountries = []string{"KP"} }},
+		{name: "ASNs without asnDatabase", config: func(c *Config) { c.ASNRateLimits = map[string]uint{"AS16509": 5} }},
+		{name: "Invalid country", config: func(c *Config) { c.ExemptCountries = []string{"Canada"} }},
+		{name: "Missing database", config: func(c *Config) { c.ASNDatabase = "/nonexistent/GeoLite2-ASN.mmdb" }},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.ProtectRoutes = []string{"/"}
+			tc.config(config)
+			if _, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect"); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func BenchmarkGetClientIP(b *testing.B) {
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.IPForwardedHeader = "X-Forwarded-For"
+	bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+	if err != nil {
+		b.Fatalf("unexpected error %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("X-Forwarded-For", "2001:db8::1, 1.2.3.4, 10.0.0.1")
+	req.RemoteAddr = "10.0.0.2:1234"
+
+	b.ReportAllocs()
+	for b.Loop() {
+		bc.getClientIP(req)
+	}
+}
+
+// exemptIps are checked for every forwarded hop, so partner lists with thousands of ranges are on the hot path
+func BenchmarkGetClientIPManyExemptIps(b *testing.B) {
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.IPForwardedHeader = "X-Forwarded-For"
+	for i := 0; i < 10000; i++ {
+		config.ExemptIPs = append(config.ExemptIPs, fmt.Sprintf("%d.%d.%d.0/24", 100+i>>16, (i>>8)&255, i&255))
+	}
+	bc, err := NewCaptchaProtect(context.Background(), nil, config, "captcha-protect")
+	if err != nil {
+		b.Fatalf("unexpected error %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("X-Forwarded-For", "2001:db8::1, 1.2.3.4, 100.0.0.1")
+	req.RemoteAddr = "10.0.0.2:1234"
+
+	b.ReportAllocs()
+	for b.Loop() {
+		bc.getClientIP(req)
+	}
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.RateLimit = 1 << 30
+	bc, err := NewCaptchaProtect(context.Background(), next, config, "captcha-protect")
+	if err != nil {
+		b.Fatalf("unexpected error %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	rw := httptest.NewRecorder()
+	bc.isGoodBot(req, netip.MustParseAddr("1.2.3.4"))
+
+	b.ReportAllocs()
+	for b.Loop() {
+		bc.ServeHTTP(rw, req)
+	}
+}
+
+func BenchmarkServeHTTPParallel(b *testing.B) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	config := CreateConfig()
+	config.ProtectRoutes = []string{"/"}
+	config.RateLimit = 1 << 30
+	config.MaxRateEntries = 0
+	bc, err := NewCaptchaProtect(context.Background(), next, config, "captcha-protect")
+	if err != nil {
+		b.Fatalf("unexpected error %v", err)
+	}
+
+	var workers atomic.Uint32
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		// each worker sends requests from its own pool of subnets
+		worker := workers.Add(1)
+		reqs := make([]*http.Request, 256)
+		for i := range reqs {
+			reqs[i] = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			reqs[i].RemoteAddr = fmt.Sprintf("%d.%d.1.1:1234", worker, i)
+			ip, _ := bc.getClientIP(reqs[i])
+			bc.isGoodBot(reqs[i], ip)
+		}
+		rw := httptest.NewRecorder()
+
+		i := 0
+		for pb.Next() {
+			bc.ServeHTTP(rw, reqs[i%len(reqs)])
+			i++
+		}
+	})
+}